@@ -233,7 +233,8 @@ func (d *Document) applyPathPart(input any, op Operation) (any, Error) {
 				if !hasCoercedKey {
 					// Fast path: string key on a string map. Use keystr directly
 					// to avoid boxing it into interface{}.
-					if wantMap && op.Kind == OpDelete {
+					if _, exists := m[keystr]; op.Kind == OpDelete && (atLeaf || !exists) {
+						// Deleting a missing nested value is a no-op.
 						delete(m, keystr)
 					} else {
 						var result any
@@ -266,7 +267,7 @@ func (d *Document) applyPathPart(input any, op Operation) (any, Error) {
 			}
 
 			if m, ok := input.(map[any]any); ok {
-				if wantMap && op.Kind == OpDelete {
+				if _, exists := m[key]; op.Kind == OpDelete && (atLeaf || !exists) {
 					delete(m, key)
 				} else {
 					v := m[key]
@@ -299,17 +300,17 @@ func (d *Document) applyPathPart(input any, op Operation) (any, Error) {
 	return input, nil
 }
 
-func (d *Document) applySwap(input any, op Operation) (any, Error) {
+func (d *Document) applySwap(input any, op Operation, budget *queryBudget) (any, Error) {
 	rightPath, ok := op.Value.(string)
 	if !ok {
 		return nil, d.error(1, "swap operation value must be a path string, got %T", op.Value)
 	}
 	// First, get both left & right values from the input.
-	left, okl, err := GetPath(op.Path, input, GetOptions{DebugLogger: d.options.DebugLogger})
+	left, okl, err := GetPath(op.Path, input, GetOptions{DebugLogger: d.options.DebugLogger, budget: budget})
 	if err != nil {
 		return nil, err
 	}
-	right, okr, err := GetPath(rightPath, input, GetOptions{DebugLogger: d.options.DebugLogger})
+	right, okr, err := GetPath(rightPath, input, GetOptions{DebugLogger: d.options.DebugLogger, budget: budget})
 	if err != nil {
 		return nil, err
 	}
@@ -348,7 +349,7 @@ func (d *Document) applySwap(input any, op Operation) (any, Error) {
 	})
 }
 
-func (d *Document) applyOp(input any, op Operation) (any, Error) {
+func (d *Document) applyOp(input any, op Operation, budget *queryBudget) (any, Error) {
 	d.expression = op.Path
 	d.pos = 0
 	d.buf.Reset()
@@ -357,7 +358,7 @@ func (d *Document) applyOp(input any, op Operation) (any, Error) {
 	case OpSet, OpDelete:
 		return d.applyPathPart(input, op)
 	case OpSwap:
-		return d.applySwap(input, op)
+		return d.applySwap(input, op, budget)
 	}
 
 	return nil, d.error(1, "unknown operation kind %d", op.Kind)
@@ -241,6 +241,25 @@ var applyExamples = []struct {
 		Input: "{bar: undefined}",
 		JSON:  `{"foo": true}`,
 	},
+	{
+		Name: "Unset nested property",
+		Existing: map[string]interface{}{
+			"foo": map[string]interface{}{
+				"bar": 1,
+				"baz": 2,
+			},
+		},
+		Input: "{foo.bar: undefined}",
+		JSON:  `{"foo": {"baz": 2}}`,
+	},
+	{
+		Name: "Unset missing nested property",
+		Existing: map[string]interface{}{
+			"foo": true,
+		},
+		Input: "{bar.baz: undefined}",
+		JSON:  `{"foo": true}`,
+	},
 	{
 		Name: "Unset array item",
 		Existing: map[string]interface{}{
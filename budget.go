@@ -0,0 +1,105 @@
+package shorthand
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrStepLimit is wrapped by the error returned when a query takes more than
+// `GetOptions.MaxSteps` steps, or applying a document more than
+// `ParseOptions.MaxSteps`.
+var ErrStepLimit = errors.New("query step limit exceeded")
+
+// cancelCheckInterval is the number of steps a query takes between checks of
+// whether its context is done.
+const cancelCheckInterval = 256
+
+// queryBudget counts the steps taken by a query and stops it when the limit
+// is reached or its context is done. A query shares its budget with all of
+// its nested queries.
+type queryBudget struct {
+	ctx   context.Context
+	max   int
+	steps int
+}
+
+// spend takes a step, returning an error if the limit is exceeded or the
+// context is done. A nil budget is unlimited.
+func (b *queryBudget) spend() error {
+	if b == nil {
+		return nil
+	}
+	b.steps++
+	if b.max > 0 && b.steps > b.max {
+		return ErrStepLimit
+	}
+	if b.ctx != nil && b.steps%cancelCheckInterval == 1 {
+		return b.ctx.Err()
+	}
+	return nil
+}
+
+// spend takes a step of the query's budget, returning an error pointing to
+// the running segment if the budget is used up or the context is done.
+func (q *Query) spend(segment *compiledSegment, budget *queryBudget) Error {
+	if budget == nil {
+		return nil
+	}
+	return q.budgetError(segment, budget, budget.spend())
+}
+
+// budgetError converts an error from spending the budget into one pointing
+// to the running segment.
+func (q *Query) budgetError(segment *compiledSegment, budget *queryBudget, err error) Error {
+	if err == nil {
+		return nil
+	}
+	length := uint(len(segment.expression))
+	if errors.Is(err, ErrStepLimit) {
+		return wrapError(&q.expression, segment.offset, length, err, "query exceeded the limit of %d steps", budget.max)
+	}
+	return wrapError(&q.expression, segment.offset, length, err, "query canceled: %v", err)
+}
+
+// applyBudgetError converts an error from spending the budget of applying a
+// document into one pointing to the path of the running operation.
+func applyBudgetError(path string, budget *queryBudget, err error) Error {
+	length := uint(len(path))
+	if errors.Is(err, ErrStepLimit) {
+		return wrapError(&path, 0, length, err, "apply exceeded the limit of %d steps", budget.max)
+	}
+	return wrapError(&path, 0, length, err, "apply canceled: %v", err)
+}
+
+// GetPathContext is like `GetPath` but stops with an error wrapping the
+// context's error once the context is done.
+func GetPathContext(ctx context.Context, path string, input any, options GetOptions) (any, bool, Error) {
+	cache := options.Cache
+	if cache == nil {
+		cache = defaultQueryCache
+	}
+	query, err := cache.compile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return query.ExecContext(ctx, input, options)
+}
+
+// ExecContext is like `Exec` but stops with an error wrapping the context's
+// error once the context is done. The context is checked periodically as the
+// query runs, so long-running filters and recursive searches stop as well.
+func (q *Query) ExecContext(ctx context.Context, input any, options GetOptions) (any, bool, Error) {
+	if options.budget == nil {
+		options.budget = &queryBudget{ctx: ctx, max: options.MaxSteps}
+	}
+	return q.Exec(input, options)
+}
+
+// withBudget sets up the step limit of a query unless it has no limit or is
+// nested within another query, which it then shares the budget of.
+func (options GetOptions) withBudget() GetOptions {
+	if options.budget == nil && options.MaxSteps > 0 {
+		options.budget = &queryBudget{max: options.MaxSteps}
+	}
+	return options
+}
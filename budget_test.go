@@ -0,0 +1,122 @@
+package shorthand
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deepInput creates nested maps and arrays with `width` items per level.
+func deepInput(depth, width int) any {
+	if depth == 0 {
+		return map[string]any{"id": 1}
+	}
+	items := make([]any, width)
+	for i := range items {
+		items[i] = map[string]any{"id": i, "children": deepInput(depth-1, width)}
+	}
+	return items
+}
+
+func TestGetMaxSteps(t *testing.T) {
+	input := map[string]any{"items": deepInput(4, 8)}
+
+	for _, query := range []string{
+		`items | ..id`,
+		`items[id > 100]`,
+		`items.{id, children: children[id > 2].id}`,
+	} {
+		_, _, err := GetPath(query, input, GetOptions{MaxSteps: 5})
+		require.Error(t, err, query)
+		assert.True(t, errors.Is(err, ErrStepLimit), query)
+		assert.Contains(t, err.Error(), "query exceeded the limit of 5 steps")
+
+		// The same query works with enough steps.
+		_, _, err = GetPath(query, input, GetOptions{MaxSteps: 100000})
+		require.NoError(t, err, query)
+	}
+
+	// The error points to the segment which used up the budget.
+	_, _, err := GetPath(`items | ..id`, input, GetOptions{MaxSteps: 5})
+	require.Error(t, err)
+	assert.Equal(t, uint(8), err.Offset())
+	assert.Equal(t, uint(4), err.Length())
+
+	query, qerr := CompileQuery(`..id`)
+	require.NoError(t, qerr)
+	_, err = query.FindPaths(input, GetOptions{MaxSteps: 5})
+	assert.True(t, errors.Is(err, ErrStepLimit))
+
+	err = query.Each(input, GetOptions{MaxSteps: 5}, func(any) bool { return true })
+	assert.True(t, errors.Is(err, ErrStepLimit))
+}
+
+func TestExecContext(t *testing.T) {
+	input := map[string]any{"items": deepInput(4, 8)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := GetPathContext(ctx, `items | ..id`, input, GetOptions{})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Contains(t, err.Error(), "query canceled")
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	query, qerr := CompileQuery(`items[id > 100]`)
+	require.NoError(t, qerr)
+	_, _, err = query.ExecContext(ctx, input, GetOptions{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	result, found, err := GetPathContext(context.Background(), `items[0].id`, input, GetOptions{MaxSteps: 100})
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 0, result)
+}
+
+func TestApplyContext(t *testing.T) {
+	d := Document{Operations: []Operation{{Kind: OpSet, Path: "a.b", Value: 1}}}
+
+	result, err := d.ApplyContext(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": map[string]any{"b": 1}}, result)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.ApplyContext(ctx, nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestApplyMaxSteps(t *testing.T) {
+	d := NewDocument(ParseOptions{MaxSteps: 2})
+	d.Operations = []Operation{
+		{Kind: OpSet, Path: "a", Value: 1},
+		{Kind: OpSet, Path: "b", Value: 2},
+		{Kind: OpSet, Path: "c", Value: 3},
+	}
+	_, err := d.Apply(nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrStepLimit))
+	assert.Contains(t, err.Error(), "apply exceeded the limit of 2 steps")
+
+	// The queries getting the values of a swap share the budget.
+	input := map[string]any{"items": deepInput(4, 8), "other": 1}
+	d = NewDocument(ParseOptions{MaxSteps: 50})
+	d.Operations = []Operation{{Kind: OpSwap, Path: "other", Value: "..id"}}
+	_, err = d.Apply(input)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrStepLimit))
+	assert.Contains(t, err.Error(), "query exceeded the limit of 50 steps")
+
+	d = NewDocument(ParseOptions{MaxSteps: 50})
+	d.Operations = []Operation{{Kind: OpSwap, Path: "a", Value: "b"}}
+	result, err := d.Apply(map[string]any{"a": 1, "b": 2})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": 2, "b": 1}, result)
+}
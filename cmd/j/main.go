@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -55,6 +56,177 @@ func marshalOutput(result any, format string) ([]byte, error) {
 	}
 }
 
+// streamRecords runs the query against each record read from `stdin` and
+// writes each result to `out` as it goes, so memory use stays bounded unless
+// `slurp` is set. Results are written as JSON Lines, a CBOR sequence, YAML
+// documents, or one line of shorthand each.
+func streamRecords(stdin io.Reader, out io.Writer, streamFormat, query, format string, slurp bool, debugLog func(string, ...any)) error {
+	options := shorthand.StreamOptions{
+		Slurp: slurp,
+		ParseOptions: shorthand.ParseOptions{
+			EnableObjectDetection: true,
+			ForceStringKeys:       format == "json",
+			DebugLogger:           debugLog,
+		},
+		GetOptions: shorthand.GetOptions{DebugLogger: debugLog},
+	}
+	switch streamFormat {
+	case "lines":
+		options.Format = shorthand.StreamLines
+	case "cbor":
+		options.Format = shorthand.StreamCBOR
+	default:
+		return fmt.Errorf("unsupported stream format %q", streamFormat)
+	}
+
+	var q *shorthand.Query
+	if query != "" {
+		var err shorthand.Error
+		if q, err = shorthand.CompileQuery(query); err != nil {
+			return err
+		}
+	}
+
+	var write func(result any) error
+	switch format {
+	case "json":
+		write = func(result any) error {
+			b, err := json.Marshal(shorthand.ConvertMapString(result))
+			if err != nil {
+				return err
+			}
+			_, err = out.Write(append(b, '\n'))
+			return err
+		}
+	case "cbor":
+		write = func(result any) error {
+			b, err := cbor.Marshal(result)
+			if err != nil {
+				return err
+			}
+			_, err = out.Write(b)
+			return err
+		}
+	case "yaml":
+		enc := yaml.NewEncoder(out)
+		defer enc.Close()
+		write = func(result any) error {
+			return enc.Encode(result)
+		}
+	case "shorthand":
+		write = shorthand.NewEncoder(out, shorthand.MarshalOptions{Spacer: " "}).Encode
+	default:
+		return fmt.Errorf("unsupported stream output format %q", format)
+	}
+
+	return shorthand.StreamQuery(stdin, q, options, write)
+}
+
+// editFile applies the shorthand patch in `args` to the file in-place, keeping
+// its comments and formatting intact.
+func editFile(filename string, args []string, options shorthand.ParseOptions) error {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	d := shorthand.NewDocument(options)
+	if err := d.Parse(strings.Join(args, " ")); err != nil {
+		return err
+	}
+
+	edited, err := d.ApplySource(string(src))
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, []byte(edited), info.Mode())
+}
+
+// formatFiles formats shorthand files, or stdin if no files are given. In
+// check mode the names of unformatted files are written to `out` instead of
+// their formatted contents. Returns whether all inputs were already formatted.
+func formatFiles(stdin io.Reader, out io.Writer, files []string, check, write bool) (bool, error) {
+	formatted := true
+
+	process := func(name string, src []byte) error {
+		result, err := shorthand.Format(string(src), shorthand.FormatOptions{})
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Pretty())
+		}
+		if result == string(src) {
+			if !check && !write {
+				fmt.Fprint(out, result)
+			}
+			return nil
+		}
+		formatted = false
+		switch {
+		case check:
+			fmt.Fprintln(out, name)
+		case write:
+			info, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(name, []byte(result), info.Mode())
+		default:
+			fmt.Fprint(out, result)
+		}
+		return nil
+	}
+
+	if len(files) == 0 {
+		src, err := io.ReadAll(stdin)
+		if err != nil {
+			return false, err
+		}
+		write = false
+		return formatted, process("<stdin>", src)
+	}
+
+	for _, name := range files {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return false, err
+		}
+		if err := process(name, src); err != nil {
+			return false, err
+		}
+	}
+
+	return formatted, nil
+}
+
+func newFmtCommand() *cobra.Command {
+	var check, write *bool
+
+	cmd := &cobra.Command{
+		Use:   "fmt [flags] [file ...]",
+		Short: "Format shorthand files",
+		Long:  "Format shorthand or JSON files into canonical shorthand, keeping comments and key order. Reads from stdin if no files are given.",
+		Run: func(cmd *cobra.Command, args []string) {
+			formatted, err := formatFiles(os.Stdin, cmd.OutOrStdout(), args, *check, *write)
+			if err != nil {
+				cmd.PrintErrln(err)
+				os.Exit(1)
+			}
+			if *check && !formatted {
+				os.Exit(1)
+			}
+		},
+	}
+
+	check = cmd.Flags().BoolP("check", "c", false, "List files which are not formatted and exit with a non-zero status")
+	write = cmd.Flags().BoolP("write", "w", false, "Write the result back to each file instead of stdout")
+
+	return cmd
+}
+
 func commandName(args0 string) string {
 	if base := filepath.Base(args0); base != "" && base != "." && base != string(filepath.Separator) {
 		return base
@@ -66,6 +238,9 @@ func main() {
 	var format *string
 	var verbose *bool
 	var query *string
+	var inPlace *string
+	var stream *string
+	var slurp *bool
 
 	var debugLog func(string, ...any)
 	name := commandName(os.Args[0])
@@ -74,21 +249,54 @@ func main() {
 		Use:     fmt.Sprintf("%s [flags] key1: value1, key2: value2, ...", name),
 		Short:   "Generate shorthand structured data",
 		Example: fmt.Sprintf("%s foo{bar: 1, baz: true}", name),
+		Args:    cobra.ArbitraryArgs,
 		Run: func(cmd *cobra.Command, args []string) {
+			if *inPlace != "" {
+				if err := editFile(*inPlace, args, shorthand.ParseOptions{
+					EnableFileInput:       true,
+					EnableObjectDetection: true,
+				}); err != nil {
+					if e, ok := err.(shorthand.Error); ok {
+						cmd.PrintErrln(e.Pretty())
+					} else {
+						cmd.PrintErrln(err)
+					}
+					os.Exit(1)
+				}
+				return
+			}
+
 			stdinPiped, err := isStdinPiped(os.Stdin)
 			if err != nil {
 				cmd.PrintErrf("Unable to inspect stdin: %v\n", err)
 				os.Exit(1)
 			}
-			if len(args) == 0 && *query == "" && !stdinPiped {
-				cmd.PrintErrln("At least one arg or --query must be provided")
-				os.Exit(1)
-			}
 			if *verbose {
 				debugLog = func(format string, a ...any) {
 					cmd.PrintErrf(format, a...)
 					cmd.PrintErrln()
 				}
+			}
+			if *stream != "" {
+				if len(args) > 0 {
+					cmd.PrintErrln("Args are not supported with --stream, use --query instead")
+					os.Exit(1)
+				}
+				if err := streamRecords(os.Stdin, cmd.OutOrStdout(), *stream, *query, *format, *slurp, debugLog); err != nil {
+					if e, ok := err.(shorthand.Error); ok {
+						cmd.PrintErrln(e.Pretty())
+					} else {
+						cmd.PrintErrln(err)
+					}
+					os.Exit(1)
+				}
+				return
+			}
+			if len(args) == 0 && *query == "" && !stdinPiped {
+				cmd.PrintErrln("At least one arg or --query must be provided")
+				os.Exit(1)
+			}
+			if *verbose {
 				cmd.PrintErrf("Input: %s\n", strings.Join(args, " "))
 			}
 			result, isStructured, err := shorthand.GetInput(args, shorthand.ParseOptions{
@@ -137,6 +345,11 @@ func main() {
 	format = cmd.Flags().StringP("format", "f", "json", "Output format [json, cbor, yaml, toml, shorthand]")
 	verbose = cmd.Flags().BoolP("verbose", "v", false, "Enable verbose output")
 	query = cmd.Flags().StringP("query", "q", "", "Path to query")
+	inPlace = cmd.Flags().StringP("in-place", "i", "", "Edit a shorthand or JSON file in-place, keeping comments")
+	stream = cmd.Flags().StringP("stream", "s", "", "Query each record of a stream from stdin [lines, cbor]")
+	slurp = cmd.Flags().Bool("slurp", false, "With --stream, query an array of all records instead of each one")
+
+	cmd.AddCommand(newFmtCommand())
 
 	if err := cmd.Execute(); err != nil {
 		cmd.PrintErrln(err)
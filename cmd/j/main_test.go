@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -126,3 +128,142 @@ func TestCommandNameFallsBackToJ(t *testing.T) {
 		t.Fatalf("expected fallback name, got %q", got)
 	}
 }
+
+func TestEditFileKeepsComments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.sh5")
+	if err := os.WriteFile(filename, []byte("// Server\nserver.port: 8080 // default\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := editFile(filename, []string{"server.port: 8081"}, shorthand.ParseOptions{EnableObjectDetection: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "// Server\nserver.port: 8081 // default\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestFormatFilesCheck(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.sh5")
+	bad := filepath.Join(dir, "bad.sh5")
+	if err := os.WriteFile(good, []byte("a: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bad, []byte("a:1,   b :2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	formatted, err := formatFiles(nil, &out, []string{good, bad}, true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if formatted {
+		t.Fatal("expected unformatted files to be reported")
+	}
+	if out.String() != bad+"\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestFormatFilesWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.sh5")
+	if err := os.WriteFile(filename, []byte("// Comment\na:1,   b :2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := formatFiles(nil, &out, []string{filename}, false, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "// Comment\na: 1\nb: 2\n" {
+		t.Fatalf("unexpected output: %q", result)
+	}
+}
+
+func TestFormatFilesStdin(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := formatFiles(strings.NewReader(`{"a": [1,2]}`), &out, nil, false, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "{a: [1, 2]}\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestStreamRecords(t *testing.T) {
+	input := "{\"id\": 1, \"tags\": [\"a\"]}\n\nid: 2, tags: [b, c]\n"
+
+	for _, example := range []struct {
+		name   string
+		query  string
+		format string
+		slurp  bool
+		output string
+	}{
+		{name: "json", query: "tags", format: "json", output: "[\"a\"]\n[\"b\",\"c\"]\n"},
+		{name: "shorthand", query: "{id}", format: "shorthand", output: "id: 1\nid: 2\n"},
+		{name: "yaml", query: "id", format: "yaml", output: "1\n---\n2\n"},
+		{name: "no query", format: "json", output: "{\"id\":1,\"tags\":[\"a\"]}\n{\"id\":2,\"tags\":[\"b\",\"c\"]}\n"},
+		{name: "slurp", query: "sumBy(id)", format: "json", slurp: true, output: "3\n"},
+	} {
+		t.Run(example.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := streamRecords(strings.NewReader(input), &out, "lines", example.query, example.format, example.slurp, nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.String() != example.output {
+				t.Fatalf("unexpected output: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestStreamRecordsCBORRoundTrip(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := streamRecords(strings.NewReader("id: 1\nid: 2\n"), &encoded, "lines", "", "cbor", false, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := streamRecords(&encoded, &out, "cbor", "id", "json", false, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "1\n2\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestStreamRecordsErrors(t *testing.T) {
+	for _, example := range []struct {
+		name         string
+		input        string
+		streamFormat string
+		query        string
+		format       string
+		err          string
+	}{
+		{name: "stream format", streamFormat: "xml", format: "json", err: `unsupported stream format "xml"`},
+		{name: "output format", streamFormat: "lines", format: "toml", err: `unsupported stream output format "toml"`},
+		{name: "query", streamFormat: "lines", query: "a[", format: "json", err: "expected ']'"},
+		{name: "record", input: "id: 1\n{\n", streamFormat: "lines", format: "json", err: "record 2:"},
+	} {
+		t.Run(example.name, func(t *testing.T) {
+			err := streamRecords(strings.NewReader(example.input), &bytes.Buffer{}, example.streamFormat, example.query, example.format, false, nil)
+			if err == nil || !strings.Contains(err.Error(), example.err) {
+				t.Fatalf("expected error containing %q, got %v", example.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package shorthand
+
+import (
+	"strings"
+)
+
+// queryOperand is a side of a fallback like `name || "unknown"` or a branch
+// of a conditional. It is either a query or, if the query is nil, a literal
+// value like `"unknown"`, `0`, or `null`.
+type queryOperand struct {
+	query   *Query
+	literal any
+}
+
+// exec gets the value of the operand for an input. Literals are always found.
+// When finding paths, the input is found at the given location and the
+// location of the value is returned, which literals don't have.
+func (o queryOperand) exec(input any, at *location, options GetOptions) (any, bool, *location, Error) {
+	if o.query == nil {
+		return o.literal, true, at.notFound(), nil
+	}
+	if at == nil {
+		value, found, err := o.query.Exec(input, options)
+		return value, found, nil, err
+	}
+	if o.query.scoped && options.scope == nil {
+		options.scope = &queryScope{root: input}
+	}
+	return o.query.execAt(input, at, options)
+}
+
+// compiledFallbackOp gets the first operand which doesn't fall back to the
+// next, e.g. `nickname ?? name || "unknown"`. Each operator comes before the
+// operand with the same index plus one.
+type compiledFallbackOp struct {
+	operands  []queryOperand
+	operators []string
+}
+
+// compiledConditionalOp gets the first branch if the condition matches the
+// current value and the second otherwise, e.g. `if status == ok then value
+// else error`. Without an `else` branch the value is not found.
+type compiledConditionalOp struct {
+	cond     compiledFilterOp
+	branches []queryOperand
+}
+
+// fallsBack returns whether a fallback operator moves on to the next operand.
+// Both do so for missing and null values, while `||` also does so for false
+// and empty strings, arrays, and maps.
+func fallsBack(operator string, value any, found bool) bool {
+	if !found || value == nil {
+		return true
+	}
+	if operator == "??" {
+		return false
+	}
+	switch v := value.(type) {
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	case map[any]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// operatorToken is a fallback operator or conditional keyword found outside
+// of quotes and brackets, along with its offset in the query.
+type operatorToken struct {
+	text   string
+	offset uint
+}
+
+// conditionalKeywords are the words of a conditional, which must be
+// surrounded by whitespace or the ends of the segment.
+var conditionalKeywords = []string{"if", "then", "else"}
+
+// scanOperators finds the update and fallback operators and conditional
+// keywords from the current position to the end of the segment, i.e. the next
+// pipe which isn't part of `||` or `|=`. It returns the tokens and the offset
+// of the end.
+func (d *Document) scanOperators() ([]operatorToken, uint) {
+	expr := d.expression
+	end := uint(len(expr))
+	var tokens []operatorToken
+	depth := 0
+	for i := d.pos; i < end; i++ {
+		c := expr[i]
+		switch {
+		case c == '\\':
+			i++
+		case c == '"':
+			for i++; i < end && expr[i] != '"'; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+		case c == '[' || c == '{' || c == '(':
+			depth++
+		case c == ']' || c == '}' || c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case depth > 0:
+		case c == '|':
+			if i+1 < end && (expr[i+1] == '|' || expr[i+1] == '=') {
+				tokens = append(tokens, operatorToken{text: expr[i : i+2], offset: i})
+				i++
+				continue
+			}
+			return tokens, i
+		case c == '?' && i+1 < end && expr[i+1] == '?':
+			tokens = append(tokens, operatorToken{text: "??", offset: i})
+			i++
+		case i == d.pos || isSpace(expr[i-1]):
+			for _, word := range conditionalKeywords {
+				after := i + uint(len(word))
+				if strings.HasPrefix(expr[i:], word) && (after == end || isSpace(expr[after]) || expr[after] == '|') {
+					tokens = append(tokens, operatorToken{text: word, offset: i})
+					i = after
+					break
+				}
+			}
+		}
+	}
+	return tokens, end
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// compileOperators compiles a segment which is an update, a conditional, or
+// uses fallback operators, consuming the rest of the segment. It returns false
+// without consuming anything for other segments.
+func (d *Document) compileOperators() (compiledOp, bool, Error) {
+	tokens, end := d.scanOperators()
+	if len(tokens) == 0 {
+		return nil, false, nil
+	}
+
+	var op compiledOp
+	var err Error
+	for _, token := range tokens {
+		if token.text == "|=" {
+			// Updates take everything else on either side, e.g. `a |= b || c`.
+			op, err = d.compileUpdate(token, end)
+			d.pos = end
+			return op, true, err
+		}
+	}
+	// A lone `if` is still a key, e.g. `if | length`.
+	first := tokens[0]
+	if first.text == "if" && strings.TrimSpace(d.expression[d.pos:first.offset]) == "" && strings.TrimSpace(d.expression[first.offset+2:end]) != "" {
+		op, err = d.compileConditional(tokens, end)
+	} else {
+		op, err = d.compileFallback(tokens, end)
+		if op == nil && err == nil {
+			return nil, false, nil
+		}
+	}
+	d.pos = end
+	return op, true, err
+}
+
+// compileFallback compiles operands separated by `||` or `??`. An operand
+// starting with `if` is a conditional taking up the rest of the segment. It
+// returns nil if there are no fallback operators.
+func (d *Document) compileFallback(tokens []operatorToken, end uint) (compiledOp, Error) {
+	op := compiledFallbackOp{}
+	start := d.pos
+	for _, token := range tokens {
+		if token.text != "||" && token.text != "??" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(d.expression[start:token.offset]), "if ") {
+			break
+		}
+		operand, err := d.compileOperand(start, token.offset, token)
+		if err != nil {
+			return nil, err
+		}
+		op.operands = append(op.operands, operand)
+		op.operators = append(op.operators, token.text)
+		start = token.offset + 2
+	}
+	if len(op.operators) == 0 {
+		return nil, nil
+	}
+
+	operand, err := d.compileOperand(start, end, operatorToken{text: op.operators[len(op.operators)-1], offset: start - 2})
+	if err != nil {
+		return nil, err
+	}
+	op.operands = append(op.operands, operand)
+	return op, nil
+}
+
+// compileConditional compiles `if cond then a else b`, where the condition is
+// a filter expression run against the current value. An `else` belongs to the
+// closest `if` without one.
+func (d *Document) compileConditional(tokens []operatorToken, end uint) (compiledOp, Error) {
+	ifToken := tokens[0]
+	then := -1
+	for i, token := range tokens[1:] {
+		if token.text == "then" {
+			then = i + 1
+			break
+		}
+	}
+	if then == -1 {
+		return nil, NewError(&d.expression, ifToken.offset, 2, "expected 'then' after if condition")
+	}
+
+	thenToken := tokens[then]
+	condStart := ifToken.offset + 2
+	cond := strings.TrimSpace(d.expression[condStart:thenToken.offset])
+	if cond == "" {
+		return nil, NewError(&d.expression, ifToken.offset, 2, "expected condition after if")
+	}
+	condStart += uint(strings.Index(d.expression[condStart:], cond))
+	filter, err := compileMexpr(d, cond, condStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var elseToken *operatorToken
+	nested := 0
+	for i := then + 1; i < len(tokens) && elseToken == nil; i++ {
+		switch tokens[i].text {
+		case "if":
+			nested++
+		case "else":
+			if nested == 0 {
+				elseToken = &tokens[i]
+			}
+			nested--
+		}
+	}
+
+	op := compiledConditionalOp{cond: filter.op(cond, condStart)}
+	thenEnd := end
+	if elseToken != nil {
+		thenEnd = elseToken.offset
+	}
+	branch, err := d.compileOperand(thenToken.offset+4, thenEnd, thenToken)
+	if err != nil {
+		return nil, err
+	}
+	op.branches = append(op.branches, branch)
+	if elseToken != nil {
+		branch, err := d.compileOperand(elseToken.offset+4, end, *elseToken)
+		if err != nil {
+			return nil, err
+		}
+		op.branches = append(op.branches, branch)
+	}
+	return op, nil
+}
+
+// compileOperand compiles the operand between two offsets, which is a literal
+// if it is only a quoted string, number, boolean, or null. The token is the
+// operator or keyword the operand belongs to, used to report a missing value.
+func (d *Document) compileOperand(start, end uint, token operatorToken) (queryOperand, Error) {
+	text := strings.TrimSpace(d.expression[start:end])
+	if text == "" {
+		return queryOperand{}, NewError(&d.expression, token.offset, uint(len(token.text)), "expected value for %s", token.text)
+	}
+	start += uint(strings.Index(d.expression[start:end], text))
+
+	if text[0] == '"' {
+		od := Document{expression: text}
+		od.next()
+		if err := od.parseQuoted(false); err == nil && od.pos == uint(len(text)) {
+			return queryOperand{literal: od.buf.String()}, nil
+		}
+	} else if value, ok := coerceValue(text, false); ok {
+		return queryOperand{literal: value}, nil
+	}
+
+	query, err := d.queryCache.compile(text)
+	if err != nil {
+		return queryOperand{}, d.rebaseError(start, err)
+	}
+	return queryOperand{query: query}, nil
+}
+
+// execFallback gets the value of the first operand which doesn't fall back,
+// along with its location when finding paths.
+func (q *Query) execFallback(op compiledFallbackOp, input any, at *location, options GetOptions) (any, bool, *location, Error) {
+	for i, operand := range op.operands {
+		value, found, valueAt, err := operand.exec(input, at, options)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		if i == len(op.operators) || !fallsBack(op.operators[i], value, found) {
+			if at != nil && operand.query == nil {
+				return nil, false, nil, q.createsValueError(0, uint(len(q.expression)), value)
+			}
+			return value, found, valueAt, nil
+		}
+	}
+	return nil, false, at.notFound(), nil
+}
+
+// conditionalBranch returns the branch of a conditional for an input, or
+// false if the condition doesn't match and there is no `else` branch.
+func (q *Query) conditionalBranch(op compiledConditionalOp, input any, options GetOptions) (queryOperand, bool, Error) {
+	matches, err := q.filterMatcher(op.cond, options)
+	if err != nil {
+		return queryOperand{}, false, err
+	}
+	matched, err := matches(input)
+	if err != nil {
+		return queryOperand{}, false, err
+	}
+	if matched {
+		return op.branches[0], true, nil
+	}
+	if len(op.branches) > 1 {
+		return op.branches[1], true, nil
+	}
+	return queryOperand{}, false, nil
+}
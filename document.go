@@ -2,6 +2,8 @@ package shorthand
 
 import (
 	"bytes"
+	"context"
+	"strings"
 )
 
 type OpKind int
@@ -35,6 +37,17 @@ type ParseOptions struct {
 	// differentiating between `float64` and `int64`.
 	ForceFloat64Numbers bool
 
+	// EnableSpecialFloats parses the unquoted values `NaN`, `+Inf` and `-Inf`
+	// as floats, which is how `MarshalOptions.RoundTrip` writes them. By default
+	// they are strings.
+	EnableSpecialFloats bool
+
+	// MaxSteps limits the work `Document.Apply` can do, counting each
+	// operation and each step taken by the queries which get the values of a
+	// swap. Applying more steps fails with an error wrapping `ErrStepLimit`.
+	// Zero means no limit.
+	MaxSteps int
+
 	// DebugLogger sets a function to be used for printing out debug information.
 	DebugLogger func(format string, a ...any)
 }
@@ -54,6 +67,9 @@ type Document struct {
 	lastWidth         uint
 	autoWrappedObject bool
 	buf               bytes.Buffer
+
+	// queryCache is used to compile nested queries and filters, if set.
+	queryCache *QueryCache
 }
 
 func NewDocument(options ParseOptions) *Document {
@@ -67,27 +83,13 @@ func (d *Document) Parse(input string) Error {
 	d.pos = 0
 	d.autoWrappedObject = false
 
-	if d.options.EnableObjectDetection {
-		// Try and determine if this is actually an object without the outer
-		// `{` and `}` surrounding it. We re-use `parseProp`` for this as it
-		// already handles things like quotes, escaping, etc.
-		for {
-			_, err := d.parseProp("", false)
-			if err != nil {
-				break
-			}
-			r := d.next()
-			if r == ':' || r == '^' {
-				// We have found an object! Wrap it and continue.
-				d.expression = "{" + input + "}"
-				d.autoWrappedObject = true
-				if d.options.DebugLogger != nil {
-					d.options.DebugLogger("Detected object, wrapping in { and }")
-				}
-				break
-			}
+	if d.options.EnableObjectDetection && d.detectObject() {
+		// We have found an object! Wrap it and continue.
+		d.expression = "{" + input + "}"
+		d.autoWrappedObject = true
+		if d.options.DebugLogger != nil {
+			d.options.DebugLogger("Detected object, wrapping in { and }")
 		}
-		d.pos = 0
 	}
 
 	err := d.parseValue("", true, false)
@@ -95,17 +97,61 @@ func (d *Document) Parse(input string) Error {
 		return err
 	}
 	d.skipWhitespace()
-	d.skipComments(d.peek())
+	for strings.HasPrefix(d.expression[d.pos:], "//") {
+		d.skipComments(d.next())
+	}
 	if !d.expect(-1) {
 		return d.error(1, "Expected EOF but found additional input: %s", runeStr(d.peek()))
 	}
 	return nil
 }
 
+// detectObject tries to determine if the expression is actually an object
+// without the outer `{` and `}` surrounding it. We re-use `parseProp` for this
+// as it already handles things like quotes, escaping, etc. The position is
+// reset to the start of the expression afterward.
+func (d *Document) detectObject() bool {
+	if _, ok := coerceValue(strings.TrimSpace(d.expression), false); ok {
+		// Scalars like timestamps contain `:` but are not objects.
+		return false
+	}
+
+	defer func() { d.pos = 0 }()
+	for {
+		_, err := d.parseProp("", false)
+		if err != nil {
+			return false
+		}
+		r := d.next()
+		if r == ':' || r == '^' {
+			return true
+		}
+	}
+}
+
 func (d *Document) Apply(input interface{}) (interface{}, Error) {
+	return d.ApplyContext(context.Background(), input)
+}
+
+// ApplyContext is like `Apply` but stops with an error wrapping the context's
+// error once the context is done, checking it before each operation and while
+// getting the values of a swap.
+func (d *Document) ApplyContext(ctx context.Context, input interface{}) (interface{}, Error) {
+	var budget *queryBudget
+	if ctx.Done() != nil || d.options.MaxSteps > 0 {
+		budget = &queryBudget{ctx: ctx, max: d.options.MaxSteps}
+	}
+
 	var err Error
 	for _, op := range d.Operations {
-		input, err = d.applyOp(input, op)
+		stepErr := ctx.Err()
+		if stepErr == nil {
+			stepErr = budget.spend()
+		}
+		if stepErr != nil {
+			return nil, applyBudgetError(op.Path, budget, stepErr)
+		}
+		input, err = d.applyOp(input, op, budget)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,515 @@
+package shorthand
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sourceWidth is the line width used when rendering multiline values into
+// shorthand source. Laying values out to a width writes the commas between
+// array items, which a newline alone doesn't separate.
+const sourceWidth = 80
+
+// textEdit replaces the source text between `start` and `end` with `text`.
+type textEdit struct {
+	start uint
+	end   uint
+	text  string
+}
+
+// applyTextEdits applies non-overlapping edits to the source. Overlapping
+// removals are merged, and insertions at the same offset keep their order.
+func applyTextEdits(src string, edits []textEdit) string {
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start
+	})
+
+	var sb strings.Builder
+	pos := uint(0)
+	for _, edit := range edits {
+		if edit.start < pos {
+			// Merge overlapping removals.
+			if edit.end > pos {
+				pos = edit.end
+			}
+			continue
+		}
+		sb.WriteString(src[pos:edit.start])
+		sb.WriteString(edit.text)
+		pos = edit.end
+	}
+	sb.WriteString(src[pos:])
+
+	return sb.String()
+}
+
+// sourceEditor applies a single operation to source text using its syntax
+// tree, generating the minimal set of text edits needed.
+type sourceEditor struct {
+	src     string
+	options ParseOptions
+	op      Operation
+	edits   []textEdit
+	removed map[*syntaxEntry]bool
+
+	// json is set when the source looks like JSON, i.e. all keys are quoted
+	// and all values are JSON literals, in which case new keys and values are
+	// rendered as JSON as well.
+	json bool
+}
+
+// ApplySource applies the document's operations to shorthand or JSON source
+// text rather than to decoded data, returning the edited source. Only the
+// spans touched by the operations are changed, so comments, blank lines,
+// quoting style and key order are preserved everywhere else.
+//
+//	d := shorthand.NewDocument(shorthand.ParseOptions{})
+//	d.Parse("server.port: 8081")
+//	edited, err := d.ApplySource(config)
+func (d *Document) ApplySource(src string) (string, Error) {
+	// Files referenced by the source are left as-is rather than loaded.
+	options := d.options
+	options.EnableFileInput = false
+
+	for _, op := range d.Operations {
+		var err Error
+		src, err = applySourceOp(src, op, options)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return src, nil
+}
+
+func applySourceOp(src string, op Operation, options ParseOptions) (string, Error) {
+	// Validate with the real parser first, which also provides good errors.
+	decoded, err := Unmarshal(src, options, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if op.Kind == OpSwap {
+		// Swaps are converted into set/delete operations using the values from
+		// the decoded source, just like `applySwap` does.
+		rightPath, ok := op.Value.(string)
+		if !ok {
+			return "", NewError(&op.Path, 0, uint(len(op.Path)), "swap operation value must be a path string, got %T", op.Value)
+		}
+		left, okl, err := GetPath(op.Path, decoded, GetOptions{DebugLogger: options.DebugLogger})
+		if err != nil {
+			return "", err
+		}
+		right, okr, err := GetPath(rightPath, decoded, GetOptions{DebugLogger: options.DebugLogger})
+		if err != nil {
+			return "", err
+		}
+		ops := []Operation{{Kind: OpSet, Path: op.Path, Value: right}, {Kind: OpSet, Path: rightPath, Value: left}}
+		if !okr {
+			ops[0] = Operation{Kind: OpDelete, Path: op.Path}
+		}
+		if !okl {
+			ops[1] = Operation{Kind: OpDelete, Path: rightPath}
+		}
+		for _, op := range ops {
+			if src, err = applySourceOp(src, op, options); err != nil {
+				return "", err
+			}
+		}
+		return src, nil
+	}
+
+	root, err := parseSyntax(src, options)
+	if err != nil {
+		return "", err
+	}
+
+	if options.DebugLogger != nil {
+		options.DebugLogger("Editing source at path %s", op.Path)
+	}
+
+	e := &sourceEditor{src: src, options: options, op: op, removed: map[*syntaxEntry]bool{}}
+	e.json = root.braced && len(root.entries) > 0 && e.isJSON(root)
+	if err := e.editNode(root, splitPath(op.Path)); err != nil {
+		return "", err
+	}
+
+	return applyTextEdits(src, e.edits), nil
+}
+
+// editNode applies the operation at the relative path `parts` to `node`.
+func (e *sourceEditor) editNode(node *syntaxNode, parts []pathPart) Error {
+	if len(parts) > 0 {
+		switch {
+		case node.kind == syntaxObject && !parts[0].index:
+			return e.editObject(node, parts)
+		case node.kind == syntaxArray && parts[0].index:
+			if ok, err := e.editArray(node, parts); ok || err != nil {
+				return err
+			}
+		}
+	}
+
+	// Fall back to re-rendering the entire node with the operation applied to
+	// its decoded value.
+	return e.rerender(node, parts)
+}
+
+// rerender decodes the node, applies the remainder of the operation to it and
+// replaces the node's source with the rendered result.
+func (e *sourceEditor) rerender(node *syntaxNode, parts []pathPart) Error {
+	var value any
+	var err Error
+	if node.braced || node.kind != syntaxObject || len(node.entries) > 0 {
+		if value, err = e.decode(node); err != nil {
+			return err
+		}
+	}
+
+	if value, err = e.applyTo(value, parts); err != nil {
+		return err
+	}
+
+	if !node.braced {
+		// Top-level object without braces, so render the entries only.
+		text := e.renderEntries(value, node)
+		e.edits = append(e.edits, textEdit{start: node.start, end: node.end, text: text})
+		return nil
+	}
+
+	e.edits = append(e.edits, textEdit{
+		start: node.start,
+		end:   node.end,
+		text:  e.renderValue(value, e.lineIndent(node.start), node.multiline),
+	})
+	return nil
+}
+
+// decode parses the source of a single node into a value.
+func (e *sourceEditor) decode(node *syntaxNode) (any, Error) {
+	options := e.options
+	options.EnableObjectDetection = !node.braced
+	return Unmarshal(e.src[node.start:node.end], options, nil)
+}
+
+// applyTo applies the operation with a relative path to a decoded value.
+func (e *sourceEditor) applyTo(value any, parts []pathPart) (any, Error) {
+	d := Document{options: e.options}
+	return d.applyOp(value, Operation{Kind: e.op.Kind, Path: joinPath(parts), Value: e.op.Value}, nil)
+}
+
+func (e *sourceEditor) editObject(node *syntaxNode, parts []pathPart) Error {
+	editCount := len(e.edits)
+	var lastExact, lastPrefix *syntaxEntry
+	exactIndex, prefixIndex := -1, -1
+
+	for i, entry := range node.entries {
+		if entry.sep == '^' {
+			continue
+		}
+		if len(entry.parts) > len(parts) && hasPathPrefix(entry.parts, parts) {
+			// Entries below the path are always replaced or removed.
+			e.remove(node, i)
+		} else if len(entry.parts) == len(parts) && hasPathPrefix(parts, entry.parts) {
+			if e.op.Kind == OpDelete {
+				e.remove(node, i)
+			}
+			lastExact, exactIndex = entry, i
+		} else if len(entry.parts) > 0 && hasPathPrefix(parts, entry.parts) {
+			lastPrefix, prefixIndex = entry, i
+		}
+	}
+
+	if e.op.Kind == OpDelete {
+		if lastPrefix != nil {
+			return e.editNode(lastPrefix.value, parts[len(lastPrefix.parts):])
+		}
+		return nil
+	}
+
+	if lastExact != nil && exactIndex > prefixIndex {
+		e.replaceValue(node, lastExact, e.op.Value)
+		return nil
+	}
+
+	if lastPrefix != nil {
+		return e.editNode(lastPrefix.value, parts[len(lastPrefix.parts):])
+	}
+
+	// Nothing matched, so add a new entry to the object.
+	if e.lastEntry(node) == nil && (node.braced || len(node.entries) > 0) {
+		// Replace the whole object instead, dropping any removals above.
+		e.edits = e.edits[:editCount]
+		return e.rerender(node, parts)
+	}
+
+	value := e.op.Value
+	if len(parts) > 1 {
+		var err Error
+		if value, err = e.applyTo(nil, parts[1:]); err != nil {
+			return err
+		}
+	}
+
+	var text string
+	if e.json {
+		text = quoteString(parts[0].key) + ": " + e.renderValue(value, e.entryIndent(node), node.multiline)
+	} else {
+		options := MarshalOptions{Spacer: " "}
+		if node.multiline {
+			options.Indent = "  "
+			options.MaxWidth = sourceWidth
+		}
+		text = parts[0].raw + renderValue(options, 0, true, value)
+		text = strings.ReplaceAll(text, "\n", "\n"+e.entryIndent(node))
+	}
+
+	e.insert(node, text)
+	return nil
+}
+
+// editArray edits an array item, returning false if the operation can't be
+// applied in-place and the array should be re-rendered instead.
+func (e *sourceEditor) editArray(node *syntaxNode, parts []pathPart) (bool, Error) {
+	raw := parts[0].key
+
+	if raw == "" {
+		// Append to the array.
+		if e.op.Kind == OpDelete {
+			return true, nil
+		}
+		if len(parts) > 1 || len(node.entries) == 0 {
+			return false, nil
+		}
+		e.insert(node, e.renderValue(e.op.Value, e.entryIndent(node), node.multiline))
+		return true, nil
+	}
+
+	insert := strings.HasPrefix(raw, "^")
+	index, err := strconv.Atoi(strings.TrimPrefix(raw, "^"))
+	if err != nil {
+		return false, nil
+	}
+	if index < 0 {
+		index += len(node.entries)
+	}
+	if index < 0 || index >= len(node.entries) {
+		return false, nil
+	}
+	entry := node.entries[index]
+
+	if insert {
+		if len(parts) > 1 || e.op.Kind == OpDelete {
+			return false, nil
+		}
+		text := e.renderValue(e.op.Value, e.entryIndent(node), node.multiline) + ","
+		if node.multiline {
+			text += "\n" + e.lineIndent(entry.leadingStart())
+		} else {
+			text += " "
+		}
+		e.edits = append(e.edits, textEdit{start: entry.leadingStart(), end: entry.leadingStart(), text: text})
+		return true, nil
+	}
+
+	if len(parts) > 1 {
+		return true, e.editNode(entry.value, parts[1:])
+	}
+
+	if e.op.Kind == OpDelete {
+		e.remove(node, index)
+	} else {
+		e.replaceValue(node, entry, e.op.Value)
+	}
+	return true, nil
+}
+
+// replaceValue replaces the value of an existing entry.
+func (e *sourceEditor) replaceValue(node *syntaxNode, entry *syntaxEntry, value any) {
+	text := e.renderValue(value, e.lineIndent(entry.start), node.multiline || entry.value.multiline)
+	start := entry.value.start
+	if entry.sep == '{' && !strings.HasPrefix(text, "{") {
+		// `foo{...}` needs a colon when replaced with a non-object value.
+		start = entry.keyEnd
+		text = ": " + text
+	}
+	e.edits = append(e.edits, textEdit{start: start, end: entry.value.end, text: text})
+}
+
+// insert adds a new entry with the given source text at the end of an object
+// or array, following the existing layout and use of commas.
+func (e *sourceEditor) insert(node *syntaxNode, text string) {
+	if last := e.lastEntry(node); last == nil {
+		// Top-level object without braces and without entries.
+		prefix := ""
+		end := len(strings.TrimRight(e.src, " \t\r\n"))
+		if end > 0 {
+			prefix = "\n"
+		}
+		e.edits = append(e.edits, textEdit{start: uint(end), end: uint(len(e.src)), text: prefix + text + "\n"})
+		return
+	}
+
+	last := e.lastEntry(node)
+	commas := node.kind == syntaxArray || e.json || !node.multiline || node.entries[0].comma
+
+	if commas && !last.comma {
+		e.edits = append(e.edits, textEdit{start: last.value.end, end: last.value.end, text: ","})
+	}
+
+	if node.multiline {
+		if commas && last.comma {
+			// Keep using trailing commas if the existing entries have them.
+			text += ","
+		}
+		pos := last.lineEnd()
+		e.edits = append(e.edits, textEdit{start: pos, end: pos, text: "\n" + e.lineIndent(last.start) + text})
+		return
+	}
+
+	pos := last.end()
+	e.edits = append(e.edits, textEdit{start: pos, end: pos, text: " " + text})
+}
+
+// lastEntry returns the last entry of a node which has not been removed.
+func (e *sourceEditor) lastEntry(node *syntaxNode) *syntaxEntry {
+	for i := len(node.entries) - 1; i >= 0; i-- {
+		if !e.removed[node.entries[i]] {
+			return node.entries[i]
+		}
+	}
+	return nil
+}
+
+// remove deletes the entry at `index` including its comments and separators.
+func (e *sourceEditor) remove(node *syntaxNode, index int) {
+	entry := node.entries[index]
+	e.removed[entry] = true
+	start := entry.leadingStart()
+	end := entry.lineEnd()
+
+	lineStart := strings.LastIndexByte(e.src[:start], '\n') + 1
+	lineEnd := strings.IndexByte(e.src[end:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(e.src)
+	} else {
+		lineEnd += int(end)
+	}
+
+	if strings.TrimSpace(e.src[lineStart:start]) == "" && strings.TrimSpace(e.src[end:lineEnd]) == "" {
+		// The entry is on its own lines, so remove them entirely.
+		if lineEnd < len(e.src) {
+			lineEnd++
+		} else if lineStart > 0 {
+			lineStart--
+		}
+		e.edits = append(e.edits, textEdit{start: uint(lineStart), end: uint(lineEnd)})
+
+		if index == len(node.entries)-1 && index > 0 && !entry.comma && e.json {
+			// JSON does not allow trailing commas.
+			prev := node.entries[index-1]
+			if prev.comma {
+				e.edits = append(e.edits, textEdit{start: prev.commaPos, end: prev.commaPos + 1})
+			}
+		}
+		return
+	}
+
+	if index < len(node.entries)-1 {
+		e.edits = append(e.edits, textEdit{start: start, end: node.entries[index+1].leadingStart()})
+	} else if index > 0 {
+		e.edits = append(e.edits, textEdit{start: node.entries[index-1].value.end, end: entry.end()})
+	} else {
+		e.edits = append(e.edits, textEdit{start: start, end: entry.end()})
+	}
+}
+
+// isJSON returns whether all keys in the node are quoted and all values are
+// JSON literals.
+func (e *sourceEditor) isJSON(node *syntaxNode) bool {
+	for _, entry := range node.entries {
+		if node.kind == syntaxObject && !strings.HasPrefix(entry.key, `"`) {
+			return false
+		}
+		switch entry.value.kind {
+		case syntaxScalar:
+			raw := e.src[entry.value.start:entry.value.end]
+			if raw == "true" || raw == "false" || raw == "null" {
+				continue
+			}
+			if _, err := strconv.ParseFloat(raw, 64); err != nil {
+				return false
+			}
+		case syntaxObject, syntaxArray:
+			if !e.isJSON(entry.value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lineIndent returns the indentation of the line containing `pos`.
+func (e *sourceEditor) lineIndent(pos uint) string {
+	lineStart := strings.LastIndexByte(e.src[:pos], '\n') + 1
+	line := e.src[lineStart:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// entryIndent returns the indentation used for entries of a node.
+func (e *sourceEditor) entryIndent(node *syntaxNode) string {
+	if len(node.entries) > 0 {
+		return e.lineIndent(node.entries[0].start)
+	}
+	return e.lineIndent(node.start)
+}
+
+// renderValue renders a value for use in the source, matching the layout and
+// style of the surrounding code.
+func (e *sourceEditor) renderValue(value any, indent string, multiline bool) string {
+	if e.json {
+		var b []byte
+		var err error
+		if multiline {
+			b, err = json.MarshalIndent(value, indent, "  ")
+		} else {
+			b, err = json.Marshal(value)
+		}
+		if err == nil {
+			return string(b)
+		}
+	}
+
+	// Round-trip mode keeps braces on single-key objects, which would
+	// otherwise render as e.g. `foo.bar: 1`, and keeps float types intact.
+	options := MarshalOptions{Spacer: " ", RoundTrip: true}
+	if multiline {
+		options.Indent = "  "
+		options.MaxWidth = sourceWidth
+	}
+
+	text := renderValue(options, 0, false, value)
+	return strings.ReplaceAll(text, "\n", "\n"+indent)
+}
+
+// renderEntries renders the entries of a top-level object without braces.
+func (e *sourceEditor) renderEntries(value any, node *syntaxNode) string {
+	if !isMap(value) {
+		return Marshal(value, MarshalOptions{Spacer: " "})
+	}
+	if !node.multiline {
+		return MarshalCLI(value)
+	}
+
+	text := MarshalPretty(value)
+	if !strings.HasPrefix(text, "{") {
+		return text
+	}
+	lines := strings.Split(strings.TrimSuffix(strings.TrimPrefix(text, "{\n"), "\n}"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, "  ")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,171 @@
+package shorthand
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var applySourceExamples = []struct {
+	Name   string
+	Source string
+	Patch  string
+	Output string
+	Error  string
+}{
+	{
+		Name:   "Replace value keeps comments",
+		Source: "// Server config\nserver {\n  // The port\n  port: 8080 // default\n\n  host: localhost\n}\n",
+		Patch:  "server.port: 8081",
+		Output: "// Server config\nserver {\n  // The port\n  port: 8081 // default\n\n  host: localhost\n}\n",
+	},
+	{
+		Name:   "Add property",
+		Source: "server {\n  port: 8080\n  host: localhost\n}\n",
+		Patch:  "server.tls: true",
+		Output: "server {\n  port: 8080\n  host: localhost\n  tls: true\n}\n",
+	},
+	{
+		Name:   "Add nested property",
+		Source: "// Settings\nname: app\n",
+		Patch:  "a.b.c: 1",
+		Output: "// Settings\nname: app\na.b.c: 1\n",
+	},
+	{
+		Name:   "Remove property with comment",
+		Source: "server {\n  port: 8080\n  // The host\n  host: localhost\n}\n",
+		Patch:  "server.host: undefined",
+		Output: "server {\n  port: 8080\n}\n",
+	},
+	{
+		Name:   "Dotted keys",
+		Source: "foo.bar: 1 // comment\nfoo.baz: 2\n",
+		Patch:  "foo.bar: 3",
+		Output: "foo.bar: 3 // comment\nfoo.baz: 2\n",
+	},
+	{
+		Name:   "Replace dotted keys",
+		Source: "foo.a: 1\nfoo.b: 2\n",
+		Patch:  "foo: 5",
+		Output: "foo: 5\n",
+	},
+	{
+		Name:   "Inline",
+		Source: "a: 1, b: [1, 2, 3]",
+		Patch:  "b[1]: undefined, c: true",
+		Output: "a: 1, b: [1, 3], c: true",
+	},
+	{
+		Name:   "Inline remove last",
+		Source: "a: 1, b: 2",
+		Patch:  "b: undefined",
+		Output: "a: 1",
+	},
+	{
+		Name:   "JSON",
+		Source: "{\n  \"name\": \"app\",\n  \"version\": \"1.0.0\",\n  \"tags\": [\"a\", \"b\"]\n}\n",
+		Patch:  "version: 1.0.1, tags[]: c, new.nested: 1",
+		Output: "{\n  \"name\": \"app\",\n  \"version\": \"1.0.1\",\n  \"tags\": [\"a\", \"b\", \"c\"],\n  \"new\": {\n    \"nested\": 1\n  }\n}\n",
+	},
+	{
+		Name:   "JSON remove last",
+		Source: "{\n  \"name\": \"app\",\n  \"version\": \"1.0.0\"\n}\n",
+		Patch:  "version: undefined",
+		Output: "{\n  \"name\": \"app\"\n}\n",
+	},
+	{
+		Name:   "Array insert and append",
+		Source: "tags: [\n  a, // first\n  b\n]\n",
+		Patch:  "tags[^0]: z, tags[]: c",
+		Output: "tags: [\n  z,\n  a, // first\n  b,\n  c\n]\n",
+	},
+	{
+		Name:   "Array item property",
+		Source: "items: [\n  {id: 1, name: a},\n  // Second\n  {id: 2, name: b}\n]\n",
+		Patch:  "items[1].name: c",
+		Output: "items: [\n  {id: 1, name: a},\n  // Second\n  {id: 2, name: c}\n]\n",
+	},
+	{
+		Name:   "Swap",
+		Source: "a: 1 // one\nb: 2\n",
+		Patch:  "a ^ b",
+		Output: "a: 2 // one\nb: 1\n",
+	},
+	{
+		Name:   "Scalar becomes object",
+		Source: "x: 1\n",
+		Patch:  "x.y: 2",
+		Output: "x: {y: 2}\n",
+	},
+	{
+		Name:   "Object without colon",
+		Source: "x{\n  y: 1\n}\n",
+		Patch:  "x: 5",
+		Output: "x: 5\n",
+	},
+	{
+		Name:   "Empty source",
+		Source: "",
+		Patch:  "a.b: 1",
+		Output: "a.b: 1\n",
+	},
+	{
+		Name:   "Empty object",
+		Source: "// Comment\nfoo: {}\n",
+		Patch:  "foo.bar: 1",
+		Output: "// Comment\nfoo: {bar: 1}\n",
+	},
+	{
+		Name:   "Insert array",
+		Source: "a: 1\n",
+		Patch:  "b: [1, 2]",
+		Output: "a: 1\nb: [1, 2]\n",
+	},
+	{
+		Name:   "Insert nested object",
+		Source: "a: 1\n",
+		Patch:  "b: {c: [1, 2], d: {e: 1}}",
+		Output: "a: 1\nb.c: [1, 2]\nb.d.e: 1\n",
+	},
+	{
+		Name:   "Insert array of objects",
+		Source: "{\n  a: 1\n}\n",
+		Patch:  "b: [{c: 1}, {d: [1, 2]}]",
+		Output: "{\n  a: 1\n  b: [{c: 1}, {d: [1, 2]}]\n}\n",
+	},
+	{
+		Name:   "Invalid source",
+		Source: "foo: [1, 2",
+		Patch:  "foo: 1",
+		Error:  "Expected ',' or ']'",
+	},
+}
+
+func TestApplySource(t *testing.T) {
+	for _, example := range applySourceExamples {
+		t.Run(example.Name, func(t *testing.T) {
+			d := NewDocument(ParseOptions{EnableObjectDetection: true})
+			require.NoError(t, d.Parse(example.Patch))
+
+			out, err := d.ApplySource(example.Source)
+			if example.Error != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), example.Error)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, example.Output, out)
+
+			// The edited source must decode to the same result as applying the
+			// patch to the decoded source.
+			expected, err := Unmarshal(example.Source, ParseOptions{EnableObjectDetection: true}, nil)
+			require.NoError(t, err)
+			expected, err = d.Apply(expected)
+			require.NoError(t, err)
+			actual, err := Unmarshal(out, ParseOptions{EnableObjectDetection: true}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package shorthand
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// encodeFlushSize is how many bytes are buffered before an `Encoder` writes
+// them to the underlying writer.
+const encodeFlushSize = 32 * 1024
+
+// Encoder writes shorthand values to an output stream.
+type Encoder struct {
+	e encodeState
+}
+
+// NewEncoder returns a new encoder that writes to `w`. Output is buffered
+// internally and written in chunks, so large documents never need to be held
+// in memory as a single string.
+func NewEncoder(w io.Writer, options MarshalOptions) *Encoder {
+	return &Encoder{e: encodeState{options: options, w: w}}
+}
+
+// Encode writes the shorthand encoding of `v` to the stream followed by a
+// newline, so it can be called repeatedly to write newline-delimited records.
+// Once a write fails, that error is returned by all further calls.
+func (enc *Encoder) Encode(v any) error {
+	e := &enc.e
+	if e.err != nil {
+		return e.err
+	}
+
+	e.value(0, false, v)
+	e.writeByte('\n')
+	e.lineStart = len(e.buf)
+	e.flush()
+	return e.err
+}
+
+// encodeState renders shorthand into a single buffer, which is flushed to
+// `w` as it grows if set.
+type encodeState struct {
+	options MarshalOptions
+	buf     []byte
+	w       io.Writer
+	err     error
+
+	// fileDir, if set, is where `UseFile` writes large strings and binary
+	// data instead of rendering the `@file` placeholder.
+	fileDir string
+
+	// lineStart is the offset in `buf` where the current line starts. It is
+	// negative when the start of the line has already been flushed.
+	lineStart int
+
+	// limit stops rendering with `errTooWide` once the output is longer,
+	// which is used to check whether a value fits on the current line.
+	limit int
+
+	// trailing is the width of anything written after the next value on the
+	// same line, like the comma after an array item.
+	trailing int
+
+	// chain is the number of keys in the dotted path currently being written.
+	chain int
+}
+
+// errTooWide stops rendering a value which doesn't fit on a line.
+var errTooWide = errors.New("value is too wide")
+
+func (e *encodeState) flush() {
+	if e.w == nil || len(e.buf) == 0 {
+		return
+	}
+	if e.err == nil {
+		_, e.err = e.w.Write(e.buf)
+	}
+	e.lineStart -= len(e.buf)
+	e.buf = e.buf[:0]
+}
+
+func (e *encodeState) maybeFlush() {
+	if e.w != nil && len(e.buf) >= encodeFlushSize {
+		e.flush()
+	}
+	if e.limit > 0 && len(e.buf) > e.limit*utf8.UTFMax {
+		e.setError(errTooWide)
+	}
+}
+
+func (e *encodeState) writeString(s string) {
+	e.buf = append(e.buf, s...)
+	e.maybeFlush()
+}
+
+func (e *encodeState) writeByte(b byte) {
+	e.buf = append(e.buf, b)
+	e.maybeFlush()
+}
+
+// writeIndent writes a newline and indentation for the given level when
+// pretty-printing, otherwise nothing.
+func (e *encodeState) writeIndent(level int) {
+	if e.options.Indent == "" {
+		return
+	}
+	e.buf = append(e.buf, '\n')
+	e.lineStart = len(e.buf)
+	for i := 0; i < level; i++ {
+		e.buf = append(e.buf, e.options.Indent...)
+	}
+	e.maybeFlush()
+}
+
+// writeSeparator writes the separator between items at the given level.
+func (e *encodeState) writeSeparator(level int) {
+	if e.options.Indent != "" {
+		e.writeIndent(level)
+		return
+	}
+	e.writeByte(',')
+	e.writeString(e.options.Spacer)
+}
+
+// column returns the width of the current line so far.
+func (e *encodeState) column() int {
+	if e.lineStart < 0 {
+		// The line started in output which has already been flushed.
+		return -e.lineStart + utf8.RuneCount(e.buf)
+	}
+	return utf8.RuneCount(e.buf[e.lineStart:])
+}
+
+// fits returns whether a value can be written without line breaks and still
+// fit within `MaxWidth`.
+func (e *encodeState) fits(level int, fromKey bool, value any) bool {
+	m := encodeState{options: e.options, chain: e.chain}
+	m.options.Indent = ""
+	m.limit = e.options.MaxWidth - e.column() - e.trailing
+	if m.limit <= 0 {
+		return false
+	}
+	m.value(level, fromKey, value)
+	return m.err == nil && utf8.RuneCount(m.buf) <= m.limit
+}
+
+// writeBytes writes `%`-prefixed base64 in chunks to keep memory bounded.
+func (e *encodeState) writeBytes(b []byte) {
+	e.writeByte('%')
+	const chunk = 3 * 1024
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		start := len(e.buf)
+		e.buf = append(e.buf, make([]byte, base64.StdEncoding.EncodedLen(n))...)
+		base64.StdEncoding.Encode(e.buf[start:], b[:n])
+		b = b[n:]
+		e.maybeFlush()
+	}
+}
+
+// normalizeValue converts anything that isn't directly supported, like
+// structs or typed slices & maps, via reflection into a supported type.
+func normalizeValue(value any) any {
+	switch value.(type) {
+	case nil, map[any]any, map[string]any, []any, []byte, time.Time, string,
+		bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64, structValue, rawValue:
+		return value
+	}
+	return reflectValue(value)
+}
+
+// writeFile writes a string or binary value to a new file in `fileDir` and
+// renders a `@path` reference to it. Binary data that happens to be valid
+// UTF-8 is wrapped in CBOR, as it would otherwise be loaded as a string.
+func (e *encodeState) writeFile(value any) {
+	var data []byte
+	pattern := "value-*.txt"
+	switch v := value.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+		pattern = "value-*.bin"
+		if utf8.Valid(v) {
+			encoded, err := cbor.Marshal(v)
+			if err != nil {
+				e.setError(err)
+				return
+			}
+			data = encoded
+			pattern = "value-*.cbor"
+		}
+	}
+
+	f, err := os.CreateTemp(e.fileDir, pattern)
+	if err != nil {
+		e.setError(err)
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		e.setError(err)
+		return
+	}
+
+	name := filepath.ToSlash(f.Name())
+	if strings.TrimSpace(name) != name || strings.Contains(name, "//") || containsAnyRune(name, "\"[],{}\n\r\t\\") {
+		// The reference would be parsed as something other than a file path.
+		os.Remove(f.Name())
+		e.setError(fmt.Errorf("file path %q can't be used as a shorthand value", name))
+		return
+	}
+	e.writeString("@" + name)
+}
+
+func (e *encodeState) setError(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *encodeState) value(level int, fromKey bool, value any) {
+	if e.err != nil {
+		return
+	}
+	value = normalizeValue(value)
+
+	if e.options.Indent != "" && e.options.MaxWidth > 0 {
+		isRoot := level == 0 && !fromKey
+		switch v := value.(type) {
+		case map[any]any, map[string]any, structValue, []any:
+			// The root object always gets one line per property, while other
+			// objects and arrays stay on a single line if they fit.
+			if isRoot {
+				keys, _ := objectFields(e.options, v)
+				isRoot = len(keys) > 1
+			}
+			if !isRoot && e.fits(level, fromKey, value) {
+				indent := e.options.Indent
+				e.options.Indent = ""
+				defer func() { e.options.Indent = indent }()
+			}
+		}
+		e.trailing = 0
+	}
+
+	if fromKey {
+		switch value.(type) {
+		case map[any]any, map[string]any, structValue:
+			// Objects follow their key directly, e.g. `foo{a: 1}` or `foo.bar: 1`.
+		default:
+			e.writeByte(':')
+			e.writeString(e.options.Spacer)
+		}
+	}
+
+	options := e.options
+	switch v := value.(type) {
+	case nil:
+		// Go uses `nil` so here we hard-code `null` to match JSON/YAML.
+		e.writeString("null")
+	case map[any]any, map[string]any, structValue:
+		keys, values := objectFields(options, v)
+		e.fields(level, fromKey, keys, values)
+	case []any:
+		if len(v) == 0 {
+			e.writeString("[]")
+			return
+		}
+
+		// Normal case: foo: [1, true, {id: 1, count: 2}]
+		e.writeByte('[')
+		e.writeIndent(level + 1)
+		chain := e.chain
+		e.chain = 0
+		for i, item := range v {
+			if i > 0 {
+				if e.options.Indent != "" && e.options.MaxWidth > 0 {
+					// Array items can't be separated by a newline alone.
+					e.writeByte(',')
+				}
+				e.writeSeparator(level + 1)
+			}
+			if i < len(v)-1 {
+				e.trailing = 1
+			}
+			e.value(level+1, false, item)
+		}
+		e.chain = chain
+		e.writeIndent(level)
+		e.writeByte(']')
+	case []byte:
+		if e.fileDir != "" {
+			e.writeFile(v)
+		} else {
+			e.writeBytes(v)
+		}
+	case time.Time:
+		s := v.Format(time.RFC3339Nano)
+		if options.RoundTrip && v.Location() != time.UTC && strings.HasSuffix(s, "Z") {
+			// Only UTC is parsed from `Z`, other zero offset zones need `+00:00`.
+			s = s[:len(s)-1] + "+00:00"
+		}
+		e.writeString(s)
+	case string:
+		if options.UseFile && !options.RoundTrip && (len(v) > 50 || strings.Contains(v, "\n")) {
+			// Long strings are represented as being loaded from files.
+			if e.fileDir != "" {
+				e.writeFile(v)
+			} else {
+				e.writeString("@file")
+			}
+		} else if shouldQuoteStringValue(v) || (options.RoundTrip && shouldQuoteRoundTrip(v)) {
+			// Round trips also protect strings from object detection and from
+			// being read as special floats.
+			e.writeString(quoteString(v))
+		} else {
+			e.writeString(v)
+		}
+	case float32:
+		if options.RoundTrip {
+			e.writeString(renderFloat(float64(v), 32))
+		} else {
+			e.writeString(fmt.Sprintf("%v", v))
+		}
+	case float64:
+		if options.RoundTrip {
+			e.writeString(renderFloat(v, 64))
+		} else {
+			e.writeString(fmt.Sprintf("%v", v))
+		}
+	case bool:
+		e.buf = strconv.AppendBool(e.buf, v)
+		e.maybeFlush()
+	case int:
+		e.buf = strconv.AppendInt(e.buf, int64(v), 10)
+		e.maybeFlush()
+	case rawValue:
+		e.writeString(string(v))
+	default:
+		// The remaining sized integer types.
+		e.writeString(fmt.Sprintf("%v", v))
+	}
+}
+
+// objectFields returns the rendered keys and values of a map or struct in
+// output order. Maps are sorted by key while structs keep their field order.
+func objectFields(options MarshalOptions, value any) ([]string, []any) {
+	switch v := value.(type) {
+	case map[any]any:
+		keys := make([]any, 0, len(v))
+
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := fmt.Sprintf("%v", keys[i]), fmt.Sprintf("%v", keys[j])
+			if a == b {
+				// Keep output stable for keys like `1` and `"1"`.
+				return fmt.Sprintf("%T", keys[i]) < fmt.Sprintf("%T", keys[j])
+			}
+			return a < b
+		})
+
+		rendered := make([]string, len(keys))
+		values := make([]any, len(keys))
+		for i, k := range keys {
+			rendered[i] = renderMapKey(options, k)
+			values[i] = v[k]
+		}
+		return rendered, values
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		values := make([]any, len(keys))
+		for i, k := range keys {
+			values[i] = v[k]
+			keys[i] = renderStringKey(k)
+		}
+		return keys, values
+	case structValue:
+		return v.keys, v.values
+	}
+	return nil, nil
+}
+
+// fields writes an object from pre-rendered keys and their values, which
+// allows maps and structs to share the same output logic.
+func (e *encodeState) fields(level int, fromKey bool, keys []string, values []any) {
+	if len(keys) == 0 {
+		e.writeString("{}")
+		return
+	}
+
+	// Special case: foo.bar: 1
+	// Objects in arrays always need braces. Round trips always use braces as
+	// they may be parsed without object detection, and quoted path parts are
+	// not reliably kept apart when collapsed into a dotted path.
+	if len(keys) == 1 && !e.options.RoundTrip && (fromKey || level == 0) &&
+		(e.options.MaxCollapse <= 0 || e.chain < e.options.MaxCollapse) {
+		if fromKey {
+			e.writeByte('.')
+		}
+		e.writeString(keys[0])
+		e.chain++
+		e.value(level, true, values[0])
+		e.chain--
+		return
+	}
+
+	// Normal case: foo{a: 1, b: 2}
+	e.writeByte('{')
+	e.writeIndent(level + 1)
+	for i, k := range keys {
+		if i > 0 {
+			e.writeSeparator(level + 1)
+		}
+		e.writeString(k)
+		chain := e.chain
+		e.chain = 1
+		e.value(level+1, true, values[i])
+		e.chain = chain
+	}
+	e.writeIndent(level)
+	e.writeByte('}')
+}
@@ -0,0 +1,98 @@
+package shorthand
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingWriter accepts `n` writes and then fails.
+type failingWriter struct {
+	n      int
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.n {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+// countingWriter records how many times it was written to.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestEncoder(t *testing.T) {
+	for _, example := range marshalExamples {
+		t.Run(example.Name, func(t *testing.T) {
+			options := MarshalOptions{Spacer: " ", Indent: "  "}
+			var buf bytes.Buffer
+			require.NoError(t, NewEncoder(&buf, options).Encode(example.Input))
+			assert.Equal(t, Marshal(example.Input, options)+"\n", buf.String())
+		})
+	}
+}
+
+func TestEncoderStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, MarshalOptions{Spacer: " "})
+	require.NoError(t, enc.Encode(map[string]any{"id": 1, "tags": []any{"a", "b"}}))
+	require.NoError(t, enc.Encode(map[string]any{"id": 2}))
+	require.NoError(t, enc.Encode("done"))
+	assert.Equal(t, "{id: 1, tags: [a, b]}\nid: 2\ndone\n", buf.String())
+}
+
+func TestEncoderLarge(t *testing.T) {
+	items := make([]any, 10000)
+	for i := range items {
+		items[i] = map[string]any{"id": i, "name": strings.Repeat("x", 20), "data": []byte("hello")}
+	}
+
+	w := &countingWriter{}
+	require.NoError(t, NewEncoder(w, MarshalOptions{}).Encode(items))
+	assert.Equal(t, Marshal(items)+"\n", w.String())
+	assert.Greater(t, w.writes, 1, "output should be written in chunks")
+}
+
+func TestEncoderWriteError(t *testing.T) {
+	w := &failingWriter{n: 1}
+	enc := NewEncoder(w, MarshalOptions{})
+	require.NoError(t, enc.Encode("first"))
+
+	err := enc.Encode("second")
+	require.EqualError(t, err, "disk full")
+
+	// Errors are sticky and nothing else is written.
+	require.EqualError(t, enc.Encode("third"), "disk full")
+	assert.Equal(t, 2, w.writes)
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	b.ReportAllocs()
+
+	value := map[string]any{
+		"foo": map[string]any{
+			"bar": map[string]any{"id": 1, "tags": []any{"one", "two"}, "cost": 3.14},
+			"baz": map[string]any{"id": 2},
+		},
+	}
+	enc := NewEncoder(io.Discard, MarshalOptions{Spacer: " "})
+
+	for n := 0; n < b.N; n++ {
+		enc.Encode(value)
+	}
+}
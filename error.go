@@ -25,12 +25,19 @@ type exprErr struct {
 	offset  uint
 	length  uint
 	message string
+
+	// err is an underlying error, if any, e.g. `context.Canceled`.
+	err error
 }
 
 func (e *exprErr) Error() string {
 	return e.message
 }
 
+func (e *exprErr) Unwrap() error {
+	return e.err
+}
+
 func (e *exprErr) Offset() uint {
 	return e.offset
 }
@@ -108,3 +115,11 @@ func NewError(source *string, offset uint, length uint, format string, a ...inte
 		message: fmt.Sprintf(format, a...),
 	}
 }
+
+// wrapError is like `NewError` but wraps an underlying error so that it can be
+// checked with `errors.Is`.
+func wrapError(source *string, offset uint, length uint, err error, format string, a ...interface{}) Error {
+	e := NewError(source, offset, length, format, a...).(*exprErr)
+	e.err = err
+	return e
+}
@@ -0,0 +1,319 @@
+package shorthand
+
+import (
+	"strings"
+)
+
+// FormatOptions controls how `Format` lays out shorthand source.
+type FormatOptions struct {
+	// Indent is used once for each level of nesting. Defaults to two spaces.
+	Indent string
+
+	// DebugLogger sets a function to be used for printing out debug information.
+	DebugLogger func(format string, a ...any)
+}
+
+// Format returns the canonical formatting of shorthand or JSON source. It
+// normalizes whitespace, indentation, optional commas and quoting while
+// keeping comments, blank lines between entries and key order. Objects and
+// arrays which were written on a single line stay on a single line unless
+// they contain comments or multi-line values.
+//
+// The source is parsed with object detection enabled, so documents without
+// the outer `{` and `}` are supported and are kept that way.
+func Format(src string, options FormatOptions) (string, Error) {
+	if options.Indent == "" {
+		options.Indent = "  "
+	}
+
+	parseOptions := ParseOptions{EnableObjectDetection: true, DebugLogger: options.DebugLogger}
+	d := Document{options: parseOptions}
+	if err := d.Parse(src); err != nil {
+		return "", err
+	}
+
+	root, err := parseSyntax(src, parseOptions)
+	if err != nil {
+		return "", err
+	}
+
+	f := &formatter{src: src, options: options}
+	if !root.braced {
+		f.entries(root, 0)
+		f.comments(root.trailing, 0, len(root.entries) > 0)
+	} else {
+		f.comments(root.leading, 0, false)
+		f.value(root, 0, true)
+		if len(root.after) > 0 {
+			f.sb.WriteByte('\n')
+			f.comments(root.after, 0, true)
+		}
+	}
+
+	out := strings.TrimRight(f.sb.String(), "\n")
+	if out == "" {
+		return "", nil
+	}
+	return out + "\n", nil
+}
+
+// formatter writes the canonical form of a syntax tree.
+type formatter struct {
+	src     string
+	options FormatOptions
+	sb      strings.Builder
+}
+
+func (f *formatter) indent(level int) {
+	for i := 0; i < level; i++ {
+		f.sb.WriteString(f.options.Indent)
+	}
+}
+
+// comments writes each comment on its own line at the given indentation
+// level, keeping a single blank line where the source had one or more.
+func (f *formatter) comments(comments []syntaxComment, level int, allowBlank bool) {
+	for i, c := range comments {
+		if c.blankBefore && (allowBlank || i > 0) {
+			f.sb.WriteByte('\n')
+		}
+		f.indent(level)
+		f.sb.WriteString(c.text)
+		f.sb.WriteByte('\n')
+	}
+}
+
+// isMultiline returns whether a container must be written across multiple
+// lines, either because it was in the source or because it contains comments
+// or other multi-line values.
+func (f *formatter) isMultiline(node *syntaxNode) bool {
+	if node.kind != syntaxObject && node.kind != syntaxArray {
+		return false
+	}
+	if node.multiline || len(node.trailing) > 0 || !node.braced {
+		return true
+	}
+	for _, entry := range node.entries {
+		if len(entry.leading) > 0 || entry.comment != nil || len(entry.value.leading) > 0 || f.isMultiline(entry.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// entries writes all entries of an object or array, one per line.
+func (f *formatter) entries(node *syntaxNode, level int) {
+	for i, entry := range node.entries {
+		blank := entry.blankBefore
+		if len(entry.leading) > 0 {
+			blank = entry.leading[0].blankBefore
+		}
+		if i > 0 && blank {
+			f.sb.WriteByte('\n')
+		}
+		f.comments(entry.leading, level, false)
+		if entry.blankBefore && len(entry.leading) > 0 {
+			f.sb.WriteByte('\n')
+		}
+		f.indent(level)
+		f.entry(node, entry, level)
+		if (node.kind == syntaxArray || entry.sep == '^') && i < len(node.entries)-1 {
+			// Array items and swaps can't be terminated by a newline alone.
+			f.sb.WriteByte(',')
+		}
+		if entry.comment != nil {
+			f.sb.WriteString(" " + entry.comment.text)
+		}
+		f.sb.WriteByte('\n')
+	}
+}
+
+// entry writes a single object property or array item.
+func (f *formatter) entry(node *syntaxNode, entry *syntaxEntry, level int) {
+	if node.kind == syntaxArray {
+		f.value(entry.value, level, false)
+		return
+	}
+
+	f.key(entry)
+	switch {
+	case entry.sep == '^':
+		if strings.HasSuffix(entry.key, `"`) {
+			// Quoted keys must be followed directly by the `^`.
+			f.sb.WriteString("^ ")
+		} else {
+			f.sb.WriteString(" ^ ")
+		}
+		f.sb.WriteString(f.src[entry.value.start:entry.value.end])
+	case entry.value.kind == syntaxObject && len(entry.value.entries) > 0:
+		// Empty objects keep the colon, as `a{}` isn't valid shorthand.
+		f.value(entry.value, level, false)
+	default:
+		f.sb.WriteString(": ")
+		f.value(entry.value, level, false)
+	}
+}
+
+// key writes a normalized property path, only quoting a single key where
+// needed. Paths with parts that need quoting are written as-is, as the parser
+// only allows quotes in some places, e.g. `a."b.c"` but not `"a".b`.
+func (f *formatter) key(entry *syntaxEntry) {
+	parts := entry.parts
+	if entry.sep == '^' || keepRawKey(entry.key) {
+		f.sb.WriteString(stripKeyComments(entry.key))
+		return
+	}
+
+	if len(parts) == 1 && !parts[0].index {
+		key := parts[0].key
+		if parts[0].quoted || (shouldQuoteKey(key) && (!canCoerce(key) || containsAnyRune(key, ".[]{}:^,\\"))) {
+			f.sb.WriteString(quoteString(key))
+		} else {
+			f.sb.WriteString(key)
+		}
+		return
+	}
+
+	for _, part := range parts {
+		if !part.index && (part.quoted || shouldQuoteKey(part.key)) {
+			f.sb.WriteString(stripKeyComments(entry.key))
+			return
+		}
+	}
+	for i, part := range parts {
+		if part.index {
+			f.sb.WriteString("[" + strings.TrimSpace(part.key) + "]")
+			continue
+		}
+		if i > 0 {
+			f.sb.WriteByte('.')
+		}
+		f.sb.WriteString(part.key)
+	}
+}
+
+// stripKeyComments removes comments from a raw key, which the parser skips,
+// so it can be written on a single line.
+func stripKeyComments(key string) string {
+	if !strings.Contains(key, "//") {
+		return key
+	}
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key):
+			sb.WriteString(key[i : i+2])
+			i++
+			continue
+		case key[i] == '"':
+			end := i + 1
+			for end < len(key) && key[end] != '"' {
+				if key[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(key) {
+				end = len(key) - 1
+			}
+			sb.WriteString(key[i : end+1])
+			i = end
+			continue
+		case strings.HasPrefix(key[i:], "//"):
+			end := strings.IndexByte(key[i:], '\n')
+			if end < 0 {
+				return sb.String()
+			}
+			i += end
+			continue
+		}
+		sb.WriteByte(key[i])
+	}
+	return sb.String()
+}
+
+// keepRawKey returns whether a property path must be written as-is rather
+// than normalized. Empty parts end the path when applied, e.g. `a..b: 1` sets
+// `a`, while escapes like `\0` and quotes within a part like `a"b"` have
+// their own rules.
+func keepRawKey(path string) bool {
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			return true
+		case '"':
+			if i > 0 && path[i-1] != '.' {
+				return true
+			}
+			for i++; i < len(path) && path[i] != '"'; i++ {
+				if path[i] == '\\' {
+					return true
+				}
+			}
+			if i+1 < len(path) && path[i+1] != '.' && path[i+1] != '[' {
+				return true
+			}
+		case '.':
+			if i == 0 || i == len(path)-1 || path[i+1] == '.' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// value writes a value, recursing into objects and arrays.
+func (f *formatter) value(node *syntaxNode, level int, root bool) {
+	switch node.kind {
+	case syntaxObject, syntaxArray:
+		open, close := "{", "}"
+		if node.kind == syntaxArray {
+			open, close = "[", "]"
+		}
+
+		f.sb.WriteString(open)
+		if node.commaOnly && len(node.entries) == 0 {
+			f.sb.WriteByte(',')
+		}
+		if len(node.entries) == 0 && len(node.trailing) == 0 {
+			f.sb.WriteString(close)
+			return
+		}
+
+		if !f.isMultiline(node) {
+			for i, entry := range node.entries {
+				if i > 0 {
+					f.sb.WriteString(", ")
+				}
+				f.entry(node, entry, level)
+			}
+			f.sb.WriteString(close)
+			return
+		}
+
+		f.sb.WriteByte('\n')
+		f.entries(node, level+1)
+		f.comments(node.trailing, level+1, len(node.entries) > 0)
+		f.indent(level)
+		f.sb.WriteString(close)
+	case syntaxQuoted:
+		raw := f.src[node.start:node.end]
+		d := Document{expression: raw, pos: 1}
+		if root || d.parseQuoted(false) != nil {
+			f.sb.WriteString(raw)
+			return
+		}
+		if s := d.buf.String(); shouldQuoteStringValue(s) {
+			f.sb.WriteString(quoteString(s))
+		} else {
+			f.sb.WriteString(s)
+		}
+	default:
+		if node.start == node.end {
+			// Empty values are empty strings.
+			f.sb.WriteString(`""`)
+			return
+		}
+		f.sb.WriteString(f.src[node.start:node.end])
+	}
+}
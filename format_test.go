@@ -0,0 +1,153 @@
+package shorthand
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var formatExamples = []struct {
+	Name   string
+	Input  string
+	Indent string
+	Output string
+	Error  string
+}{
+	{
+		Name:   "Empty",
+		Input:  "",
+		Output: "",
+	},
+	{
+		Name:   "Scalar",
+		Input:  "  true  ",
+		Output: "true\n",
+	},
+	{
+		Name:   "Quoted root",
+		Input:  `"hello"`,
+		Output: "\"hello\"\n",
+	},
+	{
+		Name:   "Object detection",
+		Input:  "a:1,   b :2",
+		Output: "a: 1\nb: 2\n",
+	},
+	{
+		Name:   "Inline JSON",
+		Input:  `{"a": 1, "b": {"c": [1,2,{"d": "x y"}]}, "e.f": "true"}`,
+		Output: "{a: 1, b{c: [1, 2, {d: x y}]}, \"e.f\": \"true\"}\n",
+	},
+	{
+		Name:   "Multiline JSON",
+		Input:  "{\n    \"name\": \"app\",\n    \"list\": [\n        1,\n        2\n    ]\n}",
+		Output: "{\n  name: app\n  list: [\n    1,\n    2\n  ]\n}\n",
+	},
+	{
+		Name:   "Comments and blank lines",
+		Input:  "// Header\n\n\nserver   {\n    port:8080,  // p\n\n\n   \"host\": \"localhost\"\n tags: [ \"a\",b , c ]\n}\n// end\n",
+		Output: "// Header\n\nserver{\n  port: 8080 // p\n\n  host: localhost\n  tags: [a, b, c]\n}\n// end\n",
+	},
+	{
+		Name:   "Comment after root",
+		Input:  `{"name": "app"} // comment`,
+		Output: "{name: app}\n// comment\n",
+	},
+	{
+		Name:   "Comments force multiline",
+		Input:  "{\n  a: [1 // one\n  , 2], b: {c: 1, // c\n  d: 2}\n}",
+		Output: "{\n  a: [\n    1, // one\n    2\n  ]\n  b{\n    c: 1 // c\n    d: 2\n  }\n}\n",
+	},
+	{
+		Name:   "Keys and values",
+		Input:  `a ^ b, x: , "1": 2, "": 3, y: "a,b", z: "@f", w: "plain"`,
+		Output: "a ^ b,\nx: \"\"\n\"1\": 2\n\"\": 3\ny: \"a,b\"\nz: \"@f\"\nw: plain\n",
+	},
+	{
+		Name:   "Empty objects",
+		Input:  "a: {}, b: {c: {}}, d: [{}]",
+		Output: "a: {}\nb{c: {}}\nd: [{}]\n",
+	},
+	{
+		Name:   "Empty array items",
+		Input:  "[1,,2,]",
+		Output: "[1, \"\", 2, \"\"]\n",
+	},
+	{
+		Name:   "Keys kept as written",
+		Input:  "a..b: 1, c\\.d.e: 2, f.\"g.h\": 3, i.\"j\": 4",
+		Output: "a..b: 1\nc\\.d.e: 2\nf.\"g.h\": 3\ni.j: 4\n",
+	},
+	{
+		Name:   "Multiple trailing comments",
+		Input:  "true // a\n// b",
+		Output: "true\n// a\n// b\n",
+	},
+	{
+		Name:   "Custom indent",
+		Input:  "a{\nb: 1\n}",
+		Indent: "\t",
+		Output: "a{\n\tb: 1\n}\n",
+	},
+	{
+		Name:  "Invalid",
+		Input: "a: [1, 2",
+		Error: "Expected ',' or ']'",
+	},
+}
+
+func TestFormat(t *testing.T) {
+	for _, example := range formatExamples {
+		t.Run(example.Name, func(t *testing.T) {
+			out, err := Format(example.Input, FormatOptions{Indent: example.Indent})
+			if example.Error != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), example.Error)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, example.Output, out)
+
+			// Formatting must be idempotent and must not change the data.
+			again, err := Format(out, FormatOptions{Indent: example.Indent})
+			require.NoError(t, err)
+			assert.Equal(t, out, again)
+
+			expected, err := Unmarshal(example.Input, ParseOptions{EnableObjectDetection: true}, nil)
+			require.NoError(t, err)
+			actual, err := Unmarshal(out, ParseOptions{EnableObjectDetection: true}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func FuzzFormat(f *testing.F) {
+	f.Add("a: 1, b: [1, 2]")
+	f.Add("// comment\n{\n  a: 1 // trailing\n}")
+	f.Add(`{"a": "b"}`)
+	f.Add("a: {}, b: {c: {}}")
+	f.Fuzz(func(t *testing.T, s string) {
+		out, err := Format(s, FormatOptions{})
+		if err != nil {
+			return
+		}
+
+		// Formatted output must parse back to the same value as the input.
+		// Inputs which are valid syntax but fail to apply, like a swap of a
+		// missing path, are skipped.
+		expected, err := Unmarshal(s, ParseOptions{EnableObjectDetection: true}, nil)
+		if err != nil {
+			return
+		}
+		actual, err := Unmarshal(out, ParseOptions{EnableObjectDetection: true}, nil)
+		if err != nil {
+			t.Fatalf("formatted %q as %q which failed to parse: %v", s, out, err)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("formatted %q as %q which changed the value from %v to %v", s, out, expected, actual)
+		}
+	})
+}
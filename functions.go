@@ -0,0 +1,861 @@
+package shorthand
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/danielgtaylor/mexpr"
+)
+
+// queryFunction implements a function called from a query pipe, e.g.
+// `items | length`. The input is the value being piped and args holds any
+// literal arguments from the call, e.g. `join(", ")`.
+type queryFunction func(input any, args []any) (any, error)
+
+// builtinFunctions is the standard library of query functions.
+var builtinFunctions = map[string]queryFunction{
+	"length": noArgs("length", fnLength),
+	"keys":   noArgs("keys", fnKeys),
+	"values": noArgs("values", fnValues),
+	"sort":   noArgs("sort", fnSort),
+	"unique": noArgs("unique", fnUnique),
+	"min":    noArgs("min", fnMin),
+	"max":    noArgs("max", fnMax),
+	"sum":    noArgs("sum", fnSum),
+}
+
+// stageFunction implements a function which transforms an array using a key
+// for each item, e.g. `users | sortBy(age)`. The keys line up with the items
+// and args holds any literal arguments after the key.
+type stageFunction func(items []any, keys []any, args []any) (any, error)
+
+// stageFunctions are built-in functions whose first argument is a query run
+// against each item to get its key.
+var stageFunctions = map[string]stageFunction{
+	"sortBy":  fnSortBy,
+	"groupBy": fnGroupBy,
+	"countBy": fnCountBy,
+	"sumBy":   fnSumBy,
+}
+
+// noArgs wraps a function which takes no arguments besides its input.
+func noArgs(name string, fn func(input any) (any, error)) queryFunction {
+	return func(input any, args []any) (any, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%s takes no arguments but got %d", name, len(args))
+		}
+		return fn(input)
+	}
+}
+
+// lookupFunction returns the named function or nil if there isn't one.
+// Functions from the options take precedence over built-in ones.
+func lookupFunction(name string, options GetOptions) queryFunction {
+	if fn, ok := options.Functions[name]; ok {
+		return func(input any, args []any) (any, error) {
+			t, err := functionType(name, fn)
+			if err != nil {
+				return nil, err
+			}
+			params := append([]any{input}, args...)
+			if !acceptsArgs(t, len(params)) {
+				return nil, fmt.Errorf("%s takes %d argument(s) including the piped value, but got %d", name, t.NumIn(), len(params))
+			}
+			return callFunction(name, fn, params)
+		}
+	}
+	return builtinFunctions[name]
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// functionType returns the type of a user-defined function, or an error if it
+// isn't a function which returns a value and optionally an error.
+func functionType(name string, fn any) (reflect.Type, error) {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s is not a function", name)
+	}
+	if t.NumOut() != 1 && (t.NumOut() != 2 || t.Out(1) != errorType) {
+		return nil, fmt.Errorf("%s must return a value and optionally an error", name)
+	}
+	return t, nil
+}
+
+// acceptsArgs returns whether a function can be called with `n` arguments.
+func acceptsArgs(t reflect.Type, n int) bool {
+	if t.IsVariadic() {
+		return n >= t.NumIn()-1
+	}
+	return n == t.NumIn()
+}
+
+// callFunction calls a user-defined Go function, which must have been checked
+// with `functionType` and `acceptsArgs`. In a pipe the piped value is the
+// first parameter, followed by any literal arguments.
+func callFunction(name string, fn any, params []any) (any, error) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+
+	in := make([]reflect.Value, len(params))
+	for i, param := range params {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= t.NumIn()-1 {
+			pt = t.In(t.NumIn() - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		arg, ok := convertArg(param, pt)
+		if !ok {
+			return nil, fmt.Errorf("%s argument %d expects %s, but found %v", name, i+1, pt, param)
+		}
+		in[i] = arg
+	}
+
+	out := v.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, fmt.Errorf("%s: %w", name, out[1].Interface().(error))
+	}
+	return out[0].Interface(), nil
+}
+
+// convertArg converts a query value to a Go function parameter type. Numbers
+// convert between types as long as no precision is lost.
+func convertArg(value any, t reflect.Type) (reflect.Value, bool) {
+	if value == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Map, reflect.Slice, reflect.Pointer, reflect.Func, reflect.Chan:
+			return reflect.Zero(t), true
+		}
+		return reflect.Value{}, false
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(t) {
+		return v, true
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if v.Kind() == reflect.String {
+			return v.Convert(t), true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if f, ok := toFloat64(value); ok && f == math.Trunc(f) {
+			out := reflect.New(t).Elem()
+			if out.CanInt() {
+				out.SetInt(int64(f))
+			} else if f >= 0 {
+				out.SetUint(uint64(f))
+			} else {
+				return reflect.Value{}, false
+			}
+			return out, true
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := toFloat64(value); ok {
+			return reflect.ValueOf(f).Convert(t), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// filterCalls returns the names of functions called by a filter expression.
+func filterCalls(ast *mexpr.Node) []string {
+	if ast == nil {
+		return nil
+	}
+	var names []string
+	if ast.Type == mexpr.NodeFunctionCall {
+		if name, ok := ast.Left.Value.(string); ok {
+			names = append(names, name)
+		}
+		if params, ok := ast.Value.([]mexpr.Node); ok {
+			for i := range params {
+				names = append(names, filterCalls(&params[i])...)
+			}
+		}
+		return names
+	}
+	names = append(names, filterCalls(ast.Left)...)
+	return append(names, filterCalls(ast.Right)...)
+}
+
+// filterItemKey holds the item being filtered in a filter environment, so
+// that `@` can get it. Identifiers can't contain a NUL byte, so this and the
+// call keys below never clash with properties of the item.
+const filterItemKey = "\x00@"
+
+// filterEnv is the input to filters which call functions or match regexes.
+// mexpr looks up functions in the value being filtered, which only works for
+// maps and only passes scalar arguments, so instead each call is run in Go
+// for every item and its result stored in the environment under a key which
+// replaces the call in the expression. The properties of the item which the
+// expression reads are stored alongside. The environment is built once per
+// evaluation and reused for every item.
+type filterEnv struct {
+	values map[string]any
+	props  []filterProp
+	calls  []*filterCall
+
+	// err is the first error from a call which the expression used, along
+	// with the node it came from.
+	err     error
+	errNode *mexpr.Node
+}
+
+// filterProp is a property read by a filter, got from each item using the
+// interpreter so missing properties behave just like in other filters.
+type filterProp struct {
+	name        string
+	interpreter mexpr.Interpreter
+}
+
+// filterCall is a function call or regex match within a filter. Calls are
+// stored in the order they must run, so nested calls come first.
+type filterCall struct {
+	key  string
+	node *mexpr.Node
+	args []mexpr.Interpreter
+	buf  []any
+
+	// re is set for regex matches, which don't match on errors rather than
+	// failing the item.
+	re *regexp.Regexp
+	fn func(args []any) (any, error)
+}
+
+// newFilterEnv builds an environment for a filter and returns it along with
+// the expression to run against it. The literals replace variables within the
+// expression. It returns an error if the filter calls an unknown function.
+func (q *Query) newFilterEnv(op compiledFilterOp, literals map[*mexpr.Node]any, options GetOptions, interpreterOptions []mexpr.InterpreterOption) (*filterEnv, *mexpr.Node, Error) {
+	env := &filterEnv{values: map[string]any{}}
+	b := filterEnvBuilder{q: q, op: op, env: env, literals: literals, options: options, interpreterOptions: interpreterOptions, seen: map[string]bool{}}
+	ast, err := b.rewrite(op.ast, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, ast, nil
+}
+
+type filterEnvBuilder struct {
+	q                  *Query
+	op                 compiledFilterOp
+	env                *filterEnv
+	literals           map[*mexpr.Node]any
+	options            GetOptions
+	interpreterOptions []mexpr.InterpreterOption
+	seen               map[string]bool
+}
+
+// rewrite copies an expression, replacing variables with their values and,
+// where it runs against the item (`root`), calls and regex matches with keys
+// into the environment. The right side of a `where` or `.` runs against other
+// values, so only its variables are replaced.
+func (b *filterEnvBuilder) rewrite(ast *mexpr.Node, root bool) (*mexpr.Node, Error) {
+	if ast == nil {
+		return nil, nil
+	}
+	if value, ok := b.literals[ast]; ok {
+		return &mexpr.Node{Type: mexpr.NodeLiteral, Offset: ast.Offset, Length: ast.Length, Value: value}, nil
+	}
+
+	if root {
+		switch ast.Type {
+		case mexpr.NodeIdentifier:
+			name, _ := ast.Value.(string)
+			if name == "@" {
+				return &mexpr.Node{Type: mexpr.NodeIdentifier, Offset: ast.Offset, Length: ast.Length, Value: filterItemKey}, nil
+			}
+			if !b.seen[name] {
+				b.seen[name] = true
+				b.env.props = append(b.env.props, filterProp{name: name, interpreter: mexpr.NewInterpreter(ast, b.interpreterOptions...)})
+			}
+			return ast, nil
+		case mexpr.NodeFunctionCall:
+			return b.call(ast)
+		case mexpr.NodeEqual:
+			for i := range b.op.regexes {
+				if r := &b.op.regexes[i]; r.node == ast {
+					return b.regex(r)
+				}
+			}
+		}
+	}
+
+	node := *ast
+	if params, ok := ast.Value.([]mexpr.Node); ok && ast.Type == mexpr.NodeFunctionCall {
+		copied := make([]mexpr.Node, len(params))
+		for i := range params {
+			param, err := b.rewrite(&params[i], false)
+			if err != nil {
+				return nil, err
+			}
+			copied[i] = *param
+		}
+		node.Value = copied
+	}
+	var err Error
+	if node.Left, err = b.rewrite(ast.Left, root); err != nil {
+		return nil, err
+	}
+	rightRoot := root && ast.Type != mexpr.NodeWhere && ast.Type != mexpr.NodeFieldSelect
+	if node.Right, err = b.rewrite(ast.Right, rightRoot); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// call adds a function call to the environment. Functions from the options
+// take precedence over built-in ones, and otherwise the function is looked up
+// in each item like mexpr does.
+func (b *filterEnvBuilder) call(ast *mexpr.Node) (*mexpr.Node, Error) {
+	name, _ := ast.Left.Value.(string)
+	params, _ := ast.Value.([]mexpr.Node)
+
+	// Errors point at the whole call rather than just its parentheses.
+	span := &mexpr.Node{Offset: ast.Left.Offset, Length: uint8(uint(ast.Offset) + uint(ast.Length) - uint(ast.Left.Offset))}
+	offset := b.op.offset + uint(span.Offset)
+
+	var fn func(args []any) (any, error)
+	if userFn, ok := b.options.Functions[name]; ok {
+		t, err := functionType(name, userFn)
+		if err != nil {
+			return nil, NewError(&b.q.expression, offset, uint(span.Length), "%s", err.Error())
+		}
+		if !acceptsArgs(t, len(params)) {
+			return nil, NewError(&b.q.expression, offset, uint(span.Length), "%s takes %d argument(s), but got %d", name, t.NumIn(), len(params))
+		}
+		fn = func(args []any) (any, error) {
+			return callFunction(name, userFn, args)
+		}
+	} else if builtin, ok := builtinFunctions[name]; ok {
+		if len(params) == 0 {
+			return nil, NewError(&b.q.expression, offset, uint(span.Length), "%s requires an argument", name)
+		}
+		fn = func(args []any) (any, error) {
+			return builtin(args[0], args[1:])
+		}
+	} else {
+		env := b.env
+		fn = func(args []any) (any, error) {
+			var itemFn any
+			switch item := env.values[filterItemKey].(type) {
+			case map[string]any:
+				itemFn = item[name]
+			case map[any]any:
+				itemFn = item[name]
+			}
+			if itemFn == nil {
+				return nil, fmt.Errorf("unknown function %s", name)
+			}
+			t, err := functionType(name, itemFn)
+			if err != nil {
+				return nil, err
+			}
+			if !acceptsArgs(t, len(args)) {
+				return nil, fmt.Errorf("%s takes %d argument(s), but got %d", name, t.NumIn(), len(args))
+			}
+			return callFunction(name, itemFn, args)
+		}
+	}
+
+	args := make([]mexpr.Interpreter, len(params))
+	for i := range params {
+		param, err := b.rewrite(&params[i], true)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = mexpr.NewInterpreter(param, b.interpreterOptions...)
+	}
+	return b.add(ast, &filterCall{node: span, args: args, fn: fn}), nil
+}
+
+// regex adds a regex match `left =~ "pattern"` to the environment.
+func (b *filterEnvBuilder) regex(r *filterRegex) (*mexpr.Node, Error) {
+	left, err := b.rewrite(r.left, true)
+	if err != nil {
+		return nil, err
+	}
+	args := []mexpr.Interpreter{mexpr.NewInterpreter(left, mexpr.UnquotedStrings)}
+	return b.add(r.node, &filterCall{node: r.node, args: args, re: r.re}), nil
+}
+
+// add stores a call in the environment and returns the node replacing it.
+func (b *filterEnvBuilder) add(ast *mexpr.Node, call *filterCall) *mexpr.Node {
+	call.key = "\x00" + strconv.Itoa(len(b.env.calls))
+	call.buf = make([]any, len(call.args))
+	b.env.calls = append(b.env.calls, call)
+	return &mexpr.Node{Type: mexpr.NodeIdentifier, Offset: ast.Offset, Length: ast.Length, Value: call.key}
+}
+
+// set prepares the environment for an item, getting the properties the
+// expression reads and running each call. Errors are only kept if the
+// expression uses the failed value, like when mexpr calls a function.
+func (e *filterEnv) set(item any) {
+	e.err, e.errNode = nil, nil
+	e.values[filterItemKey] = item
+	for _, prop := range e.props {
+		value, err := prop.interpreter.Run(item)
+		if err != nil {
+			e.values[prop.name] = e.failed(err, nil)
+			continue
+		}
+		e.values[prop.name] = value
+	}
+
+	for _, call := range e.calls {
+		e.values[call.key] = e.run(call)
+	}
+}
+
+// run runs a single call against the environment.
+func (e *filterEnv) run(call *filterCall) any {
+	for i, arg := range call.args {
+		value, err := arg.Run(e.values)
+		if e.err != nil {
+			// A nested call which failed was used by an argument.
+			err, node := e.err, e.errNode
+			e.err, e.errNode = nil, nil
+			return e.failed(err, node)
+		}
+		if err != nil {
+			if call.re != nil {
+				return false
+			}
+			return e.failed(err, nil)
+		}
+		call.buf[i] = value
+	}
+
+	if call.re != nil {
+		switch v := call.buf[0].(type) {
+		case string:
+			return call.re.MatchString(v)
+		case []byte:
+			return call.re.Match(v)
+		}
+		return false
+	}
+
+	result, err := call.fn(call.buf)
+	if err != nil {
+		return e.failed(err, call.node)
+	}
+	return result
+}
+
+// failed returns a value which records the error when the expression uses
+// it. Errors from mexpr have their own position, others use the node.
+func (e *filterEnv) failed(err error, node *mexpr.Node) func() bool {
+	return func() bool {
+		if e.err == nil {
+			e.err, e.errNode = err, node
+		}
+		return false
+	}
+}
+
+func fnLength(input any) (any, error) {
+	switch v := input.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case []byte:
+		return len(v), nil
+	case []any:
+		return len(v), nil
+	case map[string]any:
+		return len(v), nil
+	case map[any]any:
+		return len(v), nil
+	}
+	return nil, fmt.Errorf("length requires a string, array, or map, but found %v", input)
+}
+
+// sortedEntries returns the keys and values of a map sorted by key. For arrays
+// the keys are the item indexes.
+func sortedEntries(name string, input any) ([]any, []any, error) {
+	switch v := input.(type) {
+	case []any:
+		keys := make([]any, len(v))
+		for i := range v {
+			keys[i] = i
+		}
+		return keys, v, nil
+	case map[string]any:
+		names := mapKeys(v)
+		sort.Strings(names)
+		keys := make([]any, len(names))
+		values := make([]any, len(names))
+		for i, k := range names {
+			keys[i] = k
+			values[i] = v[k]
+		}
+		return keys, values, nil
+	case map[any]any:
+		keys := make([]any, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return compareValues(keys[i], keys[j]) < 0
+		})
+		values := make([]any, len(keys))
+		for i, k := range keys {
+			values[i] = v[k]
+		}
+		return keys, values, nil
+	}
+	return nil, nil, fmt.Errorf("%s requires an array or map, but found %v", name, input)
+}
+
+func fnKeys(input any) (any, error) {
+	keys, _, err := sortedEntries("keys", input)
+	return keys, err
+}
+
+func fnValues(input any) (any, error) {
+	_, values, err := sortedEntries("values", input)
+	return values, err
+}
+
+// requireArray returns the input as an array for functions which need one.
+func requireArray(name string, input any) ([]any, error) {
+	items, ok := input.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s requires an array, but found %v", name, input)
+	}
+	return items, nil
+}
+
+func fnSort(input any) (any, error) {
+	items, err := requireArray("sort", input)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]any, len(items))
+	copy(out, items)
+	sort.SliceStable(out, func(i, j int) bool {
+		return compareValues(out[i], out[j]) < 0
+	})
+	return out, nil
+}
+
+// fnUnique removes duplicate items, keeping the first of each in its original
+// position.
+func fnUnique(input any) (any, error) {
+	items, err := requireArray("unique", input)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareValues(items[order[i]], items[order[j]]) < 0
+	})
+
+	duplicate := make([]bool, len(items))
+	for i := 1; i < len(order); i++ {
+		if compareValues(items[order[i-1]], items[order[i]]) == 0 {
+			duplicate[order[i]] = true
+		}
+	}
+
+	out := make([]any, 0, len(items))
+	for i, item := range items {
+		if !duplicate[i] {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+// extreme returns the item for which `better` is true when compared against
+// every other item, or nil for an empty array.
+func extreme(name string, input any, better func(cmp int) bool) (any, error) {
+	items, err := requireArray(name, input)
+	if err != nil {
+		return nil, err
+	}
+	var result any
+	for i, item := range items {
+		if i == 0 || better(compareValues(item, result)) {
+			result = item
+		}
+	}
+	return result, nil
+}
+
+func fnMin(input any) (any, error) {
+	return extreme("min", input, func(cmp int) bool { return cmp < 0 })
+}
+
+func fnMax(input any) (any, error) {
+	return extreme("max", input, func(cmp int) bool { return cmp > 0 })
+}
+
+func fnSum(input any) (any, error) {
+	items, err := requireArray("sum", input)
+	if err != nil {
+		return nil, err
+	}
+	return sumNumbers("sum", items)
+}
+
+// sumNumbers adds up numbers. The result is an int if every item is an
+// integer and a float64 otherwise.
+func sumNumbers(name string, items []any) (any, error) {
+	isInt := true
+	intSum := int64(0)
+	floatSum := 0.0
+	for _, item := range items {
+		if i, ok := toInt64(item); ok {
+			intSum += i
+			floatSum += float64(i)
+			continue
+		}
+		f, ok := toFloat64(item)
+		if !ok {
+			return nil, fmt.Errorf("%s requires numbers, but found %v", name, item)
+		}
+		isInt = false
+		floatSum += f
+	}
+	if isInt {
+		return int(intSum), nil
+	}
+	return floatSum, nil
+}
+
+// fnSortBy stably sorts items by their keys. An optional `asc` or `desc`
+// argument sets the direction; items with equal keys keep their order.
+func fnSortBy(items []any, keys []any, args []any) (any, error) {
+	desc := false
+	if len(args) > 1 {
+		return nil, fmt.Errorf("sortBy takes a key and an optional direction but got %d arguments", len(args)+1)
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "asc":
+		case "desc":
+			desc = true
+		default:
+			return nil, fmt.Errorf("sortBy direction must be asc or desc, but found %v", args[0])
+		}
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if desc {
+			return compareValues(keys[order[i]], keys[order[j]]) > 0
+		}
+		return compareValues(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	out := make([]any, len(items))
+	for i, index := range order {
+		out[i] = items[index]
+	}
+	return out, nil
+}
+
+// groupKey converts a key to a string for use as an output map key.
+func groupKey(key any) string {
+	if key == nil {
+		return "null"
+	}
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", key)
+}
+
+// fnGroupBy groups items into arrays by key, keeping their original order.
+func fnGroupBy(items []any, keys []any, args []any) (any, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("groupBy takes only a key but got %d arguments", len(args)+1)
+	}
+	out := map[string]any{}
+	for i, item := range items {
+		k := groupKey(keys[i])
+		group, _ := out[k].([]any)
+		out[k] = append(group, item)
+	}
+	return out, nil
+}
+
+// fnCountBy counts the items with each key.
+func fnCountBy(items []any, keys []any, args []any) (any, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("countBy takes only a key but got %d arguments", len(args)+1)
+	}
+	out := map[string]any{}
+	for i := range items {
+		k := groupKey(keys[i])
+		count, _ := out[k].(int)
+		out[k] = count + 1
+	}
+	return out, nil
+}
+
+// fnSumBy adds up the key of each item, ignoring items without one.
+func fnSumBy(items []any, keys []any, args []any) (any, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("sumBy takes only a key but got %d arguments", len(args)+1)
+	}
+	values := make([]any, 0, len(keys))
+	for _, key := range keys {
+		if key != nil {
+			values = append(values, key)
+		}
+	}
+	return sumNumbers("sumBy", values)
+}
+
+// toInt64 converts any Go integer type to an int64.
+func toInt64(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// toFloat64 converts any Go number type to a float64.
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	if i, ok := toInt64(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// typeRank orders values of different types when sorting: null, booleans,
+// numbers, times, strings, bytes, arrays, maps, then anything else.
+func typeRank(v any) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case time.Time:
+		return 3
+	case string:
+		return 4
+	case []byte:
+		return 5
+	case []any:
+		return 6
+	case map[string]any, map[any]any:
+		return 7
+	}
+	if _, ok := toFloat64(v); ok {
+		return 2
+	}
+	return 8
+}
+
+// compareValues returns -1, 0, or 1 depending on whether a sorts before, the
+// same as, or after b. Numbers compare by value regardless of their Go type.
+func compareValues(a, b any) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch ra {
+	case 0:
+		return 0
+	case 1:
+		x, y := a.(bool), b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case 2:
+		x, _ := toFloat64(a)
+		y, _ := toFloat64(b)
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+		return 0
+	case 3:
+		x, y := a.(time.Time), b.(time.Time)
+		if x.Before(y) {
+			return -1
+		}
+		if x.After(y) {
+			return 1
+		}
+		return 0
+	case 4:
+		return strings.Compare(a.(string), b.(string))
+	case 5:
+		return bytes.Compare(a.([]byte), b.([]byte))
+	case 6:
+		x, y := a.([]any), b.([]any)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareValues(len(x), len(y))
+	case 7:
+		xk, xv, _ := sortedEntries("", a)
+		yk, yv, _ := sortedEntries("", b)
+		if c := compareValues(xk, yk); c != 0 {
+			return c
+		}
+		return compareValues(xv, yv)
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
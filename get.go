@@ -1,19 +1,23 @@
 package shorthand
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/danielgtaylor/mexpr"
 )
 
 type fieldSpec struct {
-	key  string
-	path string
+	key     string
+	path    string
+	alias   bool
+	exclude bool
 }
 
 const defaultCompiledCacheMaxEntries = 1024
@@ -69,26 +73,48 @@ func (c *boundedConcurrentCache) LoadOrStore(key string, value any) (any, bool)
 	return value, false
 }
 
-// compiledPathCache memoizes parsed query plans keyed by the original query
-// string. Compiled queries are immutable after creation and safe to share
-// across goroutines. The cache is bounded to avoid unbounded memory growth in
-// long-lived processes that evaluate many distinct user-provided queries.
-var compiledPathCache = newBoundedConcurrentCache(defaultCompiledCacheMaxEntries)
+// QueryCache is a bounded cache of compiled queries and filter expressions,
+// keyed by their source. Compiled queries are immutable after creation, so a
+// cache is safe to share across goroutines. The bound avoids unbounded memory
+// growth in long-lived processes that evaluate many distinct user-provided
+// queries.
+type QueryCache struct {
+	queries *boundedConcurrentCache
+	filters *boundedConcurrentCache
+}
+
+// NewQueryCache creates a cache holding up to `maxEntries` queries and as many
+// filter expressions, evicting the oldest entries first. If `maxEntries` is
+// less than one then nothing is cached.
+func NewQueryCache(maxEntries int) *QueryCache {
+	if maxEntries < 1 {
+		return &QueryCache{}
+	}
+	return &QueryCache{
+		queries: newBoundedConcurrentCache(maxEntries),
+		filters: newBoundedConcurrentCache(maxEntries),
+	}
+}
 
-// mexprCache stores parsed filter ASTs keyed by expression string. The
-// resulting tree is read-only during execution so it is safe to share. The
-// cache is bounded for the same reason as compiledPathCache.
-var mexprCache = newBoundedConcurrentCache(defaultCompiledCacheMaxEntries)
+// defaultQueryCache is used by `GetPath` unless `GetOptions.Cache` is set.
+var defaultQueryCache = NewQueryCache(defaultCompiledCacheMaxEntries)
 
-// compiledQuery is the internal prepared-query representation used by GetPath.
-// A query may contain multiple pipe-separated segments, each executed in order.
-type compiledQuery struct {
+// Query is a compiled query which can be executed many times against
+// different inputs. It may contain multiple pipe-separated segments, each
+// executed in order. Queries are safe for concurrent use.
+type Query struct {
 	expression string
 	segments   []compiledSegment
+
+	// scoped is set if the query or a nested query references the root or a
+	// parent, which must then be tracked while it runs.
+	scoped bool
 }
 
 type compiledSegment struct {
-	ops []compiledOp
+	expression string
+	offset     uint
+	ops        []compiledOp
 }
 
 type compiledOp interface{}
@@ -103,45 +129,149 @@ type compiledPropOp struct {
 
 type compiledRecursivePropOp struct {
 	key any
+
+	// nodes gets the matches in the order of a JSONPath descendant segment,
+	// where the matching children of a value come before its descendants,
+	// and always gets a list.
+	nodes bool
 }
 
 type compiledIndexOp struct {
 	isSlice    bool
 	startIndex int
 	stopIndex  int
+
+	// step is the step of a slice like `[::2]`, or zero if it has none.
+	step int
+
+	// nodes only gets items of arrays like a JSONPath index, so that
+	// anything else or an index out of range is not found.
+	nodes bool
 }
 
 type compiledFilterOp struct {
-	ast *mexpr.Node
+	expr      string
+	offset    uint
+	ast       *mexpr.Node
+	calls     []string
+	regexes   []filterRegex
+	variables []filterVariable
 }
 
 type compiledArrayLiteralOp struct {
-	elements []*compiledQuery
+	elements []*Query
+}
+
+type compiledCallOp struct {
+	offset uint
+	name   string
+	args   []any
+	parens bool
+
+	// key is the first argument of a stage function compiled as a query.
+	key *Query
 }
 
 type compiledField struct {
 	key   string
-	query *compiledQuery
+	query *Query
+
+	// pattern is set for an unaliased glob or regex field like `{app*}`,
+	// which selects every matching key.
+	pattern *keyPattern
+
+	// all is set for an unaliased `*`, which selects every key.
+	all bool
 }
 
 type compiledFieldsOp struct {
 	offset   uint
 	fields   []compiledField
 	parseErr Error
+
+	// excludes are keys or patterns removed from the keys selected by `*`
+	// and patterns, e.g. `{*, -password}`.
+	excludes []any
 }
 
 type compiledExecResult struct {
 	value    any
 	found    bool
 	consumed bool
+
+	// streamed is set if the results were passed to an emit function rather
+	// than collected into the value.
+	streamed bool
+
+	// at is the location of the value when finding paths.
+	at *location
 }
 
 type GetOptions struct {
 	// DebugLogger sets a function to be used for printing out debug information.
 	DebugLogger func(format string, a ...any)
+
+	// Cache is used by `GetPath` to store compiled queries. Defaults to a
+	// process-wide cache of 1024 entries. Use `NewQueryCache(0)` to disable
+	// caching.
+	Cache *QueryCache
+
+	// Functions are Go functions callable from queries by name. In a pipe,
+	// e.g. `items | toCSV`, the piped value is passed as the first argument
+	// followed by any literal arguments, e.g. `| round(2)`. Filters can also
+	// call them for each item, e.g. `items[isExpired(created)]`. Functions may
+	// return an error as a second result. They take precedence over built-in
+	// functions and, within filters, over fields with the same name, but a
+	// bare name after a pipe gets a property of an object which has it.
+	Functions map[string]any
+
+	// Variables are values referenced by name in filters, indexes, and at the
+	// start of a query, e.g. `items[owner == $user]`, `items[$idx]`, or
+	// `count |= $n`. Unlike formatting values into the query string, they
+	// can't change the meaning of the query and the compiled query is reused
+	// for any values. A string used as an index gets that key from a map.
+	// At the start of a query, a variable which isn't set is a property like
+	// `$ref` instead.
+	Variables map[string]any
+
+	// KeepFilteredKeys makes filters over maps, e.g. `services[status ==
+	// down]`, return a map of the matching entries with their original keys
+	// instead of an array of the matching values sorted by key.
+	KeepFilteredKeys bool
+
+	// Strict makes filters fail instead of skipping items they can't check.
+	// Unless `CollectErrors` is set, the query stops at the first item which is missing a property used by
+	// the filter, e.g. `nmae` in `items[nmae == bob]`, or for which the
+	// filter fails, e.g. comparing a string to a number or calling a function
+	// which returns an error. The error points to the failing part of the
+	// filter. Unquoted strings compared against, e.g. `bob`, are not
+	// required to be properties.
+	Strict bool
+
+	// CollectErrors makes strict mode skip each item which fails rather than
+	// stopping at the first, then return the errors of every failed item
+	// together as `Errors` once the query is done.
+	CollectErrors bool
+
+	// MaxSteps limits the work a query can do, counting each operation on
+	// each value, each item checked by a filter, and each value visited by a
+	// recursive search. A query which takes more steps fails with an error
+	// wrapping `ErrStepLimit`. Zero means no limit.
+	MaxSteps int
+
+	// budget counts the steps taken by the running query and holds its
+	// context, if any.
+	budget *queryBudget
+
+	// scope tracks the root and parents of the current value while running a
+	// query which references them.
+	scope *queryScope
+
+	// errors collects the errors of failed items when `CollectErrors` is set.
+	errors *Errors
 }
 
-var propPathUnescaper = strings.NewReplacer(`\.`, ".", `\{`, "{", `\[`, "[", `\]`, "]", `\:`, ":", `\^`, "^")
+var propPathUnescaper = strings.NewReplacer(`\\`, `\`, `\.`, ".", `\{`, "{", `\[`, "[", `\]`, "]", `\:`, ":", `\^`, "^")
 
 // unescapePropPath removes prop-escaping backslashes added by parseQuoted(escapeProp=true).
 func unescapePropPath(s string) string {
@@ -159,50 +289,401 @@ func mapKeys[M ~map[K]V, K comparable, V any](m M) []K {
 }
 
 func GetPath(path string, input any, options GetOptions) (any, bool, Error) {
-	query, err := getCompiledPath(path)
+	cache := options.Cache
+	if cache == nil {
+		cache = defaultQueryCache
+	}
+	query, err := cache.compile(path)
 	if err != nil {
 		return nil, false, err
 	}
 	return query.Exec(input, options)
 }
 
-// getCompiledPath returns a cached compiled query plan or builds one on first
-// use. Callers should treat the returned plan as read-only.
-func getCompiledPath(path string) (*compiledQuery, Error) {
-	if cached, ok := compiledPathCache.Load(path); ok {
-		return cached.(*compiledQuery), nil
+// CompileQuery parses a query so it can be validated once and executed many
+// times. Unlike `GetPath`, all syntax errors are returned here rather than
+// when the query runs. Nothing is cached; see `QueryCache.Compile`.
+func CompileQuery(path string) (*Query, Error) {
+	return (*QueryCache)(nil).Compile(path)
+}
+
+// Compile is like `CompileQuery` but returns a cached query if available and
+// caches the result otherwise. A nil cache compiles without caching.
+func (c *QueryCache) Compile(path string) (*Query, Error) {
+	query, err := c.compile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// compile returns a cached compiled query plan or builds one on first use.
+// Callers should treat the returned plan as read-only.
+func (c *QueryCache) compile(path string) (*Query, Error) {
+	if c == nil || c.queries == nil {
+		return compilePath(path, c)
+	}
+
+	if cached, ok := c.queries.Load(path); ok {
+		return cached.(*Query), nil
 	}
 
-	query, err := compilePath(path)
+	query, err := compilePath(path, c)
 	if err != nil {
 		return nil, err
 	}
 
-	actual, _ := compiledPathCache.LoadOrStore(path, query)
-	return actual.(*compiledQuery), nil
+	actual, _ := c.queries.LoadOrStore(path, query)
+	return actual.(*Query), nil
 }
 
 // compilePath parses a query string into executable segments. Parsing reuses
 // the Document helpers below so the compiled path stays aligned with the query
-// grammar and existing error reporting.
-func compilePath(path string) (*compiledQuery, Error) {
-	d := Document{expression: path}
-	query := &compiledQuery{expression: path}
+// grammar and existing error reporting. Nested queries and filters are
+// compiled using `cache`, which may be nil.
+func compilePath(path string, cache *QueryCache) (*Query, Error) {
+	d := Document{expression: path, queryCache: cache}
+	query := &Query{expression: path}
 
 	for d.pos < uint(len(d.expression)) {
-		segment, err := d.compileSegment(len(query.segments) == 0)
+		if len(query.segments) > 0 {
+			d.skipWhitespace()
+		}
+		start := d.pos
+		var segment compiledSegment
+		op, ok, err := d.compileOperators()
 		if err != nil {
 			return nil, err
 		}
+		if !ok {
+			var call compiledCallOp
+			call, ok, err = d.compileCall(len(query.segments) > 0)
+			if err != nil {
+				return nil, err
+			}
+			op = call
+		}
+		if ok {
+			segment.ops = []compiledOp{op}
+		} else {
+			segment, err = d.compileSegment(len(query.segments) == 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		raw := path[start:d.pos]
+		segment.expression = strings.TrimSpace(raw)
+		segment.offset = start + uint(len(raw)-len(strings.TrimLeft(raw, " \t\r\n")))
 		query.segments = append(query.segments, segment)
 		if d.peek() == '|' {
 			d.next()
 		}
 	}
 
+	query.scoped = query.usesScope()
 	return query, nil
 }
 
+// validate returns the first syntax error which `GetPath` defers until the
+// query runs, including those in nested queries.
+func (q *Query) validate() Error {
+	for _, segment := range q.segments {
+		for _, op := range segment.ops {
+			switch op := op.(type) {
+			case compiledFieldsOp:
+				if op.parseErr != nil {
+					return op.parseErr
+				}
+				for _, field := range op.fields {
+					if err := field.query.validate(); err != nil {
+						return err
+					}
+				}
+			case compiledArrayLiteralOp:
+				for _, element := range op.elements {
+					if err := element.validate(); err != nil {
+						return err
+					}
+				}
+			case compiledCallOp:
+				if op.key != nil {
+					if err := op.key.validate(); err != nil {
+						return err
+					}
+				}
+			case compiledUpdateOp:
+				if err := validateOperands([]queryOperand{{query: op.path}, op.value}); err != nil {
+					return err
+				}
+			case compiledFallbackOp:
+				if err := validateOperands(op.operands); err != nil {
+					return err
+				}
+			case compiledConditionalOp:
+				if err := validateOperands(op.branches); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateOperands validates the queries of fallback and conditional operands.
+func validateOperands(operands []queryOperand) Error {
+	for _, operand := range operands {
+		if operand.query != nil {
+			if err := operand.query.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the source of the query.
+func (q *Query) String() string {
+	return q.expression
+}
+
+// QueryOpKind identifies the kind of a `QueryOp`.
+type QueryOpKind int
+
+const (
+	// QueryOpProp gets a property, e.g. `foo`, or all values with `*`.
+	QueryOpProp QueryOpKind = iota
+
+	// QueryOpRecursiveProp finds a property at any depth, e.g. `..foo`.
+	QueryOpRecursiveProp
+
+	// QueryOpDot separates path parts, e.g. `foo.bar`. When the current value
+	// is an array, the rest of the segment is applied to each item.
+	QueryOpDot
+
+	// QueryOpFlatten flattens nested arrays by one level, e.g. `[]`.
+	QueryOpFlatten
+
+	// QueryOpIndex gets a single item, e.g. `[0]` or `[$idx]`.
+	QueryOpIndex
+
+	// QueryOpSlice gets an inclusive range of items, e.g. `[1:2]`.
+	QueryOpSlice
+
+	// QueryOpFilter keeps array items matching an expression, e.g. `[id > 5]`.
+	QueryOpFilter
+
+	// QueryOpArray constructs an array from queries, e.g. `[id, name]`.
+	QueryOpArray
+
+	// QueryOpFields selects fields into a new object, e.g. `{id, n: name}`.
+	QueryOpFields
+
+	// QueryOpCall calls a function on the piped value, e.g. `| length`.
+	QueryOpCall
+
+	// QueryOpRoot gets the input of the outermost query, e.g. `$.user`.
+	QueryOpRoot
+
+	// QueryOpParent gets an object containing the current value, e.g.
+	// `^.team`.
+	QueryOpParent
+
+	// QueryOpFallback gets the first operand which is present, e.g.
+	// `name || "unknown"` or `nickname ?? name`.
+	QueryOpFallback
+
+	// QueryOpConditional gets one of two branches depending on a condition,
+	// e.g. `if status == ok then value else error`.
+	QueryOpConditional
+
+	// QueryOpUpdate replaces the values matched by a path, e.g.
+	// `..password |= "***"`, and gets the updated input.
+	QueryOpUpdate
+
+	// QueryOpSelect is a segment of a JSONPath query, e.g. `['a','b']` or
+	// `..[?@.id]`, which selects from each value of the current list. Its
+	// selectors are in `Selectors`. Segments with a single name or index,
+	// e.g. `.a` or `[0]`, use dot and prop or index operations instead, and
+	// `..a` uses a recursive prop operation.
+	QueryOpSelect
+
+	// QueryOpVariable gets a variable at the start of a path, e.g. `$user`
+	// in `$user.name`, or the property of that name if it isn't set.
+	QueryOpVariable
+)
+
+// QueryOp describes a single operation within a query segment.
+type QueryOp struct {
+	Kind QueryOpKind
+
+	// Key is the property for prop and recursive prop operations. It is a
+	// string unless the key was coerced, e.g. `1` or `true`.
+	Key any
+
+	// Pattern is set when `Key` is a glob like `app*` or a regular expression
+	// like `/^x-/` which may match any number of keys.
+	Pattern bool
+
+	// Start and Stop are the indexes of index and slice operations. Negative
+	// values count from the end.
+	Start int
+	Stop  int
+
+	// Step is the step of a slice operation, e.g. `2` for `[::2]`, or zero
+	// if it has none.
+	Step int
+
+	// Variable is the name of the variable of an index operation like
+	// `[$idx]` or a variable operation like `$user`, without the `$`.
+	Variable string
+
+	// Parents is the number of levels up of a parent operation, e.g. 2 for
+	// `^^`.
+	Parents int
+
+	// Filter is the expression of a filter operation or the condition of a
+	// conditional operation.
+	Filter string
+
+	// Selectors holds the source of each selector of a select operation,
+	// e.g. `'a'` and `?@.id > 1` for `['a', ?@.id > 1]`, or `$` or `@` for
+	// the operation starting a JSONPath query. Descendant is set for a
+	// descendant segment like `..[0]`.
+	Selectors  []string
+	Descendant bool
+
+	// Operators holds the `||` or `??` operators of a fallback operation,
+	// each coming before the operand with the same index plus one.
+	Operators []string
+
+	// Fields holds the output keys of a field selection. A `*` or pattern
+	// field selects every matching key of the input.
+	Fields []string
+
+	// Excludes holds the keys or patterns removed from a field selection,
+	// e.g. `password` for `{*, -password}`.
+	Excludes []string
+
+	// Function and Args are the name and literal arguments of a function
+	// call. A call without parentheses is a property lookup if no function
+	// with that name exists when the query runs. For update, fallback, and
+	// conditional operations, Args holds the literal operands, e.g.
+	// `"unknown"`, lining up with the nil entries of `Queries`.
+	Function string
+	Args     []any
+
+	// Queries holds the nested queries of array construction and field
+	// selection operations. For field selections they line up with `Fields`.
+	// For fallback and conditional operations they are the operands and
+	// branches, which are nil for literals. For update operations they are
+	// the path and the new value.
+	Queries []*Query
+}
+
+// QuerySegment describes one pipe-separated segment of a query.
+type QuerySegment struct {
+	// Expression is the source of the segment.
+	Expression string
+
+	// Ops are the operations executed in order for the segment.
+	Ops []QueryOp
+}
+
+// Segments describes the pipe-separated segments of a query and the
+// operations in each, e.g. to inspect which fields a query accesses.
+func (q *Query) Segments() []QuerySegment {
+	segments := make([]QuerySegment, len(q.segments))
+	for i, segment := range q.segments {
+		ops := make([]QueryOp, 0, len(segment.ops))
+		for _, op := range segment.ops {
+			switch op := op.(type) {
+			case compiledPropOp:
+				ops = append(ops, describeProp(QueryOpProp, op.key))
+			case compiledRecursivePropOp:
+				ops = append(ops, describeProp(QueryOpRecursiveProp, op.key))
+			case compiledDotOp:
+				ops = append(ops, QueryOp{Kind: QueryOpDot})
+			case compiledFlattenOp:
+				ops = append(ops, QueryOp{Kind: QueryOpFlatten})
+			case compiledIndexOp:
+				kind := QueryOpIndex
+				if op.isSlice {
+					kind = QueryOpSlice
+				}
+				ops = append(ops, QueryOp{Kind: kind, Start: op.startIndex, Stop: op.stopIndex, Step: op.step})
+			case compiledVariableIndexOp:
+				ops = append(ops, QueryOp{Kind: QueryOpIndex, Variable: op.name})
+			case compiledVariableOp:
+				ops = append(ops, QueryOp{Kind: QueryOpVariable, Variable: op.name})
+			case compiledScopeOp:
+				if op.parents == 0 {
+					ops = append(ops, QueryOp{Kind: QueryOpRoot})
+				} else {
+					ops = append(ops, QueryOp{Kind: QueryOpParent, Parents: op.parents})
+				}
+			case compiledFilterOp:
+				ops = append(ops, QueryOp{Kind: QueryOpFilter, Filter: op.expr})
+			case compiledArrayLiteralOp:
+				ops = append(ops, QueryOp{Kind: QueryOpArray, Queries: op.elements})
+			case compiledFieldsOp:
+				desc := QueryOp{Kind: QueryOpFields}
+				for _, field := range op.fields {
+					desc.Fields = append(desc.Fields, field.key)
+					desc.Queries = append(desc.Queries, field.query)
+				}
+				for _, exclude := range op.excludes {
+					desc.Excludes = append(desc.Excludes, fmt.Sprintf("%v", exclude))
+				}
+				ops = append(ops, desc)
+			case compiledCallOp:
+				desc := QueryOp{Kind: QueryOpCall, Function: op.name, Args: op.args}
+				if op.key != nil {
+					desc.Queries = []*Query{op.key}
+				}
+				ops = append(ops, desc)
+			case compiledUpdateOp:
+				ops = append(ops, describeOperands(QueryOp{Kind: QueryOpUpdate}, []queryOperand{{query: op.path}, op.value}))
+			case compiledFallbackOp:
+				ops = append(ops, describeOperands(QueryOp{Kind: QueryOpFallback, Operators: op.operators}, op.operands))
+			case compiledConditionalOp:
+				ops = append(ops, describeOperands(QueryOp{Kind: QueryOpConditional, Filter: op.cond.expr}, op.branches))
+			case compiledSelectOp:
+				desc := QueryOp{Kind: QueryOpSelect, Descendant: op.descendant}
+				if op.root {
+					desc.Selectors = []string{segment.expression}
+				}
+				for _, selector := range op.selectors {
+					desc.Selectors = append(desc.Selectors, selector.source)
+				}
+				ops = append(ops, desc)
+			}
+		}
+		segments[i] = QuerySegment{Expression: segment.expression, Ops: ops}
+	}
+	return segments
+}
+
+// describeProp describes a prop operation, using the source of a pattern key.
+func describeProp(kind QueryOpKind, key any) QueryOp {
+	if p, ok := key.(*keyPattern); ok {
+		return QueryOp{Kind: kind, Key: p.source, Pattern: true}
+	}
+	return QueryOp{Kind: kind, Key: key}
+}
+
+// describeOperands adds the queries and literals of fallback operands or
+// conditional branches to a description.
+func describeOperands(desc QueryOp, operands []queryOperand) QueryOp {
+	for _, operand := range operands {
+		desc.Queries = append(desc.Queries, operand.query)
+		desc.Args = append(desc.Args, operand.literal)
+	}
+	return desc
+}
+
 // compileSegment compiles one pipe-delimited segment of a query into a flat
 // sequence of executable ops. Filters and field selections recursively compile
 // nested query fragments.
@@ -211,6 +692,26 @@ func (d *Document) compileSegment(allowArrayLiteral bool) (compiledSegment, Erro
 
 outer:
 	for {
+		if p := d.peek(); p == ' ' || p == '\t' || p == '\n' || p == '\r' {
+			// Allow whitespace before a pipe, e.g. `items[0] | length`.
+			saved := d.pos
+			d.skipWhitespace()
+			if p := d.peek(); p != -1 && p != '|' {
+				d.pos = saved
+			}
+		}
+
+		if len(ops) == 0 {
+			if op, ok := d.compileScope(); ok {
+				ops = append(ops, op)
+				continue
+			}
+			if op, ok := d.compileVariable(); ok {
+				ops = append(ops, op)
+				continue
+			}
+		}
+
 		switch d.peek() {
 		case -1, '|':
 			break outer
@@ -236,25 +737,30 @@ outer:
 				}
 			}
 
-			isSlice, startIndex, stopIndex, expr, err := d.parsePathIndex()
+			index, expr, err := d.parsePathIndex()
 			if err != nil {
 				return compiledSegment{}, err
 			}
 
+			if isVariable(expr) {
+				ops = append(ops, compiledVariableIndexOp{
+					offset: d.pos - uint(len(expr)+1),
+					name:   expr[1:],
+				})
+				continue
+			}
+
 			if expr != "" {
-				ast, err := compileMexpr(d, expr)
+				base := d.pos - uint(len(expr)+1)
+				filter, err := compileMexpr(d, expr, base)
 				if err != nil {
 					return compiledSegment{}, err
 				}
-				ops = append(ops, compiledFilterOp{ast: ast})
+				ops = append(ops, filter.op(expr, base))
 				continue
 			}
 
-			ops = append(ops, compiledIndexOp{
-				isSlice:    isSlice,
-				startIndex: startIndex,
-				stopIndex:  stopIndex,
-			})
+			ops = append(ops, index)
 		case '.':
 			d.next()
 			if d.peek() == '.' {
@@ -280,22 +786,40 @@ outer:
 				break outer
 			}
 
-			compiledFields := make([]compiledField, len(fields))
-			for i, field := range fields {
-				query, err := getCompiledPath(field.path)
+			op := compiledFieldsOp{offset: start}
+			copies := false
+			for _, field := range fields {
+				query, err := d.queryCache.compile(field.path)
 				if err != nil {
 					return compiledSegment{}, err
 				}
-				compiledFields[i] = compiledField{
-					key:   field.key,
-					query: query,
+				if field.exclude {
+					key, ok := query.singleProp()
+					if !ok {
+						return compiledSegment{}, NewError(&d.expression, start, 1, "field selection can only exclude keys, but found -%s", field.path)
+					}
+					op.excludes = append(op.excludes, key)
+					continue
+				}
+				compiled := compiledField{key: field.key, query: query}
+				if !field.alias {
+					compiled.all = field.path == "*"
+					compiled.pattern = query.keyPattern()
 				}
+				copies = copies || compiled.all || compiled.pattern != nil
+				op.fields = append(op.fields, compiled)
 			}
 
-			ops = append(ops, compiledFieldsOp{
-				offset: start,
-				fields: compiledFields,
-			})
+			if len(op.excludes) > 0 && !copies {
+				// Excluding keys implies selecting all others, e.g. `{-password}`.
+				query, err := d.queryCache.compile("*")
+				if err != nil {
+					return compiledSegment{}, err
+				}
+				op.fields = append([]compiledField{{key: "*", query: query, all: true}}, op.fields...)
+			}
+
+			ops = append(ops, op)
 		case ',', ']', '}':
 			d.next()
 		default:
@@ -310,29 +834,52 @@ outer:
 	return compiledSegment{ops: ops}, nil
 }
 
-// compileMexpr compiles and caches filter expressions used inside `[...]`.
-func compileMexpr(d *Document, expr string) (*mexpr.Node, Error) {
-	if cached, ok := mexprCache.Load(expr); ok {
-		return cached.(*mexpr.Node), nil
+// compileMexpr compiles and caches filter expressions used inside `[...]`,
+// including the patterns of any regex matches like `name =~ "^web-"`. The
+// base is the offset of the expression within the query.
+func compileMexpr(d *Document, expr string, base uint) (*compiledFilter, Error) {
+	cache := d.queryCache
+	if cache != nil && cache.filters != nil {
+		if cached, ok := cache.filters.Load(expr); ok {
+			return cached.(*compiledFilter), nil
+		}
 	}
 
-	ast, err := mexpr.Parse(expr, nil)
+	replaced, offsets := replaceRegexOps(expr)
+	replaced, parentRefs := replaceParentRefs(replaced)
+	ast, err := mexpr.Parse(replaced, nil)
 	if err != nil {
-		return nil, NewError(&d.expression, d.pos-uint(len(expr)+1)+uint(err.Offset()), uint(err.Length()), err.Error())
+		return nil, NewError(&d.expression, base+uint(err.Offset()), uint(err.Length()), err.Error())
+	}
+	filter := &compiledFilter{ast: ast, variables: findFilterVariables(ast, base, parentRefs, nil)}
+	if len(offsets) > 0 {
+		regexes, err := d.findFilterRegexes(ast, offsets, base, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		filter.regexes = regexes
 	}
 
-	actual, _ := mexprCache.LoadOrStore(expr, ast)
-	return actual.(*mexpr.Node), nil
+	if cache == nil || cache.filters == nil {
+		return filter, nil
+	}
+	actual, _ := cache.filters.LoadOrStore(expr, filter)
+	return actual.(*compiledFilter), nil
 }
 
 // Exec evaluates a compiled query against an input value while preserving the
 // same `(value, found, err)` contract as GetPath.
-func (q *compiledQuery) Exec(input any, options GetOptions) (any, bool, Error) {
+func (q *Query) Exec(input any, options GetOptions) (any, bool, Error) {
 	result := input
 	found := false
+	options = options.withBudget()
+	options, collected := options.withErrors()
+	if q.scoped && options.scope == nil {
+		options.scope = &queryScope{root: input}
+	}
 
 	for i := range q.segments {
-		execResult, err := q.execSegment(&q.segments[i], result, 0, options)
+		execResult, err := q.execSegment(&q.segments[i], result, nil, 0, options, nil)
 		if err != nil {
 			return execResult.value, execResult.found, err
 		}
@@ -340,18 +887,100 @@ func (q *compiledQuery) Exec(input any, options GetOptions) (any, bool, Error) {
 		found = execResult.found
 	}
 
-	return result, found, nil
+	return result, found, collected.err()
+}
+
+// execAt runs each segment of the query in order like `Exec`, starting from
+// an input found at the given location and tracking the location of the
+// result while finding paths.
+func (q *Query) execAt(input any, at *location, options GetOptions) (any, bool, *location, Error) {
+	result := input
+	found := false
+
+	for i := range q.segments {
+		execResult, err := q.execSegment(&q.segments[i], result, at, 0, options, nil)
+		if err != nil {
+			return execResult.value, execResult.found, nil, err
+		}
+		result = execResult.value
+		found = execResult.found
+		at = execResult.at
+	}
+
+	return result, found, at, nil
+}
+
+// Each runs a query and calls `fn` with each of its results, stopping early
+// if `fn` returns false. A query ending in a filter, a fan-out over an array,
+// a flatten, or a recursive search, e.g. `items[status == failed]` or
+// `items.name`, has a result for each item that `Exec` would return in an
+// array. These are produced one at a time without building the array, so
+// checking whether any item matches stops at the first one. Any other query
+// has a single result if it is found.
+func (q *Query) Each(input any, options GetOptions, fn func(value any) bool) Error {
+	if len(q.segments) == 0 {
+		return nil
+	}
+	options = options.withBudget()
+	options, collected := options.withErrors()
+	if q.scoped && options.scope == nil {
+		options.scope = &queryScope{root: input}
+	}
+
+	result := input
+	last := len(q.segments) - 1
+	for i := 0; i < last; i++ {
+		execResult, err := q.execSegment(&q.segments[i], result, nil, 0, options, nil)
+		if err != nil {
+			return err
+		}
+		result = execResult.value
+	}
+
+	segment := &q.segments[last]
+	execResult, err := q.execSegment(segment, result, nil, 0, options, fn)
+	if err != nil {
+		return err
+	}
+	if execResult.streamed || !execResult.found {
+		return collected.err()
+	}
+
+	var lastOp compiledOp
+	if len(segment.ops) > 0 {
+		lastOp = segment.ops[len(segment.ops)-1]
+	}
+	switch lastOp.(type) {
+	case compiledSelectOp:
+		if items, ok := execResult.value.([]any); ok {
+			for _, item := range items {
+				if !fn(item) {
+					break
+				}
+			}
+			return collected.err()
+		}
+	}
+	fn(execResult.value)
+	return collected.err()
 }
 
 // execSegment executes a compiled segment, optionally starting in the middle of
 // the op list. That ability lets filter and dot-fanout ops apply the remaining
 // tail of the segment to each matching array item without reparsing the query.
-func (q *compiledQuery) execSegment(segment *compiledSegment, input any, start int, options GetOptions) (compiledExecResult, Error) {
+// If `emit` is set, the results of a fan-out are passed to it one at a time
+// instead of being collected into an array, stopping when it returns false.
+// When finding paths, the location of the input is given by `at` and that of
+// the result is returned, and ops which create new values return an error.
+func (q *Query) execSegment(segment *compiledSegment, input any, at *location, start int, options GetOptions, emit func(any) bool) (compiledExecResult, Error) {
 	result := input
 	found := false
 	consumed := false
 
 	for i := start; i < len(segment.ops); i++ {
+		if err := q.spend(segment, options.budget); err != nil {
+			return compiledExecResult{}, err
+		}
 		switch op := segment.ops[i].(type) {
 		case compiledDotOp:
 			consumed = true
@@ -361,26 +990,51 @@ func (q *compiledQuery) execSegment(segment *compiledSegment, input any, start i
 				continue
 			}
 
-			out := make([]any, 0, len(items))
-			for _, item := range items {
-				child, err := q.execSegment(segment, item, i+1, options)
+			var out []any
+			if emit == nil {
+				out = make([]any, 0, len(items))
+			}
+			fan := newFanOut(at, items)
+			for j, item := range items {
+				child, err := q.execSegment(segment, item, fan.item(j), i+1, options, nil)
 				if err != nil {
 					return compiledExecResult{}, err
 				}
-				if child.consumed {
-					if child.found {
-						out = append(out, child.value)
-					}
-				} else if child.value != nil {
+				if child.consumed && !child.found || !child.consumed && child.value == nil {
+					continue
+				}
+				if emit == nil {
 					out = append(out, child.value)
+					fan.add(child.at)
+				} else if !emit(child.value) {
+					break
 				}
 			}
 
-			return compiledExecResult{value: out, found: true, consumed: true}, nil
+			return compiledExecResult{value: out, found: true, consumed: true, streamed: emit != nil, at: fan.location()}, nil
 		case compiledFlattenOp:
 			if options.DebugLogger != nil {
 				options.DebugLogger("Flattening %v", result)
 			}
+			if at != nil {
+				at = flattenLocation(result, at)
+			}
+			if items, ok := result.([]any); ok && emit != nil && i == len(segment.ops)-1 {
+				// The last op streams its items rather than building a new
+				// array of them.
+				for _, item := range items {
+					if nested, ok := item.([]any); ok {
+						if !emitEach(nested, emit) {
+							break
+						}
+						continue
+					}
+					if !emit(item) {
+						break
+					}
+				}
+				return compiledExecResult{found: true, consumed: true, streamed: true}, nil
+			}
 			if items, ok := result.([]any); ok {
 				out := make([]any, 0, len(items))
 				for _, item := range items {
@@ -397,86 +1051,562 @@ func (q *compiledQuery) execSegment(segment *compiledSegment, input any, start i
 			found = true
 			consumed = true
 		case compiledPropOp:
-			var ok bool
-			result, ok = execCompiledProp(op.key, result, options)
-			found = ok
+			if q.scoped && isMap(result) {
+				options.scope = options.scope.withParent(result)
+			}
+			value, ok := execCompiledProp(op.key, result, options)
+			if at != nil {
+				at = propLocation(op.key, result, at, ok)
+			}
+			result, found = value, ok
 			consumed = true
 		case compiledRecursivePropOp:
-			var err Error
-			result, err = execCompiledRecursiveProp(op.key, result, options)
+			if emit != nil && at == nil && i == len(segment.ops)-1 {
+				if err := execCompiledRecursivePropEach(op, result, options, emit); err != nil {
+					return compiledExecResult{}, q.budgetError(segment, options.budget, err)
+				}
+				return compiledExecResult{found: true, consumed: true, streamed: true}, nil
+			}
+			var err error
+			result, at, err = execCompiledRecursiveProp(op, result, at, options)
 			if err != nil {
-				return compiledExecResult{}, err
+				return compiledExecResult{}, q.budgetError(segment, options.budget, err)
 			}
 			found = true
 			consumed = true
 		case compiledIndexOp:
+			consumed = true
+			if op.nodes && !hasIndex(op, result) {
+				result, found = nil, false
+				at = at.notFound()
+				continue
+			}
+			if at != nil {
+				var err Error
+				if at, err = q.indexLocation(op, result, at); err != nil {
+					return compiledExecResult{}, err
+				}
+			}
 			result = execCompiledIndex(op, result, options)
 			found = true
+		case compiledScopeOp:
+			if at != nil {
+				if op.parents > 0 {
+					return compiledExecResult{}, NewError(&q.expression, op.offset, uint(op.parents), "cannot find paths for parent references")
+				}
+				at = &location{}
+			}
+			result, found = options.scope.lookup(op.parents)
+			consumed = true
+		case compiledVariableOp:
+			consumed = true
+			if value, ok := options.Variables[op.name]; ok {
+				// Like a literal, the value has no location in the input.
+				at = at.notFound()
+				result, found = value, true
+				continue
+			}
+			key := "$" + op.name
+			if q.scoped && isMap(result) {
+				options.scope = options.scope.withParent(result)
+			}
+			value, ok := execCompiledProp(key, result, options)
+			if at != nil {
+				at = propLocation(key, result, at, ok)
+			}
+			result, found = value, ok
+		case compiledVariableIndexOp:
+			key, err := q.variableKey(op, options)
+			if err != nil {
+				return compiledExecResult{}, err
+			}
+			if index, ok := key.(int); ok {
+				indexOp := compiledIndexOp{startIndex: index, stopIndex: index}
+				if at != nil {
+					if at, err = q.indexLocation(indexOp, result, at); err != nil {
+						return compiledExecResult{}, err
+					}
+				}
+				result = execCompiledIndex(indexOp, result, options)
+				found = true
+			} else {
+				value, ok := execCompiledProp(key, result, options)
+				if at != nil {
+					at = propLocation(key, result, at, ok)
+				}
+				result, found = value, ok
+			}
 			consumed = true
 		case compiledFilterOp:
 			consumed = true
+			if isMap(result) {
+				if options.KeepFilteredKeys {
+					emit = nil
+				}
+				value, valueAt, err := q.execMapFilter(segment, i, op, result, at, options, emit)
+				if err != nil {
+					return compiledExecResult{}, err
+				}
+				return compiledExecResult{value: value, found: true, consumed: true, streamed: emit != nil, at: valueAt}, nil
+			}
 			items, ok := result.([]any)
 			if !ok {
 				result = nil
 				found = true
+				at = at.notFound()
 				continue
 			}
 
-			interpreter := mexpr.NewInterpreter(op.ast, mexpr.UnquotedStrings)
-			out := make([]any, 0, len(items))
-			for _, item := range items {
-				filterResult, err := interpreter.Run(item)
+			matches, err := q.filterMatcher(op, options)
+			if err != nil {
+				return compiledExecResult{}, err
+			}
+			var out []any
+			if emit == nil {
+				out = make([]any, 0, len(items))
+			}
+			fan := newFanOut(at, items)
+			for j, item := range items {
+				if err := q.spend(segment, options.budget); err != nil {
+					return compiledExecResult{}, err
+				}
+				matched, err := matches(item)
 				if err != nil {
+					return compiledExecResult{}, err
+				}
+				if !matched {
 					continue
 				}
-				if matched, ok := filterResult.(bool); ok && matched {
-					child, err := q.execSegment(segment, item, i+1, options)
+				child, err := q.execSegment(segment, item, fan.item(j), i+1, options, nil)
+				if err != nil {
+					return compiledExecResult{}, err
+				}
+				if emit == nil {
+					out = append(out, child.value)
+					fan.add(child.at)
+				} else if !emit(child.value) {
+					break
+				}
+			}
+
+			return compiledExecResult{value: out, found: true, consumed: true, streamed: emit != nil, at: fan.location()}, nil
+		case compiledArrayLiteralOp:
+			if at != nil {
+				return compiledExecResult{}, NewError(&q.expression, 0, 1, "cannot find paths for array construction, which creates a new value")
+			}
+			if options.DebugLogger != nil {
+				options.DebugLogger("Getting array literal")
+			}
+			out := make([]any, 0, len(op.elements))
+			for _, element := range op.elements {
+				value, _, err := element.Exec(result, options)
+				if err != nil {
+					return compiledExecResult{}, err
+				}
+				out = append(out, value)
+			}
+			result = out
+			found = true
+			consumed = true
+		case compiledFieldsOp:
+			if at != nil {
+				return compiledExecResult{}, NewError(&q.expression, op.offset, 1, "cannot find paths for field selection, which creates a new value")
+			}
+			if !isMap(result) {
+				return compiledExecResult{}, NewError(&q.expression, op.offset, 1, "field selection requires a map, but found %v", result)
+			}
+			if op.parseErr != nil {
+				return compiledExecResult{}, op.parseErr
+			}
+
+			out, err := execCompiledFields(op, result, options)
+			if err != nil {
+				return compiledExecResult{}, err
+			}
+			result = out
+			found = true
+			consumed = true
+		case compiledCallOp:
+			consumed = true
+			if !op.parens {
+				// A bare name is a property first, so `x | length` keeps
+				// getting `length` from objects which have it.
+				if value, ok := execCompiledProp(op.name, result, options); ok {
+					if at != nil {
+						at = propLocation(op.name, result, at, ok)
+					}
+					result, found = value, ok
+					continue
+				}
+			}
+			if _, ok := options.Functions[op.name]; !ok {
+				if stage, ok := stageFunctions[op.name]; ok {
+					if at != nil {
+						return compiledExecResult{}, q.createsValueError(op.offset, uint(len(op.name)), op.name)
+					}
+					value, err := q.execStage(op, stage, result, options)
 					if err != nil {
 						return compiledExecResult{}, err
 					}
-					out = append(out, child.value)
+					result = value
+					found = true
+					continue
+				}
+			}
+			fn := lookupFunction(op.name, options)
+			if fn == nil {
+				if op.parens {
+					return compiledExecResult{}, NewError(&q.expression, op.offset, uint(len(op.name)), "unknown function %s", op.name)
+				}
+				// Not a function, so keep the original meaning of a property.
+				value, ok := execCompiledProp(op.name, result, options)
+				if at != nil {
+					at = propLocation(op.name, result, at, ok)
+				}
+				result, found = value, ok
+				continue
+			}
+			if at != nil {
+				return compiledExecResult{}, q.createsValueError(op.offset, uint(len(op.name)), op.name)
+			}
+			if options.DebugLogger != nil {
+				options.DebugLogger("Calling function %s%v", op.name, op.args)
+			}
+			value, err := fn(result, op.args)
+			if err != nil {
+				return compiledExecResult{}, NewError(&q.expression, op.offset, uint(len(op.name)), "%s", err.Error())
+			}
+			result = value
+			found = true
+		case compiledUpdateOp:
+			if at != nil {
+				return compiledExecResult{}, NewError(&q.expression, op.offset, 2, "cannot find paths for an update, which creates a new value")
+			}
+			var err Error
+			if result, err = q.execUpdate(op, result, options); err != nil {
+				return compiledExecResult{}, err
+			}
+			found = true
+			consumed = true
+		case compiledFallbackOp:
+			var err Error
+			result, found, at, err = q.execFallback(op, result, at, options)
+			if err != nil {
+				return compiledExecResult{}, err
+			}
+			consumed = true
+		case compiledConditionalOp:
+			branch, ok, err := q.conditionalBranch(op, result, options)
+			if err != nil {
+				return compiledExecResult{}, err
+			}
+			current := result
+			result, found = nil, false
+			if ok {
+				if at != nil && branch.query == nil {
+					return compiledExecResult{}, q.createsValueError(0, uint(len(q.expression)), branch.literal)
+				}
+				if result, found, at, err = branch.exec(current, at, options); err != nil {
+					return compiledExecResult{}, err
 				}
+			} else {
+				at = at.notFound()
 			}
+			consumed = true
+		case compiledSelectOp:
+			var err Error
+			if result, at, err = q.execSelect(segment, op, result, at, options); err != nil {
+				return compiledExecResult{}, err
+			}
+			found = true
+			consumed = true
+		}
+	}
+
+	return compiledExecResult{value: result, found: found, consumed: consumed, at: at}, nil
+}
+
+// flattenLocation returns the location of the result of flattening an input
+// when finding paths.
+func flattenLocation(input any, at *location) *location {
+	items, ok := input.([]any)
+	if !ok {
+		return missingLocation
+	}
+	itemsAt := at.items(items)
+	list := make([]location, 0, len(items))
+	for j, item := range items {
+		if nested, ok := item.([]any); ok {
+			list = append(list, itemsAt[j].items(nested)...)
+		} else {
+			list = append(list, itemsAt[j])
+		}
+	}
+	return locationList(list)
+}
+
+// execSelect runs a JSONPath selector over the items of the input, or over
+// the input itself for the root, returning the selected values along with
+// their locations when finding paths.
+func (q *Query) execSelect(segment *compiledSegment, op compiledSelectOp, input any, at *location, options GetOptions) ([]any, *location, Error) {
+	var nodes []pathMatch
+	if op.root {
+		nodes = []pathMatch{{value: input}}
+		if at != nil {
+			nodes[0].path = at.path
+		}
+	} else {
+		items, _ := input.([]any)
+		var itemsAt []location
+		if at != nil {
+			itemsAt = at.items(items)
+		}
+		nodes = make([]pathMatch, len(items))
+		for j, item := range items {
+			nodes[j] = pathMatch{value: item}
+			if at != nil {
+				nodes[j].path = itemsAt[j].path
+			}
+		}
+		var err Error
+		if nodes, err = q.selectNodes(segment, op, nodes, options, at != nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	values := make([]any, len(nodes))
+	var list []location
+	if at != nil {
+		list = make([]location, len(nodes))
+	}
+	for j, node := range nodes {
+		values[j] = node.value
+		if at != nil {
+			list[j] = location{path: node.path}
+		}
+	}
+	return values, locationList(list), nil
+}
+
+// execStage runs a stage function like `sortBy(age)`, evaluating its key
+// query against each item of the input array.
+func (q *Query) execStage(op compiledCallOp, stage stageFunction, input any, options GetOptions) (any, Error) {
+	if op.key == nil {
+		return nil, NewError(&q.expression, op.offset, uint(len(op.name)), "%s requires a key, e.g. %s(id)", op.name, op.name)
+	}
+	items, ok := input.([]any)
+	if !ok {
+		return nil, NewError(&q.expression, op.offset, uint(len(op.name)), "%s requires an array, but found %v", op.name, input)
+	}
+	if options.DebugLogger != nil {
+		options.DebugLogger("Calling stage %s%v", op.name, op.args)
+	}
+
+	keys := make([]any, len(items))
+	for i, item := range items {
+		key, _, err := op.key.Exec(item, options)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+
+	value, err := stage(items, keys, op.args[1:])
+	if err != nil {
+		return nil, NewError(&q.expression, op.offset, uint(len(op.name)), "%s", err.Error())
+	}
+	return value, nil
+}
+
+// execMapFilter runs a filter over the values of a map in key order, applying
+// the rest of the segment to each match like an array filter does. Results are
+// passed to `emit` if set, which doesn't support `KeepFilteredKeys`.
+func (q *Query) execMapFilter(segment *compiledSegment, i int, op compiledFilterOp, input any, at *location, options GetOptions, emit func(any) bool) (any, *location, Error) {
+	keys, values, _ := patternEntries(nil, input)
+
+	matches, err := q.filterMatcher(op, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	var matchedKeys, results []any
+	var resultsAt []location
+	if emit == nil {
+		matchedKeys = make([]any, 0, len(values))
+		results = make([]any, 0, len(values))
+	}
+	if at != nil {
+		resultsAt = make([]location, 0, len(values))
+	}
+	for j, value := range values {
+		if err := q.spend(segment, options.budget); err != nil {
+			return nil, nil, err
+		}
+		matched, err := matches(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !matched {
+			continue
+		}
+		var valueAt *location
+		if at != nil {
+			valueAt = at.child(keys[j])
+		}
+		child, err := q.execSegment(segment, value, valueAt, i+1, options, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if emit != nil {
+			if !emit(child.value) {
+				break
+			}
+			continue
+		}
+		matchedKeys = append(matchedKeys, keys[j])
+		results = append(results, child.value)
+		if at != nil {
+			resultsAt = append(resultsAt, *child.at)
+		}
+	}
+
+	if !options.KeepFilteredKeys {
+		return results, locationList(resultsAt), nil
+	}
+	if _, ok := input.(map[any]any); ok {
+		out := make(map[any]any, len(results))
+		for j, key := range matchedKeys {
+			out[key] = results[j]
+		}
+		return out, nil, nil
+	}
+	out := make(map[string]any, len(results))
+	for j, key := range matchedKeys {
+		out[key.(string)] = results[j]
+	}
+	return out, nil, nil
+}
+
+// filterMatcher returns a function which reports whether an item matches a
+// filter expression. Items for which the expression fails do not match unless
+// the options are strict, in which case the failure is returned as an error
+// pointing into the filter. It returns an error if the filter uses a variable
+// which isn't set.
+func (q *Query) filterMatcher(op compiledFilterOp, options GetOptions) (func(item any) (bool, Error), Error) {
+	variables, err := q.variableLiterals(op.variables, options)
+	if err != nil {
+		return nil, err
+	}
 
-			return compiledExecResult{value: out, found: true, consumed: true}, nil
-		case compiledArrayLiteralOp:
-			if options.DebugLogger != nil {
-				options.DebugLogger("Getting array literal")
+	interpreterOptions := []mexpr.InterpreterOption{mexpr.UnquotedStrings}
+	var required []*mexpr.Node
+	if options.Strict {
+		interpreterOptions = append(interpreterOptions, mexpr.StrictMode)
+		required = requiredProperties(op.ast, op.variables, nil)
+	}
+
+	ast := substituteNodes(op.ast, variables)
+	var env *filterEnv
+	if len(op.calls) > 0 || len(op.regexes) > 0 {
+		if env, ast, err = q.newFilterEnv(op, variables, options, interpreterOptions); err != nil {
+			return nil, err
+		}
+	}
+	interpreter := mexpr.NewInterpreter(ast, interpreterOptions...)
+
+	return func(item any) (bool, Error) {
+		if options.Strict {
+			if node := missingProperty(required, item); node != nil {
+				return false, options.failItem(NewError(&q.expression, op.offset+uint(node.Offset), uint(node.Length), "no property %v in %s", node.Value, describeItem(item)))
 			}
-			out := make([]any, 0, len(op.elements))
-			for _, element := range op.elements {
-				value, _, err := element.Exec(result, options)
-				if err != nil {
-					return compiledExecResult{}, err
-				}
-				out = append(out, value)
+		}
+		var input any = item
+		if env != nil {
+			env.set(item)
+			input = env.values
+		}
+		result, err := interpreter.Run(input)
+		if env != nil && env.err != nil {
+			if !options.Strict {
+				return false, nil
 			}
-			result = out
-			found = true
-			consumed = true
-		case compiledFieldsOp:
-			if !isMap(result) {
-				return compiledExecResult{}, NewError(&q.expression, op.offset, 1, "field selection requires a map, but found %v", result)
+			if merr, ok := env.err.(mexpr.Error); ok && env.errNode == nil {
+				return false, options.failItem(NewError(&q.expression, op.offset+uint(merr.Offset()), uint(merr.Length()), "%s", merr.Error()))
 			}
-			if op.parseErr != nil {
-				return compiledExecResult{}, op.parseErr
+			return false, options.failItem(NewError(&q.expression, op.offset+uint(env.errNode.Offset), uint(env.errNode.Length), "%s", env.err.Error()))
+		}
+		if err != nil {
+			if options.Strict {
+				return false, options.failItem(NewError(&q.expression, op.offset+uint(err.Offset()), uint(err.Length()), "%s", err.Error()))
 			}
+			return false, nil
+		}
+		matched, ok := result.(bool)
+		return ok && matched, nil
+	}, nil
+}
 
-			out := make(map[string]any, len(op.fields))
-			for _, field := range op.fields {
-				value, _, err := field.query.Exec(result, options)
-				if err != nil {
-					return compiledExecResult{}, err
-				}
-				out[field.key] = value
+// execCompiledFields selects fields from a map into a new map. Keys copied by
+// `*` or a pattern are added first, so named fields take precedence over them.
+func execCompiledFields(op compiledFieldsOp, input any, options GetOptions) (map[string]any, Error) {
+	out := make(map[string]any, len(op.fields))
+	for _, field := range op.fields {
+		if field.all || field.pattern != nil {
+			copyFields(out, input, field.pattern, op.excludes)
+		}
+	}
+	for _, field := range op.fields {
+		if field.all || field.pattern != nil {
+			continue
+		}
+		value, _, err := field.query.Exec(input, options)
+		if err != nil {
+			return nil, err
+		}
+		out[field.key] = value
+	}
+	return out, nil
+}
+
+// copyFields copies the entries of a map matching a pattern, or all entries if
+// the pattern is nil, into `out` unless their key is excluded. Keys which
+// aren't strings are converted to strings.
+func copyFields(out map[string]any, input any, pattern *keyPattern, excludes []any) {
+	switch m := input.(type) {
+	case map[string]any:
+		for k, v := range m {
+			if (pattern == nil || pattern.match(k)) && !isExcluded(k, excludes) {
+				out[k] = v
+			}
+		}
+	case map[any]any:
+		for k, v := range m {
+			if (pattern == nil || pattern.match(k)) && !isExcluded(k, excludes) {
+				out[fmt.Sprintf("%v", k)] = v
 			}
-			result = out
-			found = true
-			consumed = true
 		}
 	}
+}
 
-	return compiledExecResult{value: result, found: found, consumed: consumed}, nil
+// isExcluded returns whether a key matches any of the excluded keys or
+// patterns. Keys are compared by their string form, so `-1` excludes both
+// the integer key `1` and the string key `"1"`.
+func isExcluded(key any, excludes []any) bool {
+	for _, exclude := range excludes {
+		if p, ok := exclude.(*keyPattern); ok {
+			if p.match(key) {
+				return true
+			}
+			continue
+		}
+		if key == exclude {
+			return true
+		}
+		_, keyIsString := key.(string)
+		_, excludeIsString := exclude.(string)
+		if !(keyIsString && excludeIsString) && fmt.Sprintf("%v", key) == fmt.Sprintf("%v", exclude) {
+			return true
+		}
+	}
+	return false
 }
 
 // execCompiledProp resolves a single property access or wildcard against a map.
@@ -485,6 +1615,11 @@ func execCompiledProp(key any, input any, options GetOptions) (any, bool) {
 		options.DebugLogger("Getting key '%v'", key)
 	}
 
+	if p, ok := key.(*keyPattern); ok {
+		_, values, ok := patternEntries(p, input)
+		return values, ok
+	}
+
 	if m, ok := input.(map[string]any); ok {
 		if s, ok := key.(string); ok {
 			if s == "*" {
@@ -527,62 +1662,184 @@ func execCompiledProp(key any, input any, options GetOptions) (any, bool) {
 	return nil, false
 }
 
+// propLocation returns the location of the result of `execCompiledProp`
+// when finding paths, given whether it was found.
+func propLocation(key, input any, at *location, found bool) *location {
+	if !found {
+		return missingLocation
+	}
+	if p, ok := key.(*keyPattern); ok || key == "*" {
+		keys, _, _ := patternEntries(p, input)
+		return at.children(keys)
+	}
+	return at.child(key)
+}
+
 // execCompiledRecursiveProp performs recursive descent (`..field`) against the
 // input tree while preserving the stable ordering expected by existing tests.
-func execCompiledRecursiveProp(key, input any, options GetOptions) ([]any, Error) {
+func execCompiledRecursiveProp(op compiledRecursivePropOp, input any, at *location, options GetOptions) ([]any, *location, error) {
 	if options.DebugLogger != nil {
-		options.DebugLogger("Recursive getting key '%v'", key)
+		options.DebugLogger("Recursive getting key '%v'", op.key)
+	}
+	var results []any
+	if op.nodes {
+		results = []any{}
+	}
+	var list []location
+	if at != nil {
+		list = []location{}
 	}
-	return execCompiledFindPropRecursive(key, input)
+	results, err := execCompiledFindPropRecursive(op, input, at, results, &list, options, nil)
+	return results, locationList(list), err
 }
 
-func execCompiledFindPropRecursive(key, input any) ([]any, Error) {
-	var results []any
+// errStopEmit stops a recursive search early once its emit function returns
+// false.
+var errStopEmit = errors.New("stop emitting")
 
-	if m, ok := input.(map[string]any); ok {
-		keys := make([]string, 0, len(m))
-		for k := range m {
-			keys = append(keys, k)
+// execCompiledRecursivePropEach is like `execCompiledRecursiveProp` but
+// passes each value to `emit` as it is found, stopping when it returns false.
+func execCompiledRecursivePropEach(op compiledRecursivePropOp, input any, options GetOptions, emit func(any) bool) error {
+	if options.DebugLogger != nil {
+		options.DebugLogger("Recursive getting key '%v'", op.key)
+	}
+	_, err := execCompiledFindPropRecursive(op, input, nil, nil, nil, options, emit)
+	if err == errStopEmit {
+		return nil
+	}
+	return err
+}
+
+// emitEach passes each item to `emit`, returning false if it stopped early.
+func emitEach(items []any, emit func(any) bool) bool {
+	for _, item := range items {
+		if !emit(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// execCompiledFindPropRecursive appends the values of matching keys at any
+// depth to `results`, sorted by key within each map. Their locations are
+// appended to `list` when finding paths. If `emit` is set, values are passed
+// to it instead of being appended.
+func execCompiledFindPropRecursive(op compiledRecursivePropOp, input any, at *location, results []any, list *[]location, options GetOptions, emit func(any) bool) ([]any, error) {
+	if err := options.budget.spend(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if items, ok := input.([]any); ok {
+		var itemsAt []location
+		if at != nil {
+			itemsAt = at.items(items)
 		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			v := m[k]
-			if s, ok := key.(string); ok && k == s {
-				results = append(results, v)
+		for i, item := range items {
+			var itemAt *location
+			if at != nil {
+				itemAt = &itemsAt[i]
 			}
-			if nested, err := execCompiledFindPropRecursive(key, v); err == nil {
-				results = append(results, nested...)
+			if results, err = execCompiledFindPropRecursive(op, item, itemAt, results, list, options, emit); err != nil {
+				return nil, err
 			}
 		}
+		return results, nil
 	}
 
-	if m, ok := input.(map[any]any); ok {
-		for k, v := range m {
-			if k == key {
-				results = append(results, v)
+	keys, values, ok := patternEntries(nil, input)
+	if !ok {
+		return results, nil
+	}
+	var keysAt []location
+	if at != nil {
+		keysAt = at.children(keys).list
+	}
+	descend := func(i int) error {
+		var childAt *location
+		if at != nil {
+			childAt = &keysAt[i]
+		}
+		results, err = execCompiledFindPropRecursive(op, values[i], childAt, results, list, options, emit)
+		return err
+	}
+	for i, k := range keys {
+		if keyMatches(op.key, k) {
+			if emit != nil {
+				if !emit(values[i]) {
+					return nil, errStopEmit
+				}
+			} else {
+				results = append(results, values[i])
+			}
+			if at != nil {
+				*list = append(*list, keysAt[i])
 			}
-			if nested, err := execCompiledFindPropRecursive(key, v); err == nil {
-				results = append(results, nested...)
+		}
+		if !op.nodes {
+			if err := descend(i); err != nil {
+				return nil, err
 			}
 		}
 	}
-
-	if items, ok := input.([]any); ok {
-		for _, item := range items {
-			if nested, err := execCompiledFindPropRecursive(key, item); err == nil {
-				results = append(results, nested...)
+	if op.nodes {
+		for i := range keys {
+			if err := descend(i); err != nil {
+				return nil, err
 			}
 		}
 	}
-
 	return results, nil
 }
 
+// hasIndex returns whether an index op gets an item of an array.
+func hasIndex(op compiledIndexOp, input any) bool {
+	items, ok := input.([]any)
+	if !ok {
+		return false
+	}
+	_, _, ok = indexRange(op, len(items))
+	return ok
+}
+
+// indexLocation returns the location of the result of `execCompiledIndex`
+// when finding paths. Items of strings and bytes have no path.
+func (q *Query) indexLocation(op compiledIndexOp, input any, at *location) (*location, Error) {
+	items, ok := input.([]any)
+	if !ok {
+		switch input.(type) {
+		case string, []byte:
+			return nil, NewError(&q.expression, 0, uint(len(q.expression)), "cannot find paths within a string or bytes value")
+		}
+		return missingLocation, nil
+	}
+	itemsAt := at.items(items)
+	if op.step != 0 && op.step != 1 {
+		indexes := stepIndexes(op, len(items))
+		if indexes == nil {
+			return missingLocation, nil
+		}
+		list := make([]location, len(indexes))
+		for i, index := range indexes {
+			list[i] = itemsAt[index]
+		}
+		return locationList(list), nil
+	}
+	startIndex, stopIndex, ok := indexRange(op, len(items))
+	if !ok {
+		return missingLocation, nil
+	}
+	if !op.isSlice {
+		return &itemsAt[startIndex], nil
+	}
+	return locationList(itemsAt[startIndex : stopIndex+1]), nil
+}
+
 // execCompiledIndex applies array/string/byte indexing and slicing semantics
 // for a pre-parsed index operation.
 func execCompiledIndex(op compiledIndexOp, input any, options GetOptions) any {
 	if options.DebugLogger != nil {
-		options.DebugLogger("Getting index %v:%v ", op.startIndex, op.stopIndex)
+		options.DebugLogger("Getting index %v:%v:%v ", op.startIndex, op.stopIndex, op.step)
 	}
 
 	length := 0
@@ -595,18 +1852,12 @@ func execCompiledIndex(op compiledIndexOp, input any, options GetOptions) any {
 		length = len(value)
 	}
 
-	startIndex := op.startIndex
-	stopIndex := op.stopIndex
-	if startIndex < 0 {
-		startIndex += length
-	}
-	if stopIndex < 0 {
-		stopIndex += length
-	}
-	if stopIndex > length-1 {
-		stopIndex = length - 1
+	if op.step != 0 && op.step != 1 {
+		return execSteppedSlice(op, input, length)
 	}
-	if startIndex < 0 || startIndex > length-1 || stopIndex < 0 || startIndex > stopIndex {
+
+	startIndex, stopIndex, ok := indexRange(op, length)
+	if !ok {
 		return nil
 	}
 
@@ -628,6 +1879,96 @@ func execCompiledIndex(op compiledIndexOp, input any, options GetOptions) any {
 	}
 }
 
+// execSteppedSlice applies a slice with a step, e.g. `[::2]`, which creates a
+// new value rather than sharing memory with the input.
+func execSteppedSlice(op compiledIndexOp, input any, length int) any {
+	indexes := stepIndexes(op, length)
+	if indexes == nil {
+		return nil
+	}
+
+	switch value := input.(type) {
+	case string:
+		runes := []rune(value)
+		out := make([]rune, len(indexes))
+		for i, index := range indexes {
+			out[i] = runes[index]
+		}
+		return string(out)
+	case []byte:
+		out := make([]byte, len(indexes))
+		for i, index := range indexes {
+			out[i] = value[index]
+		}
+		return out
+	case []any:
+		out := make([]any, len(indexes))
+		for i, index := range indexes {
+			out[i] = value[index]
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// stepIndexes returns the indexes selected by a slice with a step for a value
+// of the given length, or nil if there are none. Like other slices both ends
+// are inclusive, so `[-1:0:-1]` reverses all items. The start must be within
+// range while the stop is clamped to the first or last item.
+func stepIndexes(op compiledIndexOp, length int) []int {
+	var indexes []int
+	if op.step > 0 {
+		startIndex, stopIndex, ok := indexRange(op, length)
+		if !ok {
+			return nil
+		}
+		for i := startIndex; i <= stopIndex; i += op.step {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+
+	startIndex := op.startIndex
+	stopIndex := op.stopIndex
+	if startIndex < 0 {
+		startIndex += length
+	}
+	if stopIndex < 0 {
+		stopIndex += length
+	}
+	if stopIndex < 0 {
+		stopIndex = 0
+	}
+	if startIndex < 0 || startIndex > length-1 || stopIndex > startIndex {
+		return nil
+	}
+	for i := startIndex; i >= stopIndex; i += op.step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// indexRange resolves negative indexes and clamps the range of an index op
+// for a value of the given length. It returns false if the range is empty.
+func indexRange(op compiledIndexOp, length int) (int, int, bool) {
+	startIndex := op.startIndex
+	stopIndex := op.stopIndex
+	if startIndex < 0 {
+		startIndex += length
+	}
+	if stopIndex < 0 {
+		stopIndex += length
+	}
+	if stopIndex > length-1 {
+		stopIndex = length - 1
+	}
+	if startIndex < 0 || startIndex > length-1 || stopIndex < 0 || startIndex > stopIndex {
+		return 0, 0, false
+	}
+	return startIndex, stopIndex, true
+}
+
 func (d *Document) parseUntil(open int, terminators ...rune) (quoted bool, canSlice bool, err Error) {
 	d.buf.Reset()
 	return d.parseUntilNoReset(open, terminators...)
@@ -683,12 +2024,12 @@ outer:
 // parsePathIndex parses the contents of `[...]` after the opening `[` has
 // already been consumed. It returns either an index/slice description or a
 // filter expression string for the compiled query engine to handle.
-func (d *Document) parsePathIndex() (bool, int, int, string, Error) {
+func (d *Document) parsePathIndex() (compiledIndexOp, string, Error) {
 	d.skipWhitespace()
 	start := d.pos
 	_, canSlice, err := d.parseUntil(1, '|')
 	if err != nil {
-		return false, 0, 0, "", err
+		return compiledIndexOp{}, "", err
 	}
 
 	var value string
@@ -699,25 +2040,41 @@ func (d *Document) parsePathIndex() (bool, int, int, string, Error) {
 	}
 
 	if !d.expect(']') {
-		return false, 0, 0, "", d.error(d.pos-start, "expected ']' after index or filter")
+		return compiledIndexOp{}, "", d.error(d.pos-start, "expected ']' after index or filter")
 	}
 
 	if len(value) > 0 {
 		indexes := strings.Split(value, ":")
 		if len(indexes) == 1 {
 			if index, err := strconv.Atoi(value); err == nil {
-				return false, index, index, "", nil
+				return compiledIndexOp{startIndex: index, stopIndex: index}, "", nil
 			}
-		} else {
+		} else if len(indexes) <= 3 {
+			step, stepOK := 0, true
+			if len(indexes) == 3 && indexes[2] != "" {
+				parsed, err := strconv.Atoi(indexes[2])
+				if err == nil && parsed == 0 {
+					return compiledIndexOp{}, "", NewError(&d.expression, start, d.pos-start-1, "slice step cannot be zero")
+				}
+				step, stepOK = parsed, err == nil
+			}
+
+			// Negative steps go from the end to the start by default.
 			if indexes[0] == "" {
 				indexes[0] = "0"
+				if step < 0 {
+					indexes[0] = "-1"
+				}
 			}
-			if startIndex, err := strconv.Atoi(indexes[0]); err == nil {
+			if startIndex, err := strconv.Atoi(indexes[0]); err == nil && stepOK {
 				if indexes[1] == "" {
 					indexes[1] = "-1"
+					if step < 0 {
+						indexes[1] = "0"
+					}
 				}
 				if stopIndex, err := strconv.Atoi(indexes[1]); err == nil {
-					return true, startIndex, stopIndex, "", nil
+					return compiledIndexOp{isSlice: true, startIndex: startIndex, stopIndex: stopIndex, step: step}, "", nil
 				}
 			}
 		}
@@ -727,7 +2084,7 @@ func (d *Document) parsePathIndex() (bool, int, int, string, Error) {
 		}
 	}
 
-	return false, 0, 0, value, nil
+	return compiledIndexOp{}, value, nil
 }
 
 func (d *Document) rebaseError(base uint, err Error) Error {
@@ -836,9 +2193,9 @@ func (d *Document) bracketHasTopLevelComma() (bool, Error) {
 	}
 }
 
-func (d *Document) compileArrayLiteral() ([]*compiledQuery, Error) {
+func (d *Document) compileArrayLiteral() ([]*Query, Error) {
 	d.skipWhitespace()
-	elements := []*compiledQuery{}
+	elements := []*Query{}
 	for {
 		d.skipWhitespace()
 		if d.peek() == ']' {
@@ -853,7 +2210,7 @@ func (d *Document) compileArrayLiteral() ([]*compiledQuery, Error) {
 			return nil, NewError(&d.expression, exprStart, 1, "expected array literal element")
 		}
 
-		query, err := getCompiledPath(expr)
+		query, err := d.queryCache.compile(expr)
 		if err != nil {
 			return nil, d.rebaseError(exprStart, err)
 		}
@@ -886,8 +2243,152 @@ func stringRuneSlice(s string, startIndex int, stopIndex int) string {
 	return s[byteStart:byteEnd]
 }
 
+// compileCall compiles a pipe segment which calls a function, e.g. `length`
+// or `join(", ")`. The first segment of a query must use parentheses, e.g.
+// `length()`, as otherwise it gets a property. If the segment is not a call,
+// then it returns false and leaves the position unchanged.
+func (d *Document) compileCall(afterPipe bool) (compiledCallOp, bool, Error) {
+	savedPos := d.pos
+	savedLastWidth := d.lastWidth
+	d.skipWhitespace()
+	start := d.pos
+	for {
+		r := d.peek()
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (d.pos > start && r >= '0' && r <= '9') {
+			d.next()
+			continue
+		}
+		break
+	}
+
+	op := compiledCallOp{offset: start, name: d.expression[start:d.pos]}
+	if op.name != "" {
+		d.skipWhitespace()
+		if d.peek() == '(' {
+			d.next()
+			args, err := d.parseCallArgs()
+			if err != nil {
+				return compiledCallOp{}, false, err
+			}
+			op.args = make([]any, len(args))
+			for i, arg := range args {
+				op.args[i] = arg.value
+			}
+			if _, ok := stageFunctions[op.name]; ok && len(args) > 0 {
+				op.key, err = d.queryCache.compile(args[0].source)
+				if err != nil {
+					return compiledCallOp{}, false, d.rebaseError(args[0].offset, err)
+				}
+			}
+			op.parens = true
+			d.skipWhitespace()
+		}
+		if p := d.peek(); (p == -1 || p == '|') && (afterPipe || op.parens) {
+			return op, true, nil
+		}
+	}
+
+	d.pos = savedPos
+	d.lastWidth = savedLastWidth
+	return compiledCallOp{}, false, nil
+}
+
+// callArg is a function argument along with its source, which stage
+// functions like `sortBy(age)` compile as a query.
+type callArg struct {
+	offset uint
+	source string
+	value  any
+}
+
+// parseCallArgs parses function arguments after the opening `(` has already
+// been consumed. Quoted arguments are strings and others are coerced like
+// values, e.g. `2` is a number.
+func (d *Document) parseCallArgs() ([]callArg, Error) {
+	args := []callArg{}
+	for {
+		d.skipWhitespace()
+		if d.peek() == ')' && len(args) == 0 {
+			d.next()
+			return args, nil
+		}
+
+		arg := callArg{offset: d.pos}
+		if d.peek() == '"' {
+			d.next()
+			d.buf.Reset()
+			if err := d.parseQuoted(false); err != nil {
+				return nil, err
+			}
+			arg.source = d.expression[arg.offset:d.pos]
+			arg.value = d.buf.String()
+		} else {
+			open := 0
+		scan:
+			for {
+				switch d.peek() {
+				case -1:
+					break scan
+				case '"':
+					d.next()
+					if err := d.skipQuotedRaw(); err != nil {
+						return nil, err
+					}
+					continue
+				case '\\':
+					d.next()
+				case '[', '{', '(':
+					open++
+				case ']', '}':
+					if open > 0 {
+						open--
+					}
+				case ')':
+					if open == 0 {
+						break scan
+					}
+					open--
+				case ',':
+					if open == 0 {
+						break scan
+					}
+				}
+				d.next()
+			}
+			arg.source = strings.TrimSpace(d.expression[arg.offset:d.pos])
+			if arg.source == "" {
+				return nil, d.error(1, "expected function argument")
+			}
+			arg.value = arg.source
+			if v, ok := coerceValue(arg.source, false); ok {
+				arg.value = v
+			}
+		}
+		args = append(args, arg)
+
+		d.skipWhitespace()
+		switch d.next() {
+		case ',':
+			continue
+		case ')':
+			return args, nil
+		}
+		return nil, NewError(&d.expression, d.pos-d.lastWidth, 1, "expected ',' or ')' after function argument")
+	}
+}
+
 func (d *Document) parseGetProp() (any, Error) {
 	d.skipWhitespace()
+	if d.peek() == '/' {
+		pattern, ok, err := d.parseKeyRegex()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return pattern, nil
+		}
+	}
+
 	start := d.pos
 	quoted, canSlice, err := d.parseUntil(0, '.', '[', '|', ',', '}', ']')
 	if err != nil {
@@ -895,12 +2396,21 @@ func (d *Document) parseGetProp() (any, Error) {
 	}
 
 	var key string
-	if canSlice {
+	if canSlice && !quoted {
 		key = d.expression[start:d.pos]
 	} else {
 		key = d.buf.String()
 	}
 
+	if !quoted && d.peek() == '|' {
+		// Allow whitespace before a pipe, e.g. `items | [0]`.
+		key = strings.TrimRightFunc(key, unicode.IsSpace)
+	}
+
+	if !quoted && isGlob(key) {
+		return globPattern(key), nil
+	}
+
 	if !d.options.ForceStringKeys && !quoted {
 		if v, ok := coerceValue(key, false); ok {
 			return v, nil
@@ -917,12 +2427,23 @@ func (d *Document) parseFieldSpecs() ([]fieldSpec, uint, Error) {
 	d.buf.Reset()
 	start := d.pos - 1
 	key := ""
+	exclude := false
 	open := 1
 	var r rune
 	d.skipWhitespace()
 	fields := make([]fieldSpec, 0, 4)
 	for {
 		r = d.next()
+		if r == '"' && key != "" {
+			// Keep quotes in aliased values so that literals like `{name: name ||
+			// "unknown"}` are kept. The compiled path unquotes keys itself.
+			quoteStart := d.pos - 1
+			if err := d.skipQuotedRaw(); err != nil {
+				return nil, 0, err
+			}
+			d.buf.WriteString(d.expression[quoteStart:d.pos])
+			continue
+		}
 		if r == '"' {
 			if err := d.parseQuoted(true); err != nil {
 				return nil, 0, err
@@ -944,6 +2465,32 @@ func (d *Document) parseFieldSpecs() ([]fieldSpec, uint, Error) {
 			}
 			continue
 		}
+		if r == '(' {
+			// Copy function arguments as-is so quotes and commas are kept.
+			argsStart := d.pos - 1
+			depth := 1
+			for depth > 0 {
+				switch d.next() {
+				case -1:
+					return nil, 0, NewError(&d.expression, argsStart, d.pos-argsStart, "expected ')' to close function arguments")
+				case '"':
+					if err := d.skipQuotedRaw(); err != nil {
+						return nil, 0, err
+					}
+				case '(':
+					depth++
+				case ')':
+					depth--
+				}
+			}
+			d.buf.WriteString(d.expression[argsStart:d.pos])
+			continue
+		}
+		if r == '-' && open <= 1 && key == "" && d.buf.Len() == 0 && !exclude {
+			// Exclude a key, e.g. `{*, -password}`.
+			exclude = true
+			continue
+		}
 		if r == ':' && open <= 1 {
 			key = d.buf.String()
 			d.buf.Reset()
@@ -958,16 +2505,18 @@ func (d *Document) parseFieldSpecs() ([]fieldSpec, uint, Error) {
 		}
 		if open == 0 || (open == 1 && r == ',') {
 			path := d.buf.String()
-			if key == "" {
+			alias := key != ""
+			if !alias {
 				// Use the unescaped path as the output key so that quoted names
 				// like `{"foo.bar"}` produce key "foo.bar", not "foo\.bar".
 				key = unescapePropPath(path)
 			}
-			fields = append(fields, fieldSpec{key: key, path: path})
+			fields = append(fields, fieldSpec{key: key, path: path, alias: alias, exclude: exclude})
 			if r == '}' {
 				break
 			}
 			key = ""
+			exclude = false
 			d.buf.Reset()
 			d.skipWhitespace()
 			continue
@@ -3,6 +3,7 @@ package shorthand
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -182,6 +183,60 @@ var getExamples = []struct {
 		Query: `field[1:]`,
 		Go:    []byte("ello"),
 	},
+	{
+		Name:  "Array slice step",
+		Input: `{"field": [0, 1, 2, 3, 4]}`,
+		Query: `field[::2]`,
+		Go:    []any{0.0, 2.0, 4.0},
+	},
+	{
+		Name:  "Array slice step inclusive stop",
+		Input: `{"field": [0, 1, 2, 3, 4, 5]}`,
+		Query: `field[1:5:2]`,
+		Go:    []any{1.0, 3.0, 5.0},
+	},
+	{
+		Name:  "Array slice reversed",
+		Input: `{"field": [0, 1, 2]}`,
+		Query: `field[-1:0:-1]`,
+		Go:    []any{2.0, 1.0, 0.0},
+	},
+	{
+		Name:  "Array slice reversed defaults",
+		Input: `{"field": [0, 1, 2, 3, 4]}`,
+		Query: `field[::-2]`,
+		Go:    []any{4.0, 2.0, 0.0},
+	},
+	{
+		Name:  "Array slice reversed clamped stop",
+		Input: `{"field": [0, 1, 2]}`,
+		Query: `field[1:-10:-1]`,
+		Go:    []any{1.0, 0.0},
+	},
+	{
+		Name:  "Array slice reversed empty",
+		Input: `{"field": [0, 1, 2]}`,
+		Query: `field[0:2:-1]`,
+		Go:    nil,
+	},
+	{
+		Name:  "Array slice zero step",
+		Input: `{"field": [0, 1, 2]}`,
+		Query: `field[::0]`,
+		Error: "slice step cannot be zero",
+	},
+	{
+		Name:  "Slice string reversed unicode",
+		Input: `{"field": "a😈b"}`,
+		Query: `field[::-1]`,
+		Go:    "b😈a",
+	},
+	{
+		Name:  "Slice bytes step",
+		Input: map[string]any{"field": []byte("hello")},
+		Query: `field[::2]`,
+		Go:    []byte("hlo"),
+	},
 	{
 		Name:  "Array item fields",
 		Input: `{"items": [{"f1": {"f2": 1}}, {"f1": {"f2": 2}}, {"other": 3}]}`,
@@ -431,6 +486,519 @@ var getExamples = []struct {
 		Query: `{foo: [body.a}`,
 		Error: "expected ']' after index or filter",
 	},
+	{
+		Name:  "Quoted field without escapes",
+		Input: `{"x y": {"z": 1}}`,
+		Query: `"x y".z`,
+		Go:    1.0,
+	},
+	{
+		Name:  "Function length",
+		Input: `{"items": [1, 2, 3]}`,
+		Query: `items | length`,
+		Go:    3,
+	},
+	{
+		Name:  "Function length string",
+		Input: `{"name": "héllo"}`,
+		Query: `name|length`,
+		Go:    5,
+	},
+	{
+		Name:  "Function max",
+		Input: `{"users": [{"age": 5}, {"age": 7}, {"age": 6}]}`,
+		Query: `users.age | max`,
+		Go:    7.0,
+	},
+	{
+		Name:  "Function min mixed types",
+		Input: `{"items": ["a", 2, null, true]}`,
+		Query: `items | min`,
+		JSON:  `null`,
+	},
+	{
+		Name:  "Function chain",
+		Input: `{"tags": ["b", "a", "b", "c", "a"]}`,
+		Query: `tags | unique | sort`,
+		Go:    []any{"a", "b", "c"},
+	},
+	{
+		Name:  "Function unique keeps order",
+		Input: `{"tags": ["b", "a", "b"]}`,
+		Query: `tags | unique`,
+		Go:    []any{"b", "a"},
+	},
+	{
+		Name:  "Function keys and values",
+		Input: `{"m": {"b": 1, "a": 2}}`,
+		Query: `[m | keys, m | values]`,
+		Go:    []any{[]any{"a", "b"}, []any{2.0, 1.0}},
+	},
+	{
+		Name:  "Function sum ints",
+		Input: map[string]any{"n": []any{1, 2, 3}},
+		Query: `n | sum`,
+		Go:    6,
+	},
+	{
+		Name:  "Function sum floats",
+		Input: map[string]any{"n": []any{1, 2.5}},
+		Query: `n | sum`,
+		Go:    3.5,
+	},
+	{
+		Name:  "Function in field selection",
+		Input: `{"items": [1, 2], "tags": ["a", "a"]}`,
+		Query: `{count: items | length, tags: tags | unique}`,
+		JSON:  `{"count": 2, "tags": ["a"]}`,
+	},
+	{
+		Name:  "Function after flatten with whitespace",
+		Input: `{"users": [{"friends": ["a", "b"]}, {"friends": ["b", "c"]}]}`,
+		Query: `users.friends | [] | unique`,
+		Go:    []any{"a", "b", "c"},
+	},
+	{
+		Name:  "Function starting a query",
+		Input: `[{"a": 1}, {"a": 2}]`,
+		Query: `sumBy(a) `,
+		Go:    3.0,
+	},
+	{
+		Name:  "Function name starting a query is a property",
+		Input: `{"length": 5}`,
+		Query: `length`,
+		Go:    5.0,
+	},
+	{
+		Name:  "Function empty parens",
+		Input: `{"items": [1, 2]}`,
+		Query: `items | length()`,
+		Go:    2,
+	},
+	{
+		Name:  "Function name falls back to property",
+		Input: `{"a": {"b": 1}}`,
+		Query: `a | b`,
+		Go:    1.0,
+	},
+	{
+		Name:  "Function unknown",
+		Input: `{"a": 1}`,
+		Query: `a | nope()`,
+		Error: "unknown function nope",
+	},
+	{
+		Name:  "Function args in field selection",
+		Input: `{"a": [1]}`,
+		Query: `{n: a | nope(",", x)}`,
+		Error: "unknown function nope",
+	},
+	{
+		Name:  "Function wrong type",
+		Input: `{"a": 1}`,
+		Query: `a | sort`,
+		Error: "sort requires an array, but found 1",
+	},
+	{
+		Name:  "Function unexpected args",
+		Input: `{"a": [1]}`,
+		Query: `a | length(1, "x")`,
+		Error: "length takes no arguments but got 2",
+	},
+	{
+		Name:  "Function args unclosed",
+		Input: `{"a": [1]}`,
+		Query: `a | length(1`,
+		Error: "expected ',' or ')' after function argument",
+	},
+	{
+		Name:  "SortBy",
+		Input: `{"users": [{"n": "a", "age": 7}, {"n": "b", "age": 5}, {"n": "c", "age": 7}]}`,
+		Query: `users | sortBy(age) | [].n`,
+		Go:    []any{"b", "a", "c"},
+	},
+	{
+		Name:  "SortBy desc is stable",
+		Input: `{"users": [{"n": "a", "age": 7}, {"n": "b", "age": 5}, {"n": "c", "age": 7}]}`,
+		Query: `users | sortBy(age, desc) | [].n`,
+		Go:    []any{"a", "c", "b"},
+	},
+	{
+		Name:  "SortBy nested key newest N",
+		Input: `{"items": [{"id": 1, "meta": {"created": "2021"}}, {"id": 2, "meta": {"created": "2023"}}, {"id": 3, "meta": {"created": "2022"}}]}`,
+		Query: `items | sortBy(meta.created, desc) | [:1].id`,
+		Go:    []any{2.0, 3.0},
+	},
+	{
+		Name:  "GroupBy",
+		Input: `{"users": [{"n": "a", "team": "x"}, {"n": "b", "team": "y"}, {"n": "c", "team": "x"}, {"n": "d"}]}`,
+		Query: `users | groupBy(team)`,
+		JSON:  `{"x": [{"n": "a", "team": "x"}, {"n": "c", "team": "x"}], "y": [{"n": "b", "team": "y"}], "null": [{"n": "d"}]}`,
+	},
+	{
+		Name:  "CountBy in field selection",
+		Input: `{"items": [{"status": "ok"}, {"status": "err"}, {"status": "ok"}]}`,
+		Query: `{total: items | length, byStatus: items | countBy(status)}`,
+		JSON:  `{"total": 3, "byStatus": {"ok": 2, "err": 1}}`,
+	},
+	{
+		Name:  "CountBy numeric key",
+		Input: map[string]any{"items": []any{map[string]any{"code": 200}, map[string]any{"code": 404}, map[string]any{"code": 200}}},
+		Query: `items | countBy(code)`,
+		Go:    map[string]any{"200": 2, "404": 1},
+	},
+	{
+		Name:  "SumBy",
+		Input: map[string]any{"orders": []any{map[string]any{"total": 5}, map[string]any{"total": 7}, map[string]any{}}},
+		Query: `orders | sumBy(total)`,
+		Go:    12,
+	},
+	{
+		Name:  "SumBy non-number",
+		Input: `{"orders": [{"total": "x"}]}`,
+		Query: `orders | sumBy(total)`,
+		Error: "sumBy requires numbers, but found x",
+	},
+	{
+		Name:  "SortBy missing key",
+		Input: `{"users": []}`,
+		Query: `users | sortBy()`,
+		Error: "sortBy requires a key, e.g. sortBy(id)",
+	},
+	{
+		Name:  "SortBy bad direction",
+		Input: `{"users": [{"age": 1}]}`,
+		Query: `users | sortBy(age, up)`,
+		Error: "sortBy direction must be asc or desc, but found up",
+	},
+	{
+		Name:  "GroupBy non-array",
+		Input: `{"users": {"a": 1}}`,
+		Query: `users | groupBy(team)`,
+		Error: "groupBy requires an array",
+	},
+	{
+		Name:  "GroupBy unbalanced key query",
+		Input: `{"users": []}`,
+		Query: `users | groupBy(a[)`,
+		Error: "expected ',' or ')' after function argument",
+	},
+	{
+		Name:  "Function sum non-number",
+		Input: `{"a": [1, "x"]}`,
+		Query: `a | sum`,
+		Error: "sum requires numbers, but found x",
+	},
+	{
+		Name:  "Filter regex",
+		Input: `{"items": [{"name": "web-1"}, {"name": "web-x"}, {"name": "db-2"}, {"id": 4}]}`,
+		Query: `items[name =~ "^web-\d+" or name =~ "2$"].name`,
+		Go:    []any{"web-1", "db-2"},
+	},
+	{
+		Name:  "Filter regex on items",
+		Input: `{"tags": ["a=1", "b", "c=3"]}`,
+		Query: `tags[not (@ =~ "=")]`,
+		Go:    []any{"b"},
+	},
+	{
+		Name:  "Filter regex operator in string",
+		Input: `{"items": [{"op": "=~"}, {"op": "=="}]}`,
+		Query: `items[op == "=~"].op`,
+		Go:    []any{"=~"},
+	},
+	{
+		Name:  "Filter regex unquoted",
+		Input: `{"items": []}`,
+		Query: `items[name =~ web]`,
+		Error: "=~ expects a quoted regular expression",
+	},
+	{
+		Name:  "Filter regex invalid",
+		Input: `{"items": []}`,
+		Query: `items[name =~ "(web"]`,
+		Error: "invalid regular expression",
+	},
+	{
+		Name:  "Filter regex within where",
+		Input: `{"items": []}`,
+		Query: `items[tags where @ =~ "a"]`,
+		Error: "=~ is not supported within where",
+	},
+	{
+		Name:  "Glob key",
+		Input: `{"labels": {"app": "a", "app.kubernetes.io/name": "b", "tier": "c"}}`,
+		Query: `labels.app*`,
+		Go:    []any{"a", "b"},
+	},
+	{
+		Name:  "Glob key field selection",
+		Input: `{"labels": {"app": "a", "app.kubernetes.io/name": "b", "tier": "c"}}`,
+		Query: `labels.{app*, t: tier}`,
+		Go:    map[string]any{"app": "a", "app.kubernetes.io/name": "b", "t": "c"},
+	},
+	{
+		Name:  "Glob key field selection alias",
+		Input: `{"labels": {"app": "a", "tier": "c"}}`,
+		Query: `labels.{apps: app*}`,
+		Go:    map[string]any{"apps": []any{"a"}},
+	},
+	{
+		Name:  "Glob key quoted",
+		Input: `{"a*": 1, "ab": 2}`,
+		Query: `"a*"`,
+		Go:    1.0,
+	},
+	{
+		Name:  "Glob key invalid UTF-8",
+		Input: map[string]any{"a\xb8": 1, "b": 2},
+		Query: "*\xb8",
+		Go:    []any{1},
+	},
+	{
+		Name:  "Regex key",
+		Input: `{"metadata": {"x-a": 1, "x-b.c": 2, "y": 3}}`,
+		Query: `metadata./^x-\w(\.c)?$/`,
+		Go:    []any{1.0, 2.0},
+	},
+	{
+		Name:  "Regex key field selection",
+		Input: `{"metadata": {"x-a": 1, "y": 3, "z": 4}}`,
+		Query: `metadata.{/^x-|z/}`,
+		Go:    map[string]any{"x-a": 1.0, "z": 4.0},
+	},
+	{
+		Name:  "Regex key non-string keys",
+		Input: map[any]any{1: "a", 12: "b", "x": "c"},
+		Query: `/^1/`,
+		Go:    []any{"a", "b"},
+	},
+	{
+		Name:  "Recursive glob key",
+		Input: `{"a": {"app": 1, "b": {"apple": 2}}}`,
+		Query: `..app*`,
+		Go:    []any{1.0, 2.0},
+	},
+	{
+		Name:  "Slash key without closing slash",
+		Input: `{"paths": {"/users": 1}}`,
+		Query: `paths./users`,
+		Go:    1.0,
+	},
+	{
+		Name:  "Field exclusion",
+		Input: `{"id": 1, "name": "a", "password": "p", "secrets": {"key": "k"}}`,
+		Query: `{*, -password, -secrets}`,
+		Go:    map[string]any{"id": 1.0, "name": "a"},
+	},
+	{
+		Name:  "Field exclusion implies all",
+		Input: `{"id": 1, "x-a": 2, "x-b": 3}`,
+		Query: `{-x-*}`,
+		Go:    map[string]any{"id": 1.0},
+	},
+	{
+		Name:  "Field exclusion non-string keys",
+		Input: map[any]any{1: "a", 2: "b", "password": "p"},
+		Query: `{*, -1, -password}`,
+		Go:    map[string]any{"2": "b"},
+	},
+	{
+		Name:  "Field all with computed",
+		Input: `{"id": 1, "name": "a", "tags": ["x", "y"]}`,
+		Query: `{extra: tags | length, *, name: tags[0], -tags}`,
+		Go:    map[string]any{"id": 1.0, "name": "x", "extra": 2},
+	},
+	{
+		Name:  "Field all non-string keys",
+		Input: map[any]any{1: "a", true: "b"},
+		Query: `{*, extra: 1}`,
+		Go:    map[string]any{"1": "a", "true": "b", "extra": "a"},
+	},
+	{
+		Name:  "Field all aliased",
+		Input: `{"a": 1, "b": 2}`,
+		Query: `{values: *}`,
+		Go:    map[string]any{"values": []any{1.0, 2.0}},
+	},
+	{
+		Name:  "Field exclusion of a path",
+		Input: `{"meta": {"id": 1}}`,
+		Query: `{*, -meta.id}`,
+		Error: "field selection can only exclude keys, but found -meta.id",
+	},
+	{
+		Name:  "Map filter",
+		Input: `{"services": {"web": {"status": "down"}, "db": {"status": "up"}, "api": {"status": "down"}}}`,
+		Query: `services[status == down]`,
+		Go:    []any{map[string]any{"status": "down"}, map[string]any{"status": "down"}},
+	},
+	{
+		Name:  "Map filter with path",
+		Input: `{"services": {"web": {"port": 80}, "db": {"port": 5432}, "api": {"port": 8080}}}`,
+		Query: `services[port > 100].port`,
+		Go:    []any{8080.0, 5432.0},
+	},
+	{
+		Name:  "Regex key invalid",
+		Input: `{}`,
+		Query: `metadata./x(/`,
+		Error: "invalid regular expression",
+	},
+	{
+		Name:  "Fallback",
+		Input: `{"name": ""}`,
+		Query: `name || "unknown"`,
+		Go:    "unknown",
+	},
+	{
+		Name:  "Fallback nullish",
+		Input: `{"name": "", "nick": null}`,
+		Query: `nick ?? name`,
+		Go:    "",
+	},
+	{
+		Name:  "Fallback chain",
+		Input: `{"email": "a@example.com"}`,
+		Query: `nick ?? name ?? email`,
+		Go:    "a@example.com",
+	},
+	{
+		Name:  "Fallback keeps zero",
+		Input: `{"count": 0}`,
+		Query: `count || 5`,
+		Go:    0.0,
+	},
+	{
+		Name:  "Fallback before pipe",
+		Input: `{"tags": ["a", "b"]}`,
+		Query: `labels || tags | length`,
+		Go:    2,
+	},
+	{
+		Name:  "Fallback in fields",
+		Input: `{"items": [{"name": "a"}, {"id": 2}]}`,
+		Query: `items.{name: name || "unknown", id: id ?? 0}`,
+		Go: []any{
+			map[string]any{"name": "a", "id": 0},
+			map[string]any{"name": "unknown", "id": 2.0},
+		},
+	},
+	{
+		Name:  "Fallback in array",
+		Input: `{"b": 2}`,
+		Query: `[a ?? b, c || null]`,
+		Go:    []any{2.0, nil},
+	},
+	{
+		Name:  "Fallback missing operand",
+		Input: `{}`,
+		Query: `name ||`,
+		Error: "expected value for ||",
+	},
+	{
+		Name:  "Conditional",
+		Input: `{"status": "ok", "value": 1, "error": "bad"}`,
+		Query: `if status == ok then value else error`,
+		Go:    1.0,
+	},
+	{
+		Name:  "Conditional else",
+		Input: `{"status": "failed", "value": 1, "error": "bad"}`,
+		Query: `if status == ok then value else error`,
+		Go:    "bad",
+	},
+	{
+		Name:  "Conditional nested",
+		Input: `{"a": 1, "b": 2}`,
+		Query: `if a == 1 then if b == 1 then "one" else "two" else "none"`,
+		Go:    "two",
+	},
+	{
+		Name:  "Conditional in fields",
+		Input: `{"items": [{"size": 1}, {"size": 10}]}`,
+		Query: `items.{size: if size > 5 then "large" else "small"}`,
+		Go:    []any{map[string]any{"size": "small"}, map[string]any{"size": "large"}},
+	},
+	{
+		Name:  "Conditional after pipe",
+		Input: `{"items": [1, 2]}`,
+		Query: `items | if @.length > 1 then "many" else "few"`,
+		Go:    "many",
+	},
+	{
+		Name:  "Conditional as fallback",
+		Input: `{"status": "ok"}`,
+		Query: `name || if status == ok then "yes" else "no"`,
+		Go:    "yes",
+	},
+	{
+		Name:  "Conditional without then",
+		Input: `{}`,
+		Query: `if status == ok`,
+		Error: "expected 'then' after if condition",
+	},
+	{
+		Name:  "Conditional invalid condition",
+		Input: `{}`,
+		Query: `if status == then value`,
+		Error: "incomplete expression",
+	},
+	{
+		Name:  "Conditional key",
+		Input: `{"if": 1}`,
+		Query: `if`,
+		Go:    1.0,
+	},
+	{
+		Name:  "Update filtered",
+		Input: `{"items": [{"status": "old"}, {"status": "ok"}]}`,
+		Query: `items[status == old].status |= "new"`,
+		JSON:  `{"items": [{"status": "new"}, {"status": "ok"}]}`,
+	},
+	{
+		Name:  "Update recursive",
+		Input: `{"password": "a", "db": {"password": "b", "host": "h"}}`,
+		Query: `..password |= "***"`,
+		JSON:  `{"password": "***", "db": {"password": "***", "host": "h"}}`,
+	},
+	{
+		Name:  "Update with query",
+		Input: `{"items": [{"id": 1, "secret": "x"}], "tags": ["b", "a", "b"]}`,
+		Query: `items[0] |= {id} | tags |= unique()`,
+		JSON:  `{"items": [{"id": 1}], "tags": ["b", "a"]}`,
+	},
+	{
+		Name:  "Update then query",
+		Input: `{"items": [{"name": "a"}, {"name": "b"}]}`,
+		Query: `items.name |= "x" | items.name`,
+		Go:    []any{"x", "x"},
+	},
+	{
+		Name:  "Update no matches",
+		Input: `{"a": 1}`,
+		Query: `b |= 2`,
+		JSON:  `{"a": 1}`,
+	},
+	{
+		Name:  "Update fallback",
+		Input: `{"items": [{"name": ""}, {"name": "b"}]}`,
+		Query: `items[:] |= {*, name: name || "unknown"}`,
+		JSON:  `{"items": [{"name": "unknown"}, {"name": "b"}]}`,
+	},
+	{
+		Name:  "Update literal path",
+		Input: `{}`,
+		Query: `"a" |= 1`,
+		Error: "expected a path to update",
+	},
+	{
+		Name:  "Update field selection",
+		Input: `{"a": {"b": 1}}`,
+		Query: `a.{b} |= 1`,
+		Error: "cannot find paths for field selection",
+	},
 }
 
 func TestGet(t *testing.T) {
@@ -541,14 +1109,14 @@ func TestGetPathAdditionalEdgeCases(t *testing.T) {
 			name:  "Single bracket expression is not array literal",
 			input: map[string]any{"body": map[string]any{"subject": "docs"}},
 			query: `[body.subject]`,
-			want:  nil,
+			want:  []any{},
 			found: true,
 		},
 		{
 			name:  "Single bracket expression in field is not array literal",
 			input: map[string]any{"body": map[string]any{"subject": "docs"}},
 			query: `{foo: [body.subject]}`,
-			want:  map[string]any{"foo": nil},
+			want:  map[string]any{"foo": []any{}},
 			found: true,
 		},
 		{
@@ -730,8 +1298,669 @@ func TestBoundedConcurrentCacheEvictsOldest(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestCompileQuery(t *testing.T) {
+	query, err := CompileQuery(`users[age > 5].{id, names: friends|[0]}`)
+	require.NoError(t, err)
+	assert.Equal(t, `users[age > 5].{id, names: friends|[0]}`, query.String())
+
+	input := map[string]any{
+		"users": []any{
+			map[string]any{"id": 1, "age": 5, "friends": []any{"a"}},
+			map[string]any{"id": 2, "age": 6, "friends": []any{"b", "c"}},
+		},
+	}
+	result, found, err := query.Exec(input, GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []any{map[string]any{"id": 2, "names": "b"}}, result)
+
+	for _, bad := range []string{`{id`, `{a: {id}, b: {c`, `[a, {b]`, `items[a ==]`, `[a, ]`} {
+		t.Run(bad, func(t *testing.T) {
+			_, err := CompileQuery(bad)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestQuerySegments(t *testing.T) {
+	query, err := CompileQuery(`foo.bar[0][1:-1][]..id | items[id > 1].{id, n: name}`)
+	require.NoError(t, err)
+
+	segments := query.Segments()
+	require.Len(t, segments, 2)
+
+	assert.Equal(t, "foo.bar[0][1:-1][]..id", segments[0].Expression)
+	assert.Equal(t, []QueryOp{
+		{Kind: QueryOpProp, Key: "foo"},
+		{Kind: QueryOpDot},
+		{Kind: QueryOpProp, Key: "bar"},
+		{Kind: QueryOpIndex},
+		{Kind: QueryOpSlice, Start: 1, Stop: -1},
+		{Kind: QueryOpFlatten},
+		{Kind: QueryOpRecursiveProp, Key: "id"},
+	}, segments[0].Ops)
+
+	assert.Equal(t, "items[id > 1].{id, n: name}", segments[1].Expression)
+	ops := segments[1].Ops
+	require.Len(t, ops, 4)
+	assert.Equal(t, QueryOp{Kind: QueryOpFilter, Filter: "id > 1"}, ops[1])
+	assert.Equal(t, QueryOpFields, ops[3].Kind)
+	assert.Equal(t, []string{"id", "n"}, ops[3].Fields)
+	assert.Equal(t, "name", ops[3].Queries[1].String())
+
+	query, err = CompileQuery(`a[1::2][::-1]`)
+	require.NoError(t, err)
+	assert.Equal(t, []QueryOp{
+		{Kind: QueryOpProp, Key: "a"},
+		{Kind: QueryOpSlice, Start: 1, Stop: -1, Step: 2},
+		{Kind: QueryOpSlice, Start: -1, Stop: 0, Step: -1},
+	}, query.Segments()[0].Ops)
+
+	query, err = CompileQuery(`[a, b]`)
+	require.NoError(t, err)
+	ops = query.Segments()[0].Ops
+	require.Len(t, ops, 1)
+	assert.Equal(t, QueryOpArray, ops[0].Kind)
+	require.Len(t, ops[0].Queries, 2)
+	assert.Equal(t, "b", ops[0].Queries[1].String())
+
+	_, err = CompileQuery(`items | sortBy(tags[id >])`)
+	require.Error(t, err)
+	assert.Equal(t, uint(24), err.Offset())
+
+	query, err = CompileQuery(`items | sortBy(meta.age, desc)`)
+	require.NoError(t, err)
+	ops = query.Segments()[1].Ops
+	require.Len(t, ops, 1)
+	assert.Equal(t, []any{"meta.age", "desc"}, ops[0].Args)
+	assert.Equal(t, "meta.age", ops[0].Queries[0].String())
+
+	query, err = CompileQuery(`labels.app*..x-* | /^x-/`)
+	require.NoError(t, err)
+	segments = query.Segments()
+	assert.Equal(t, []QueryOp{
+		{Kind: QueryOpProp, Key: "labels"},
+		{Kind: QueryOpDot},
+		{Kind: QueryOpProp, Key: "app*", Pattern: true},
+		{Kind: QueryOpRecursiveProp, Key: "x-*", Pattern: true},
+	}, segments[0].Ops)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpProp, Key: "/^x-/", Pattern: true}}, segments[1].Ops)
+
+	query, err = CompileQuery(`{*, -password, -x-*, id: name}`)
+	require.NoError(t, err)
+	ops = query.Segments()[0].Ops
+	require.Len(t, ops, 1)
+	assert.Equal(t, []string{"*", "id"}, ops[0].Fields)
+	assert.Equal(t, []string{"password", "x-*"}, ops[0].Excludes)
+
+	query, err = CompileQuery(`items | join(", ", 2)`)
+	require.NoError(t, err)
+	assert.Equal(t, []QueryOp{
+		{Kind: QueryOpCall, Function: "join", Args: []any{", ", 2}},
+	}, query.Segments()[1].Ops)
+}
+
+func TestGetFunctions(t *testing.T) {
+	input := map[string]any{
+		"items": []any{
+			map[string]any{"id": 1, "created": "2020-01-01", "tags": []any{"a", "b"}},
+			map[string]any{"id": 2, "created": "2030-01-01", "tags": []any{"c"}},
+		},
+		"words": []any{"a", "bb"},
+		"obj":   map[string]any{"length": 3, "keys": "k"},
+		"n":     1.5,
+	}
+
+	options := GetOptions{Functions: map[string]any{
+		"isExpired": func(created string) bool {
+			return created < "2025-01-01"
+		},
+		"ids": func(items []any) (string, error) {
+			out := []string{}
+			for _, item := range items {
+				out = append(out, fmt.Sprintf("%v", item.(map[string]any)["id"]))
+			}
+			return strings.Join(out, ","), nil
+		},
+		"scale": func(v float64, by int) float64 {
+			return v * float64(by)
+		},
+		"join": func(items []any, sep string, more ...string) string {
+			out := []string{}
+			for _, item := range items {
+				out = append(out, fmt.Sprintf("%v", item))
+			}
+			return strings.Join(out, sep) + strings.Join(more, "")
+		},
+		"fail": func(v any) (any, error) {
+			return nil, fmt.Errorf("boom")
+		},
+		"check": func(id int) (bool, error) {
+			if id == 2 {
+				return false, fmt.Errorf("bad id")
+			}
+			return true, nil
+		},
+		"length": func(v any) string {
+			return "custom"
+		},
+		"shout": func(s string) string {
+			return strings.ToUpper(s)
+		},
+		"notFunc": 5,
+	}}
+
+	for _, example := range []struct {
+		Query string
+		Go    any
+		Error string
+	}{
+		{Query: `items[isExpired(created)].id`, Go: []any{1}},
+		{Query: `items[id > 0 and not isExpired(created)] | ids`, Go: "2"},
+		{Query: `items | ids`, Go: "1,2"},
+		{Query: `n | scale(2)`, Go: 3.0},
+		{Query: `{doubled: n | scale(2)}`, Go: map[string]any{"doubled": 3.0}},
+		{Query: `items.id | join("; ")`, Go: "1; 2"},
+		{Query: `items.id | join(-, "!", "?")`, Go: "1-2!?"},
+		{Query: `items | length`, Go: "custom"},
+		{Query: `items[check(id)].id`, Go: []any{1}},
+		{Query: `obj | length`, Go: 3},
+		{Query: `obj | keys`, Go: "k"},
+		{Query: `obj | keys()`, Go: []any{"keys", "length"}},
+		{Query: `items[max(tags) == b].id`, Go: []any{1}},
+		{Query: `words[shout(@) == "BB"]`, Go: []any{"bb"}},
+		{Query: `words[shout(@) =~ "^B"]`, Go: []any{"bb"}},
+		{Query: `words[upper(@) == "BB"]`, Go: []any{}},
+		{Query: `words[shout(@, 1)]`, Error: "shout takes 1 argument(s), but got 2"},
+		{Query: `items | sum`, Error: "sum requires numbers"},
+		{Query: `n | scale(1.5)`, Error: "scale argument 2 expects int, but found 1.5"},
+		{Query: `n | scale`, Error: "scale takes 2 argument(s) including the piped value, but got 1"},
+		{Query: `n | fail`, Error: "fail: boom"},
+		{Query: `n | notFunc`, Error: "notFunc is not a function"},
+	} {
+		t.Run(example.Query, func(t *testing.T) {
+			result, _, err := GetPath(example.Query, input, options)
+			if example.Error != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), example.Error)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, example.Go, result)
+		})
+	}
+
+	// Built-in functions can be called from filters too.
+	result, _, err := GetPath(`items[length(tags) > 1].id`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []any{1}, result)
+
+	// Unknown functions fail the filter in strict mode.
+	_, _, err = GetPath(`words[upper(@) == "Z"]`, input, GetOptions{Strict: true})
+	require.Error(t, err)
+	assert.Equal(t, "unknown function upper", err.Error())
+	assert.Equal(t, uint(6), err.Offset())
+}
+
+func TestGetMapFilterKeepKeys(t *testing.T) {
+	services := map[string]any{
+		"web": map[string]any{"status": "down", "port": 80},
+		"db":  map[string]any{"status": "up", "port": 5432},
+		"api": map[string]any{"status": "down", "port": 8080},
+	}
+	options := GetOptions{KeepFilteredKeys: true}
+
+	result, _, err := GetPath(`[status == down].port`, services, options)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"web": 80, "api": 8080}, result)
+
+	result, _, err = GetPath(`[status == missing]`, services, options)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{}, result)
+
+	byID := map[any]any{
+		1: map[string]any{"status": "down"},
+		2: map[string]any{"status": "up"},
+	}
+	result, _, err = GetPath(`[status == down]`, byID, options)
+	require.NoError(t, err)
+	assert.Equal(t, map[any]any{1: map[string]any{"status": "down"}}, result)
+
+	result, _, err = GetPath(`[status == down]`, byID, GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []any{map[string]any{"status": "down"}}, result)
+}
+
+func TestGetStrict(t *testing.T) {
+	input := map[string]any{
+		"items": []any{
+			map[string]any{"id": 1, "name": "a", "size": 2, "meta": map[string]any{"x": 1}},
+			map[string]any{"id": 2, "name": "b", "size": "big"},
+		},
+		"nums": []any{1, 2},
+	}
+	options := GetOptions{Strict: true}
+
+	for _, query := range []string{
+		`items[name == a].id`,
+		`items[name startsWith "b"].id`,
+		`nums[@ > 1]`,
+		`items[id == 1 and name == a].id`,
+		`items[name =~ "^a"].id`,
+		`items[0] | if name == a then 1 else 2`,
+	} {
+		expected, _, err := GetPath(query, input, GetOptions{})
+		require.NoError(t, err, query)
+		result, _, err := GetPath(query, input, options)
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, result, query)
+	}
+
+	for _, example := range []struct {
+		query   string
+		message string
+		offset  uint
+		length  uint
+	}{
+		{`items[nmae == a]`, "no property nmae in map with keys [id, meta, name, size]", 6, 4},
+		{`nums[size > 1]`, "no property size in 1", 5, 4},
+		{`items[size > 1]`, "unable to convert to number: big", 6, 4},
+		{`items[meta.x == 1]`, "no property meta in map with keys [id, name, size]", 6, 4},
+		{`items[not active]`, "no property active in map with keys [id, meta, name, size]", 10, 6},
+		{`items[0] | if meta.y == 1 then 1`, "cannot get y from map[x:1]", 19, 1},
+		{`items[0] | if nmae == a then 1`, "no property nmae in map with keys [id, meta, name, size]", 14, 4},
+	} {
+		t.Run(example.query, func(t *testing.T) {
+			// Without strict mode the failing items are skipped.
+			_, _, err := GetPath(example.query, input, GetOptions{})
+			require.NoError(t, err)
+
+			_, _, err = GetPath(example.query, input, options)
+			require.Error(t, err)
+			assert.Equal(t, example.message, err.Error())
+			assert.Equal(t, example.offset, err.Offset())
+			assert.Equal(t, example.length, err.Length())
+
+			query, qerr := CompileQuery(example.query)
+			require.NoError(t, qerr)
+			if !strings.Contains(example.query, "if") {
+				_, err = query.FindPaths(input, options)
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	// Errors from functions are reported instead of skipping the item.
+	_, _, err := GetPath(`items[check(id)]`, input, GetOptions{
+		Strict: true,
+		Functions: map[string]any{
+			"check": func(id float64) (bool, error) {
+				return false, fmt.Errorf("bad id %v", id)
+			},
+		},
+	})
+	require.Error(t, err)
+	assert.Equal(t, "check: bad id 1", err.Error())
+	assert.Equal(t, uint(6), err.Offset())
+
+	// Collecting errors checks every item and returns all of the failures.
+	collect := GetOptions{Strict: true, CollectErrors: true}
+	input["more"] = []any{
+		map[string]any{"id": 1, "size": "big"},
+		map[string]any{"id": 2, "size": 3},
+		map[string]any{"id": 3},
+	}
+	query, qerr := CompileQuery(`more[size > 1].id`)
+	require.NoError(t, qerr)
+	_, _, err = query.Exec(input, collect)
+	require.Error(t, err)
+	var errs Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Equal(t, "unable to convert to number: big", errs[0].Error())
+	assert.Equal(t, "no property size in map with keys [id]", errs[1].Error())
+	assert.Equal(t, uint(5), err.Offset())
+	assert.Equal(t, "unable to convert to number: big\nno property size in map with keys [id]", err.Error())
+
+	var ids []any
+	err = query.Each(input, collect, func(value any) bool {
+		ids = append(ids, value)
+		return true
+	})
+	require.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, []any{2}, ids)
+
+	_, err = query.FindPaths(input, collect)
+	require.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 2)
+
+	result, _, err := GetPath(`more[id > 1].id`, input, collect)
+	require.NoError(t, err)
+	assert.Equal(t, []any{2, 3}, result)
+}
+
+func TestGetVariables(t *testing.T) {
+	input := map[string]any{
+		"items": []any{
+			map[string]any{"name": "a1", "owner": "alice", "size": 1},
+			map[string]any{"name": "b2", "owner": "bob", "size": 5},
+			map[string]any{"name": "a3", "owner": "bob", "size": 10},
+		},
+		"meta": map[string]any{"owner": "bob"},
+	}
+
+	query, err := CompileQuery(`items[owner == $user and size >= $min].name`)
+	require.NoError(t, err)
+
+	// The same compiled query works with different values.
+	for _, example := range []struct {
+		user string
+		min  any
+		want []any
+	}{
+		{"bob", 0, []any{"b2", "a3"}},
+		{"bob", 6.0, []any{"a3"}},
+		{"alice", 0, []any{"a1"}},
+		{"x] | [0", 0, []any{}},
+	} {
+		result, _, err := query.Exec(input, GetOptions{Variables: map[string]any{"user": example.user, "min": example.min}})
+		require.NoError(t, err)
+		assert.Equal(t, example.want, result, example.user)
+	}
+
+	variables := map[string]any{
+		"idx":   -1,
+		"key":   "owner",
+		"owner": map[string]any{"id": "alice"},
+	}
+	for _, example := range []struct {
+		query string
+		want  any
+	}{
+		{`items[$idx].name`, "a3"},
+		{`meta[$key]`, "bob"},
+		{`items[owner == $owner.id].name`, []any{"a1"}},
+		{`items[name =~ "^a" and owner != $owner.id].name`, []any{"a3"}},
+		{`{names: items[owner == $owner.id].name}`, map[string]any{"names": []any{"a1"}}},
+		{`$owner.id`, "alice"},
+		{`$key`, "owner"},
+		{`items[0].size |= $idx | items[0]`, map[string]any{"name": "a1", "owner": "alice", "size": -1}},
+		{`missing ?? $key`, "owner"},
+		{`if meta.owner == bob then $owner.id`, "alice"},
+		{`{id: $owner.id}`, map[string]any{"id": "alice"}},
+		{`[$idx, $key]`, []any{-1, "owner"}},
+	} {
+		result, _, err := GetPath(example.query, input, GetOptions{Variables: variables})
+		require.NoError(t, err, example.query)
+		assert.Equal(t, example.want, result, example.query)
+	}
+
+	// Without a variable of that name, `$ref` is still a property.
+	refs := map[string]any{"$ref": map[string]any{"id": "#/a"}}
+	result, found, err := GetPath(`$ref.id`, refs, GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "#/a", result)
+	paths, err := FindPaths(`$ref.id`, refs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$ref.id"}, paths)
+
+	_, _, err = GetPath(`items[owner == $missing]`, input, GetOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined variable $missing")
+	assert.Equal(t, uint(15), err.Offset())
+
+	_, _, err = GetPath(`items[$idx]`, input, GetOptions{Variables: map[string]any{"idx": 1.5}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "variable $idx must be an integer index or string key")
+	assert.Equal(t, uint(6), err.Offset())
+
+	query, err = CompileQuery(`items[$idx].owner`)
+	require.NoError(t, err)
+	assert.Equal(t, QueryOp{Kind: QueryOpIndex, Variable: "idx"}, query.Segments()[0].Ops[1])
+	paths, err = query.FindPaths(input, GetOptions{Variables: map[string]any{"idx": 1}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"items[1].owner"}, paths)
+
+	query, err = CompileQuery(`$owner.id`)
+	require.NoError(t, err)
+	assert.Equal(t, QueryOp{Kind: QueryOpVariable, Variable: "owner"}, query.Segments()[0].Ops[0])
+}
+
+func TestGetRootAndParent(t *testing.T) {
+	input := map[string]any{
+		"team":        "core",
+		"limit":       4,
+		"currentUser": map[string]any{"id": 2},
+		"orders": []any{
+			map[string]any{"customer": 1, "id": "a"},
+			map[string]any{"customer": 2, "id": "b"},
+		},
+		"items": []any{
+			map[string]any{"name": "x", "meta": map[string]any{"size": 1}},
+			map[string]any{"name": "y", "meta": map[string]any{"size": 5}},
+		},
+		"nums": []any{1, 2, 3},
+		"$ref": "r",
+	}
+
+	for _, example := range []struct {
+		query string
+		want  any
+	}{
+		{`orders[customer == $.currentUser.id].id`, []any{"b"}},
+		{`items.{name, team: ^.team}`, []any{
+			map[string]any{"name": "x", "team": "core"},
+			map[string]any{"name": "y", "team": "core"},
+		}},
+		{`items.meta.{size, name: ^.name, team: ^^.team}`, []any{
+			map[string]any{"size": 1, "name": "x", "team": "core"},
+			map[string]any{"size": 5, "name": "y", "team": "core"},
+		}},
+		{`items[meta.size > ^.limit].name`, []any{"y"}},
+		{`nums[@ ^ 2 > ^.limit]`, []any{3}},
+		{`orders.{id, all: $.orders.id}`, []any{
+			map[string]any{"id": "a", "all": []any{"a", "b"}},
+			map[string]any{"id": "b", "all": []any{"a", "b"}},
+		}},
+		{`[team, $.limit]`, []any{"core", 4}},
+		{`$ref`, "r"},
+		{`^`, nil},
+	} {
+		result, _, err := GetPath(example.query, input, GetOptions{})
+		require.NoError(t, err, example.query)
+		assert.Equal(t, example.want, result, example.query)
+	}
+
+	query, err := CompileQuery(`items.{p: ^^.team} | $.team`)
+	require.NoError(t, err)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpParent, Parents: 2}}, query.Segments()[0].Ops[2].Queries[0].Segments()[0].Ops[:1])
+	assert.Equal(t, QueryOp{Kind: QueryOpRoot}, query.Segments()[1].Ops[0])
+}
+
+func TestGetFallbackFound(t *testing.T) {
+	input := map[string]any{"status": "failed", "nick": nil}
+
+	_, found, err := GetPath(`name ?? nick`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, found, "a null value is found")
+
+	_, found, err = GetPath(`name ?? title`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.False(t, found, "every operand is missing")
+
+	_, found, err = GetPath(`if status == ok then status`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.False(t, found, "no else branch")
+
+	query, qerr := CompileQuery(`nick ?? name || "unknown" | length`)
+	require.NoError(t, qerr)
+	op := query.Segments()[0].Ops[0]
+	assert.Equal(t, QueryOpFallback, op.Kind)
+	assert.Equal(t, []string{"??", "||"}, op.Operators)
+	assert.Equal(t, "nick", op.Queries[0].String())
+	assert.Nil(t, op.Queries[2])
+	assert.Equal(t, []any{nil, nil, "unknown"}, op.Args)
+
+	query, qerr = CompileQuery(`if size > 5 then "large" else size`)
+	require.NoError(t, qerr)
+	op = query.Segments()[0].Ops[0]
+	assert.Equal(t, QueryOpConditional, op.Kind)
+	assert.Equal(t, "size > 5", op.Filter)
+	assert.Equal(t, []any{"large", nil}, op.Args)
+	assert.Equal(t, "size", op.Queries[1].String())
+}
+
+func TestGetUpdate(t *testing.T) {
+	input := map[string]any{
+		"users": []any{
+			map[string]any{"name": "a", "token": "t1"},
+			map[string]any{"name": "b"},
+		},
+	}
+
+	result, found, err := GetPath(`users.token |= "***"`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, map[string]any{
+		"users": []any{
+			map[string]any{"name": "a", "token": "***"},
+			map[string]any{"name": "b"},
+		},
+	}, result)
+
+	// The input is not modified.
+	assert.Equal(t, "t1", input["users"].([]any)[0].(map[string]any)["token"])
+
+	query, qerr := CompileQuery(`..token |= "***" | users`)
+	require.NoError(t, qerr)
+	op := query.Segments()[0].Ops[0]
+	assert.Equal(t, QueryOpUpdate, op.Kind)
+	assert.Equal(t, "..token", op.Queries[0].String())
+	assert.Nil(t, op.Queries[1])
+	assert.Equal(t, []any{nil, "***"}, op.Args)
+}
+
+func TestQueryEach(t *testing.T) {
+	input := map[string]any{
+		"items": []any{
+			map[string]any{"id": 1, "status": "ok", "tags": []any{"a", "b"}},
+			map[string]any{"id": 2, "status": "failed"},
+			map[string]any{"id": 3, "status": "failed", "tags": []any{"c"}},
+		},
+		"services": map[string]any{
+			"web": map[string]any{"up": false},
+			"db":  map[string]any{"up": true},
+		},
+		"mixed": []any{1, []any{2, 3}, []any{}, "a"},
+	}
+
+	for _, example := range []struct {
+		query string
+		want  []any
+	}{
+		{`mixed | []`, []any{1, 2, 3, "a"}},
+		{`mixed[]`, []any{1, 2, 3, "a"}},
+		{`services..up`, []any{true, false}},
+		{`items.id`, []any{1, 2, 3}},
+		{`items[status == failed].id`, []any{2, 3}},
+		{`items.tags`, []any{[]any{"a", "b"}, []any{"c"}}},
+		{`items.tags | []`, []any{"a", "b", "c"}},
+		{`..id`, []any{1, 2, 3}},
+		{`services[not up]`, []any{map[string]any{"up": false}}},
+		{`items | length()`, []any{3}},
+		{`items[0].tags`, []any{[]any{"a", "b"}}},
+		{`missing`, []any{}},
+		{`items[status == unknown]`, []any{}},
+	} {
+		results := []any{}
+		query, err := CompileQuery(example.query)
+		require.NoError(t, err)
+		require.NoError(t, query.Each(input, GetOptions{}, func(value any) bool {
+			results = append(results, value)
+			return true
+		}))
+		assert.Equal(t, example.want, results, example.query)
+	}
+}
+
+func TestQueryEachStopsEarly(t *testing.T) {
+	items := make([]any, 1000)
+	for i := range items {
+		items[i] = map[string]any{"id": i}
+	}
+
+	checked := 0
+	options := GetOptions{Functions: map[string]any{
+		"check": func(id float64) bool {
+			checked++
+			return id >= 10
+		},
+	}}
+
+	query, err := CompileQuery(`[check(id)].id`)
+	require.NoError(t, err)
+	var first any
+	require.NoError(t, query.Each(items, options, func(value any) bool {
+		first = value
+		return false
+	}))
+	assert.Equal(t, 10, first)
+	assert.Equal(t, 11, checked)
+
+	// Flattens and recursive searches stop without visiting the rest of the
+	// input, so they stay within a step limit which covers only a few items.
+	for _, q := range []string{`..id`, `[].id`, `[]`} {
+		query, err = CompileQuery(q)
+		require.NoError(t, err)
+		first = nil
+		require.NoError(t, query.Each(items, GetOptions{MaxSteps: 20}, func(value any) bool {
+			first = value
+			return false
+		}), q)
+		assert.NotNil(t, first, q)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	input := map[string]any{"a": map[string]any{"b": 1}}
+
+	cache := NewQueryCache(1)
+	result, _, err := GetPath("a.b", input, GetOptions{Cache: cache})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result)
+
+	first, ok := cache.queries.Load("a.b")
+	require.True(t, ok)
+	_, ok = defaultQueryCache.queries.Load("a.b")
+	assert.False(t, ok, "caller cache should not use the global cache")
+
+	compiled, err := cache.Compile("a.b")
+	require.NoError(t, err)
+	assert.Same(t, first, compiled)
+
+	// Older entries are evicted.
+	_, err = cache.Compile("a")
+	require.NoError(t, err)
+	_, ok = cache.queries.Load("a.b")
+	assert.False(t, ok)
+
+	// Caching can be disabled.
+	disabled := NewQueryCache(0)
+	a, err := disabled.Compile("a.b")
+	require.NoError(t, err)
+	b, err := disabled.Compile("a.b")
+	require.NoError(t, err)
+	assert.NotSame(t, a, b)
+
+	result, _, err = GetPath("a.{b}", input, GetOptions{Cache: disabled})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"b": 1}, result)
+}
+
 func TestCompiledFieldParseErrorKeepsOnlyQuerySource(t *testing.T) {
-	query, err := compilePath(`{id`)
+	query, err := compilePath(`{id`, nil)
 	require.NoError(t, err)
 	require.Len(t, query.segments, 1)
 	require.Len(t, query.segments[0].ops, 1)
@@ -953,6 +2182,25 @@ func BenchmarkGetPathFlatten(b *testing.B) {
 	}
 }
 
+func BenchmarkQueryEachFirst(b *testing.B) {
+	b.ReportAllocs()
+
+	items := make([]any, 1000)
+	for i := range items {
+		items[i] = map[string]any{"id": i, "status": "ok"}
+	}
+	items[10] = map[string]any{"id": 10, "status": "failed"}
+
+	query, err := CompileQuery("[status == failed].id")
+	require.NoError(b, err)
+
+	for n := 0; n < b.N; n++ {
+		query.Each(items, GetOptions{}, func(value any) bool {
+			return false
+		})
+	}
+}
+
 func FuzzGet(f *testing.F) {
 	data := map[string]any{
 		"n":  nil,
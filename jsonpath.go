@@ -0,0 +1,1268 @@
+package shorthand
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonpathCachePrefix separates compiled JSONPath queries from shorthand
+// queries in a `QueryCache`, since e.g. `$.a` is valid in both but means
+// something different.
+const jsonpathCachePrefix = "\x00jsonpath:"
+
+// maxJSONPathInt is the largest index, slice bound, or step allowed by
+// RFC 9535, which is the largest integer exactly representable in JSON.
+const maxJSONPathInt = 1<<53 - 1
+
+// compiledSelectOp runs one segment of a JSONPath query like `['a','b']` or
+// `..[?@.id]`, applying its selectors to each node of the current node list
+// to get a new list. The root op starts the list with the input itself.
+type compiledSelectOp struct {
+	root       bool
+	descendant bool
+	selectors  []jsonpathSelector
+}
+
+type jsonpathSelectorKind int
+
+const (
+	selectName jsonpathSelectorKind = iota
+	selectWildcard
+	selectIndex
+	selectSlice
+	selectFilter
+)
+
+// jsonpathSelector selects children of a node by name, index, slice, or
+// filter, or all of them with a wildcard. The start and end of a slice are
+// nil if they are omitted.
+type jsonpathSelector struct {
+	kind   jsonpathSelectorKind
+	source string
+	name   string
+	index  int
+	start  *int
+	end    *int
+	step   int
+	filter jsonpathExpr
+}
+
+// jsonpathExpr is a logical expression of a filter selector, e.g. `@.price <
+// 10 && @.isbn`. Filters follow the RFC rather than shorthand's own filters,
+// e.g. a missing value is never equal to null, so they have their own types.
+type jsonpathExpr interface{}
+
+type jsonpathOr []jsonpathExpr
+
+type jsonpathAnd []jsonpathExpr
+
+type jsonpathNot struct {
+	expr jsonpathExpr
+}
+
+// jsonpathComparison compares two single values, e.g. `@.price < 10`.
+type jsonpathComparison struct {
+	op    string
+	left  jsonpathOperand
+	right jsonpathOperand
+}
+
+// jsonpathTest matches if a query selects any nodes, e.g. `@.isbn`, or if a
+// function like `match(@.name, 'a.*')` is true.
+type jsonpathTest struct {
+	operand jsonpathOperand
+}
+
+// jsonpathOperand is a literal, a query relative to the current node (`@`)
+// or the root (`$`), or a function call. The query is nil for literals and
+// calls.
+type jsonpathOperand struct {
+	offset   uint
+	length   uint
+	literal  any
+	query    *Query
+	absolute bool
+	singular bool
+	call     *jsonpathCall
+}
+
+// jsonpathCall is a call to one of the functions defined by the RFC. The
+// regex of `match` or `search` is compiled ahead of time if its pattern is a
+// literal, in which case `invalid` is set if it fails to compile.
+type jsonpathCall struct {
+	name    string
+	args    []jsonpathOperand
+	regex   *regexp.Regexp
+	invalid bool
+}
+
+// jsonpathType is the type of a function parameter or result.
+type jsonpathType int
+
+const (
+	jsonpathValueType jsonpathType = iota
+	jsonpathLogicalType
+	jsonpathNodesType
+)
+
+var jsonpathFunctions = map[string]struct {
+	params []jsonpathType
+	result jsonpathType
+}{
+	"length": {[]jsonpathType{jsonpathValueType}, jsonpathValueType},
+	"count":  {[]jsonpathType{jsonpathNodesType}, jsonpathValueType},
+	"match":  {[]jsonpathType{jsonpathValueType, jsonpathValueType}, jsonpathLogicalType},
+	"search": {[]jsonpathType{jsonpathValueType, jsonpathValueType}, jsonpathLogicalType},
+	"value":  {[]jsonpathType{jsonpathNodesType}, jsonpathValueType},
+}
+
+// valueType returns whether an operand is a single value, which can be
+// compared or passed to a function taking a value.
+func (o jsonpathOperand) valueType() bool {
+	if o.query != nil {
+		return o.singular
+	}
+	if o.call != nil {
+		return jsonpathFunctions[o.call.name].result == jsonpathValueType
+	}
+	return true
+}
+
+// GetJSONPath runs an RFC 9535 JSONPath query like
+// `$.store.book[?@.price < 10].title` and returns the list of selected values,
+// which is empty if nothing matches. Compiled queries are cached just like
+// `GetPath`.
+func GetJSONPath(path string, input any, options GetOptions) ([]any, Error) {
+	cache := options.Cache
+	if cache == nil {
+		cache = defaultQueryCache
+	}
+	query, err := cache.CompileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	result, _, err := query.Exec(input, options)
+	if err != nil {
+		return nil, err
+	}
+	return result.([]any), nil
+}
+
+// CompileJSONPath compiles an RFC 9535 JSONPath query into a `Query`, which
+// runs on the same engine as shorthand queries. Its result is always an array
+// of the selected values. `Query.FindPaths` returns shorthand paths like
+// `store.book[0].title`, which can be used to patch the input. Nothing is
+// cached; see `QueryCache.CompileJSONPath`.
+func CompileJSONPath(path string) (*Query, Error) {
+	return (*QueryCache)(nil).CompileJSONPath(path)
+}
+
+// CompileJSONPath is like `CompileJSONPath` but returns a cached query if
+// available and caches the result otherwise. A nil cache compiles without
+// caching.
+func (c *QueryCache) CompileJSONPath(path string) (*Query, Error) {
+	if c == nil || c.queries == nil {
+		return compileJSONPath(path)
+	}
+
+	key := jsonpathCachePrefix + path
+	if cached, ok := c.queries.Load(key); ok {
+		return cached.(*Query), nil
+	}
+
+	query, err := compileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := c.queries.LoadOrStore(key, query)
+	return actual.(*Query), nil
+}
+
+// compileJSONPath parses a JSONPath query. Each segment, e.g. `.store` or
+// `[0]`, becomes a segment of the query with a single select op.
+func compileJSONPath(path string) (*Query, Error) {
+	p := &jsonpathParser{expression: path}
+	if p.peek() != '$' {
+		return nil, p.error(0, 1, "JSONPath queries must start with '$'")
+	}
+	query, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < uint(len(path)) {
+		if strings.TrimSpace(path[p.pos:]) == "" {
+			return nil, p.error(p.pos, uint(len(path))-p.pos, "unexpected whitespace at the end of the query")
+		}
+		p.skipBlank()
+		if path[p.pos] == '|' {
+			return nil, p.error(p.pos, 1, "pipes are not supported in JSONPath queries")
+		}
+		return nil, p.error(p.pos, 1, "expected '.', '..', or '[' but found %q", path[p.pos])
+	}
+	query.scoped = p.usesRoot
+	return query, nil
+}
+
+// jsonpathParser parses JSONPath queries, including the queries nested in
+// filters.
+type jsonpathParser struct {
+	expression string
+	pos        uint
+
+	// usesRoot is set if a filter references the root with `$`.
+	usesRoot bool
+}
+
+func (p *jsonpathParser) error(offset, length uint, format string, a ...any) Error {
+	return NewError(&p.expression, offset, length, format, a...)
+}
+
+// peek returns the next byte or -1 at the end of the query.
+func (p *jsonpathParser) peek() int {
+	if p.pos >= uint(len(p.expression)) {
+		return -1
+	}
+	return int(p.expression[p.pos])
+}
+
+func (p *jsonpathParser) consume(s string) bool {
+	if strings.HasPrefix(p.expression[p.pos:], s) {
+		p.pos += uint(len(s))
+		return true
+	}
+	return false
+}
+
+func (p *jsonpathParser) skipBlank() {
+	for p.pos < uint(len(p.expression)) && isSpace(p.expression[p.pos]) {
+		p.pos++
+	}
+}
+
+// parseQuery parses `$` or `@` followed by any number of segments. Blank
+// space may come before each segment.
+func (p *jsonpathParser) parseQuery() (*Query, Error) {
+	query := &Query{expression: p.expression}
+	query.segments = append(query.segments, compiledSegment{
+		expression: p.expression[p.pos : p.pos+1],
+		offset:     p.pos,
+		ops:        []compiledOp{compiledSelectOp{root: true}},
+	})
+	p.pos++
+
+	for {
+		saved := p.pos
+		p.skipBlank()
+		if c := p.peek(); c != '.' && c != '[' {
+			p.pos = saved
+			return query, nil
+		}
+		start := p.pos
+		op, err := p.parseSegment()
+		if err != nil {
+			return nil, err
+		}
+		query.segments = append(query.segments, compiledSegment{
+			expression: p.expression[start:p.pos],
+			offset:     start,
+			ops:        op.compile(),
+		})
+	}
+}
+
+// parseSegment parses a child segment like `.name`, `.*`, or `[0, 'a']`, or a
+// descendant segment like `..name` or `..[0]`.
+func (p *jsonpathParser) parseSegment() (compiledSelectOp, Error) {
+	op := compiledSelectOp{}
+	var err Error
+	if p.consume("..") {
+		op.descendant = true
+		switch c := p.peek(); {
+		case c == '[':
+			p.pos++
+			op.selectors, err = p.parseBracketed()
+		case c == '*':
+			p.pos++
+			op.selectors = []jsonpathSelector{{kind: selectWildcard, source: "*"}}
+		case p.isNameFirst():
+			name := p.parseName()
+			op.selectors = []jsonpathSelector{{kind: selectName, source: name, name: name}}
+		default:
+			err = p.error(p.pos-2, 2, "expected a name, '*', or '[' after '..'")
+		}
+		return op, err
+	}
+
+	if p.consume("[") {
+		op.selectors, err = p.parseBracketed()
+		return op, err
+	}
+
+	p.pos++
+	switch {
+	case p.peek() == '*':
+		p.pos++
+		op.selectors = []jsonpathSelector{{kind: selectWildcard, source: "*"}}
+	case p.isNameFirst():
+		name := p.parseName()
+		op.selectors = []jsonpathSelector{{kind: selectName, source: name, name: name}}
+	default:
+		err = p.error(p.pos-1, 1, "expected a name or '*' after '.'")
+	}
+	return op, err
+}
+
+// compile returns the ops which run a segment. A single name or index
+// selects at most one child of each node, so it becomes a fan-out over the
+// node list getting a property or item like in a shorthand query, and a
+// descendant name becomes a recursive search. Other selectors select any
+// number of children of each node, which the fan-out can't join into one
+// list, and filters follow the RFC rather than shorthand, so they stay a
+// select op.
+func (op compiledSelectOp) compile() []compiledOp {
+	if len(op.selectors) != 1 {
+		return []compiledOp{op}
+	}
+	selector := op.selectors[0]
+	switch {
+	case selector.kind == selectName && op.descendant:
+		return []compiledOp{compiledRecursivePropOp{key: selector.name, nodes: true}}
+	case selector.kind == selectName && selector.name != "*":
+		// A `*` property is a wildcard, so that name needs a select op.
+		return []compiledOp{compiledDotOp{}, compiledPropOp{key: selector.name}}
+	case selector.kind == selectIndex && !op.descendant:
+		return []compiledOp{compiledDotOp{}, compiledIndexOp{startIndex: selector.index, stopIndex: selector.index, nodes: true}}
+	}
+	return []compiledOp{op}
+}
+
+// isNameFirst returns whether the next character can start a member name
+// like `.name`, i.e. a letter, `_`, or any non-ASCII character.
+func (p *jsonpathParser) isNameFirst() bool {
+	c := p.peek()
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= utf8.RuneSelf
+}
+
+// parseName parses a member name, which may also contain digits after the
+// first character.
+func (p *jsonpathParser) parseName() string {
+	start := p.pos
+	for p.isNameFirst() || (p.peek() >= '0' && p.peek() <= '9') {
+		if p.peek() >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(p.expression[p.pos:])
+			if r == utf8.RuneError {
+				break
+			}
+			p.pos += uint(size)
+			continue
+		}
+		p.pos++
+	}
+	return p.expression[start:p.pos]
+}
+
+// parseBracketed parses comma-separated selectors up to the closing `]`.
+func (p *jsonpathParser) parseBracketed() ([]jsonpathSelector, Error) {
+	var selectors []jsonpathSelector
+	for {
+		p.skipBlank()
+		start := p.pos
+		selector, err := p.parseSelector()
+		if err != nil {
+			return nil, err
+		}
+		selector.source = p.expression[start:p.pos]
+		selectors = append(selectors, selector)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return selectors, nil
+		default:
+			return nil, p.error(p.pos, 1, "expected ',' or ']' after selector")
+		}
+	}
+}
+
+// parseSelector parses a name like `'a'`, a wildcard, an index, a slice like
+// `1:5:2`, or a filter like `?@.id > 1`.
+func (p *jsonpathParser) parseSelector() (jsonpathSelector, Error) {
+	switch c := p.peek(); c {
+	case '\'', '"':
+		name, err := p.parseString()
+		return jsonpathSelector{kind: selectName, name: name}, err
+	case '*':
+		p.pos++
+		return jsonpathSelector{kind: selectWildcard}, nil
+	case '?':
+		p.pos++
+		p.skipBlank()
+		expr, err := p.parseOr()
+		return jsonpathSelector{kind: selectFilter, filter: expr}, err
+	case '(':
+		return jsonpathSelector{}, p.error(p.pos, 1, "script expressions are not supported, use a filter like [?@.id == 1]")
+	}
+
+	start := p.pos
+	var first *int
+	if c := p.peek(); c == '-' || (c >= '0' && c <= '9') {
+		n, err := p.parseInt()
+		if err != nil {
+			return jsonpathSelector{}, err
+		}
+		first = &n
+	}
+	p.skipBlank()
+	if p.peek() != ':' {
+		if first == nil {
+			if p.peek() == ']' {
+				return jsonpathSelector{}, p.error(start, 1, "expected a selector, use [*] to select all items")
+			}
+			return jsonpathSelector{}, p.error(start, 1, "expected a selector but found %q", p.expression[start])
+		}
+		return jsonpathSelector{kind: selectIndex, index: *first}, nil
+	}
+
+	selector := jsonpathSelector{kind: selectSlice, start: first, step: 1}
+	p.pos++
+	p.skipBlank()
+	if c := p.peek(); c == '-' || (c >= '0' && c <= '9') {
+		n, err := p.parseInt()
+		if err != nil {
+			return jsonpathSelector{}, err
+		}
+		selector.end = &n
+		p.skipBlank()
+	}
+	if p.peek() == ':' {
+		p.pos++
+		p.skipBlank()
+		if c := p.peek(); c == '-' || (c >= '0' && c <= '9') {
+			n, err := p.parseInt()
+			if err != nil {
+				return jsonpathSelector{}, err
+			}
+			selector.step = n
+		}
+	}
+	return selector, nil
+}
+
+// parseInt parses an index, slice bound, or step, which can't have leading
+// zeros or be `-0`.
+func (p *jsonpathParser) parseInt() (int, Error) {
+	start := p.pos
+	p.consume("-")
+	digits := p.pos
+	for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+		p.pos++
+	}
+	text := p.expression[start:p.pos]
+	switch {
+	case p.pos == digits:
+		return 0, p.error(start, 1, "expected an integer")
+	case p.expression[digits] == '0' && p.pos-digits > 1:
+		return 0, p.error(start, p.pos-start, "integer %s must not have leading zeros", text)
+	case text == "-0":
+		return 0, p.error(start, p.pos-start, "integer -0 is not allowed")
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || n > maxJSONPathInt || n < -maxJSONPathInt {
+		return 0, p.error(start, p.pos-start, "integer %s is out of range", text)
+	}
+	return int(n), nil
+}
+
+// parseString parses a single or double quoted string with JSON escapes,
+// where only the surrounding quote may be escaped.
+func (p *jsonpathParser) parseString() (string, Error) {
+	start := p.pos
+	quote := p.expression[p.pos]
+	p.pos++
+	var sb strings.Builder
+	for {
+		c := p.peek()
+		switch {
+		case c == -1:
+			return "", p.error(start, p.pos-start, "expected %c to end the string", quote)
+		case c == int(quote):
+			p.pos++
+			return sb.String(), nil
+		case c < 0x20:
+			return "", p.error(p.pos, 1, "control characters in strings must be escaped")
+		case c == '\\':
+			r, err := p.parseEscape(quote)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteRune(r)
+		default:
+			r, size := utf8.DecodeRuneInString(p.expression[p.pos:])
+			sb.WriteRune(r)
+			p.pos += uint(size)
+		}
+	}
+}
+
+// parseEscape parses an escape like `\n` or `\u00e9`, including a surrogate
+// pair like `\ud83d\ude00`.
+func (p *jsonpathParser) parseEscape(quote byte) (rune, Error) {
+	start := p.pos
+	p.pos++
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '/', '\\':
+		return rune(c), nil
+	case int(quote):
+		return rune(quote), nil
+	case 'u':
+		r, ok := p.parseHex()
+		if !ok {
+			break
+		}
+		if r >= 0xdc00 && r <= 0xdfff {
+			return 0, p.error(start, p.pos-start, "invalid unicode escape, unpaired surrogate")
+		}
+		if r >= 0xd800 && r <= 0xdbff {
+			if !p.consume(`\u`) {
+				return 0, p.error(start, p.pos-start, "invalid unicode escape, unpaired surrogate")
+			}
+			low, ok := p.parseHex()
+			if !ok || low < 0xdc00 || low > 0xdfff {
+				return 0, p.error(start, p.pos-start, "invalid unicode escape, unpaired surrogate")
+			}
+			r = 0x10000 + (r-0xd800)<<10 + (low - 0xdc00)
+		}
+		return r, nil
+	}
+	return 0, p.error(start, p.pos-start, "invalid escape in string")
+}
+
+// parseHex parses the four hex digits of a unicode escape.
+func (p *jsonpathParser) parseHex() (rune, bool) {
+	if p.pos+4 > uint(len(p.expression)) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(p.expression[p.pos:p.pos+4], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	p.pos += 4
+	return rune(n), true
+}
+
+// parseOr parses a filter expression with `||` having the lowest precedence.
+func (p *jsonpathParser) parseOr() (jsonpathExpr, Error) {
+	var or jsonpathOr
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+		saved := p.pos
+		p.skipBlank()
+		if !p.consume("||") {
+			p.pos = saved
+			break
+		}
+		p.skipBlank()
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *jsonpathParser) parseAnd() (jsonpathExpr, Error) {
+	var and jsonpathAnd
+	for {
+		expr, err := p.parseBasic()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, expr)
+		saved := p.pos
+		p.skipBlank()
+		if !p.consume("&&") {
+			p.pos = saved
+			break
+		}
+		p.skipBlank()
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+// parseBasic parses a comparison, a test, or a parenthesized expression, any
+// of which but comparisons may be negated with `!`.
+func (p *jsonpathParser) parseBasic() (jsonpathExpr, Error) {
+	if p.consume("!") {
+		p.skipBlank()
+		start := p.pos
+		expr, err := p.parseBasic()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := expr.(jsonpathComparison); ok && p.expression[start] != '(' {
+			return nil, p.error(start, p.pos-start, "comparisons must be in parentheses to be negated, e.g. !(@.a == 1)")
+		}
+		return jsonpathNot{expr: expr}, nil
+	}
+
+	if p.consume("(") {
+		p.skipBlank()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipBlank()
+		if !p.consume(")") {
+			return nil, p.error(p.pos, 1, "expected ')' to end the expression")
+		}
+		return expr, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkArithmetic(); err != nil {
+		return nil, err
+	}
+	saved := p.pos
+	p.skipBlank()
+	op := ""
+	for _, candidate := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.consume(candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		p.pos = saved
+		if left.query == nil && (left.call == nil || jsonpathFunctions[left.call.name].result == jsonpathValueType) {
+			return nil, p.error(left.offset, left.length, "expected a comparison after %s", p.expression[left.offset:left.offset+left.length])
+		}
+		return jsonpathTest{operand: left}, nil
+	}
+
+	p.skipBlank()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkArithmetic(); err != nil {
+		return nil, err
+	}
+	for _, operand := range []jsonpathOperand{left, right} {
+		if !operand.valueType() {
+			return nil, p.error(operand.offset, operand.length, "cannot compare %s, which is not a single value", p.expression[operand.offset:operand.offset+operand.length])
+		}
+	}
+	return jsonpathComparison{op: op, left: left, right: right}, nil
+}
+
+// checkArithmetic returns an error if an operand is followed by an
+// arithmetic operator, which JSONPath doesn't support.
+func (p *jsonpathParser) checkArithmetic() Error {
+	saved := p.pos
+	p.skipBlank()
+	offset, c := p.pos, p.peek()
+	p.pos = saved
+	if c == '+' || c == '-' || c == '*' || c == '/' || c == '%' {
+		return p.error(offset, 1, "arithmetic is not supported in JSONPath filters")
+	}
+	return nil
+}
+
+// parseOperand parses a literal, a query, or a function call.
+func (p *jsonpathParser) parseOperand() (jsonpathOperand, Error) {
+	start := p.pos
+	operand := jsonpathOperand{offset: start}
+	var err Error
+	switch c := p.peek(); {
+	case c == '@' || c == '$':
+		operand.absolute = c == '$'
+		p.usesRoot = p.usesRoot || operand.absolute
+		if operand.query, err = p.parseQuery(); err != nil {
+			return operand, err
+		}
+		operand.singular = isSingularQuery(operand.query)
+	case c == '\'' || c == '"':
+		operand.literal, err = p.parseString()
+	case c == '-' || (c >= '0' && c <= '9'):
+		operand.literal, err = p.parseNumber()
+	case c >= 'a' && c <= 'z':
+		for c := p.peek(); c == '_' || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9'); c = p.peek() {
+			p.pos++
+		}
+		name := p.expression[start:p.pos]
+		if p.peek() == '(' {
+			operand.call, err = p.parseCall(name, start)
+			break
+		}
+		switch name {
+		case "true":
+			operand.literal = true
+		case "false":
+			operand.literal = false
+		case "null":
+			operand.literal = nil
+		default:
+			err = p.error(start, p.pos-start, "unexpected %s, use @.%s to get a property of the current value", name, name)
+		}
+	case c == -1:
+		err = p.error(p.pos, 1, "expected a value, query, or function")
+	default:
+		err = p.error(p.pos, 1, "expected a value, query, or function but found %q", p.expression[p.pos])
+	}
+	operand.length = p.pos - start
+	return operand, err
+}
+
+// parseNumber parses a JSON number literal, which may also be `-0`.
+func (p *jsonpathParser) parseNumber() (any, Error) {
+	start := p.pos
+	digits := func() bool {
+		from := p.pos
+		for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+			p.pos++
+		}
+		return p.pos > from
+	}
+	p.consume("-")
+	intStart := p.pos
+	ok := digits()
+	if ok && p.expression[intStart] == '0' && p.pos-intStart > 1 {
+		ok = false
+	}
+	if ok && p.consume(".") {
+		ok = digits()
+	}
+	if ok && (p.consume("e") || p.consume("E")) {
+		if !p.consume("+") {
+			p.consume("-")
+		}
+		ok = digits()
+	}
+	text := p.expression[start:p.pos]
+	if !ok {
+		return nil, p.error(start, p.pos-start, "invalid number %s", text)
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, p.error(start, p.pos-start, "invalid number %s", text)
+	}
+	return n, nil
+}
+
+// parseCall parses the arguments of a function call and checks that they
+// have the types the function expects.
+func (p *jsonpathParser) parseCall(name string, start uint) (*jsonpathCall, Error) {
+	fn, ok := jsonpathFunctions[name]
+	if !ok {
+		return nil, p.error(start, p.pos-start, "unsupported function %s", name)
+	}
+	call := &jsonpathCall{name: name}
+	p.pos++
+	p.skipBlank()
+	if !p.consume(")") {
+		for {
+			arg, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			p.skipBlank()
+			if p.consume(")") {
+				break
+			}
+			if !p.consume(",") {
+				return nil, p.error(p.pos, 1, "expected ',' or ')' after function argument")
+			}
+			p.skipBlank()
+		}
+	}
+
+	if len(call.args) != len(fn.params) {
+		return nil, p.error(start, p.pos-start, "%s takes %d arguments, but found %d", name, len(fn.params), len(call.args))
+	}
+	for i, arg := range call.args {
+		if fn.params[i] == jsonpathNodesType && arg.query == nil {
+			return nil, p.error(arg.offset, arg.length, "%s expects a query like @.items", name)
+		}
+		if fn.params[i] == jsonpathValueType && !arg.valueType() {
+			return nil, p.error(arg.offset, arg.length, "%s expects a single value, but found %s", name, p.expression[arg.offset:arg.offset+arg.length])
+		}
+	}
+
+	if name == "match" || name == "search" {
+		if pattern, ok := call.args[1].literal.(string); ok && call.args[1].query == nil && call.args[1].call == nil {
+			re, err := compileIRegexp(pattern, name == "match")
+			call.regex, call.invalid = re, err != nil
+		}
+	}
+	return call, nil
+}
+
+// isSingularQuery returns whether a query can select at most one node, i.e.
+// it only uses single names and indexes, which are compiled to a fan-out
+// unless the name is `*`.
+func isSingularQuery(query *Query) bool {
+	for _, segment := range query.segments[1:] {
+		switch op := segment.ops[0].(type) {
+		case compiledDotOp:
+			continue
+		case compiledSelectOp:
+			if !op.descendant && len(op.selectors) == 1 && op.selectors[0].kind == selectName {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// compileIRegexp compiles an RFC 9485 regular expression, where `.` doesn't
+// match line breaks. Patterns for `match` must match the whole string.
+func compileIRegexp(pattern string, full bool) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			sb.WriteByte(c)
+			i++
+			c = pattern[i]
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '.' && !inClass:
+			sb.WriteString(`[^\n\r]`)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	if full {
+		return regexp.Compile(`^(?:` + sb.String() + `)$`)
+	}
+	return regexp.Compile(sb.String())
+}
+
+// selectNodes applies a select op to each node of a list, returning the
+// selected nodes in order. Paths are only tracked if `paths` is set.
+func (q *Query) selectNodes(segment *compiledSegment, op compiledSelectOp, nodes []pathMatch, options GetOptions, paths bool) ([]pathMatch, Error) {
+	var out []pathMatch
+	var err Error
+	for _, node := range nodes {
+		if op.descendant {
+			out, err = q.selectDescendants(segment, op, node, out, options, paths)
+		} else {
+			out, err = q.selectChildren(segment, op, node, out, options, paths)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if out == nil {
+		out = []pathMatch{}
+	}
+	return out, nil
+}
+
+// selectDescendants applies the selectors to a node and then to each of its
+// descendants in document order.
+func (q *Query) selectDescendants(segment *compiledSegment, op compiledSelectOp, node pathMatch, out []pathMatch, options GetOptions, paths bool) ([]pathMatch, Error) {
+	out, err := q.selectChildren(segment, op, node, out, options, paths)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range jsonpathChildren(node, paths) {
+		if out, err = q.selectDescendants(segment, op, child, out, options, paths); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// selectChildren appends the children of a node chosen by each selector.
+func (q *Query) selectChildren(segment *compiledSegment, op compiledSelectOp, node pathMatch, out []pathMatch, options GetOptions, paths bool) ([]pathMatch, Error) {
+	for _, selector := range op.selectors {
+		if err := q.spend(segment, options.budget); err != nil {
+			return nil, err
+		}
+		switch selector.kind {
+		case selectName:
+			var value any
+			ok := false
+			switch m := node.value.(type) {
+			case map[string]any:
+				value, ok = m[selector.name]
+			case map[any]any:
+				value, ok = m[selector.name]
+			}
+			if ok {
+				child := pathMatch{value: value}
+				if paths {
+					child.path = appendPathKey(node.path, selector.name)
+				}
+				out = append(out, child)
+			}
+		case selectWildcard:
+			out = append(out, jsonpathChildren(node, paths)...)
+		case selectIndex, selectSlice:
+			items, ok := node.value.([]any)
+			if !ok {
+				continue
+			}
+			var indexes []int
+			if selector.kind == selectIndex {
+				index := selector.index
+				if index < 0 {
+					index += len(items)
+				}
+				if index >= 0 && index < len(items) {
+					indexes = []int{index}
+				}
+			} else {
+				indexes = sliceIndexes(selector, len(items))
+			}
+			for _, index := range indexes {
+				child := pathMatch{value: items[index]}
+				if paths {
+					child.path = node.path + "[" + strconv.Itoa(index) + "]"
+				}
+				out = append(out, child)
+			}
+		case selectFilter:
+			for _, child := range jsonpathChildren(node, paths) {
+				if err := q.spend(segment, options.budget); err != nil {
+					return nil, err
+				}
+				matched, err := q.jsonpathTest(selector.filter, child.value, options)
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					out = append(out, child)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// jsonpathChildren returns the items of an array or the values of a map
+// sorted by key.
+func jsonpathChildren(node pathMatch, paths bool) []pathMatch {
+	if items, ok := node.value.([]any); ok {
+		children := make([]pathMatch, len(items))
+		for i, item := range items {
+			children[i] = pathMatch{value: item}
+			if paths {
+				children[i].path = node.path + "[" + strconv.Itoa(i) + "]"
+			}
+		}
+		return children
+	}
+	keys, values, ok := patternEntries(nil, node.value)
+	if !ok {
+		return nil
+	}
+	children := make([]pathMatch, len(values))
+	for i, value := range values {
+		children[i] = pathMatch{value: value}
+		if paths {
+			children[i].path = appendPathKey(node.path, keys[i])
+		}
+	}
+	return children
+}
+
+// sliceIndexes returns the indexes selected by a slice with the semantics of
+// RFC 9535, where the end is exclusive and a zero step selects nothing.
+func sliceIndexes(selector jsonpathSelector, length int) []int {
+	step := selector.step
+	if step == 0 {
+		return nil
+	}
+	normalize := func(i int) int {
+		if i < 0 {
+			return i + length
+		}
+		return i
+	}
+	clamp := func(i, lower, upper int) int {
+		if i < lower {
+			return lower
+		}
+		if i > upper {
+			return upper
+		}
+		return i
+	}
+
+	var indexes []int
+	if step > 0 {
+		start, end := 0, length
+		if selector.start != nil {
+			start = clamp(normalize(*selector.start), 0, length)
+		}
+		if selector.end != nil {
+			end = clamp(normalize(*selector.end), 0, length)
+		}
+		for i := start; i < end; i += step {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+
+	start, end := length-1, -1
+	if selector.start != nil {
+		start = clamp(normalize(*selector.start), -1, length-1)
+	}
+	if selector.end != nil {
+		end = clamp(normalize(*selector.end), -1, length-1)
+	}
+	for i := start; i > end; i += step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// jsonpathTest reports whether a node matches a filter expression.
+func (q *Query) jsonpathTest(expr jsonpathExpr, node any, options GetOptions) (bool, Error) {
+	switch e := expr.(type) {
+	case jsonpathOr:
+		for _, operand := range e {
+			matched, err := q.jsonpathTest(operand, node, options)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	case jsonpathAnd:
+		for _, operand := range e {
+			matched, err := q.jsonpathTest(operand, node, options)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	case jsonpathNot:
+		matched, err := q.jsonpathTest(e.expr, node, options)
+		return !matched, err
+	case jsonpathComparison:
+		left, leftOK, err := q.jsonpathValue(e.left, node, options)
+		if err != nil {
+			return false, err
+		}
+		right, rightOK, err := q.jsonpathValue(e.right, node, options)
+		if err != nil {
+			return false, err
+		}
+		return compareJSONPath(e.op, left, leftOK, right, rightOK), nil
+	case jsonpathTest:
+		if e.operand.query != nil {
+			nodes, err := q.jsonpathNodes(e.operand, node, options)
+			return len(nodes) > 0, err
+		}
+		value, _, err := q.jsonpathCall(e.operand.call, node, options)
+		matched, _ := value.(bool)
+		return matched, err
+	}
+	return false, nil
+}
+
+// jsonpathNodes gets the values selected by a query operand.
+func (q *Query) jsonpathNodes(operand jsonpathOperand, node any, options GetOptions) ([]any, Error) {
+	input := node
+	if operand.absolute {
+		input, _ = options.scope.lookup(0)
+	}
+	result, _, err := operand.query.Exec(input, options)
+	if err != nil {
+		return nil, err
+	}
+	return result.([]any), nil
+}
+
+// jsonpathValue gets the single value of an operand. It returns false if
+// there is no value, e.g. a query which selects nothing.
+func (q *Query) jsonpathValue(operand jsonpathOperand, node any, options GetOptions) (any, bool, Error) {
+	switch {
+	case operand.query != nil:
+		nodes, err := q.jsonpathNodes(operand, node, options)
+		if err != nil || len(nodes) != 1 {
+			return nil, false, err
+		}
+		return nodes[0], true, nil
+	case operand.call != nil:
+		return q.jsonpathCall(operand.call, node, options)
+	}
+	return operand.literal, true, nil
+}
+
+// jsonpathCall runs a function, returning false if its result is nothing,
+// e.g. the length of a number.
+func (q *Query) jsonpathCall(call *jsonpathCall, node any, options GetOptions) (any, bool, Error) {
+	switch call.name {
+	case "length":
+		value, ok, err := q.jsonpathValue(call.args[0], node, options)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		switch v := value.(type) {
+		case string:
+			return utf8.RuneCountInString(v), true, nil
+		case []any:
+			return len(v), true, nil
+		case map[string]any:
+			return len(v), true, nil
+		case map[any]any:
+			return len(v), true, nil
+		}
+		return nil, false, nil
+	case "count", "value":
+		nodes, err := q.jsonpathNodes(call.args[0], node, options)
+		if err != nil {
+			return nil, false, err
+		}
+		if call.name == "count" {
+			return len(nodes), true, nil
+		}
+		if len(nodes) != 1 {
+			return nil, false, nil
+		}
+		return nodes[0], true, nil
+	}
+
+	// The remaining functions are `match` and `search`.
+	value, ok, err := q.jsonpathValue(call.args[0], node, options)
+	if err != nil {
+		return false, true, err
+	}
+	s, isString := value.(string)
+	if !ok || !isString || call.invalid {
+		return false, true, nil
+	}
+	re := call.regex
+	if re == nil {
+		value, ok, err := q.jsonpathValue(call.args[1], node, options)
+		if err != nil {
+			return false, true, err
+		}
+		pattern, isString := value.(string)
+		if !ok || !isString {
+			return false, true, nil
+		}
+		var reErr error
+		if re, reErr = compileIRegexp(pattern, call.name == "match"); reErr != nil {
+			return false, true, nil
+		}
+	}
+	return re.MatchString(s), true, nil
+}
+
+// compareJSONPath compares two values, either of which may be nothing. Only
+// numbers and strings are ordered, so e.g. `true < 1` is false.
+func compareJSONPath(op string, left any, leftOK bool, right any, rightOK bool) bool {
+	switch op {
+	case "==":
+		return jsonpathEqual(left, leftOK, right, rightOK)
+	case "!=":
+		return !jsonpathEqual(left, leftOK, right, rightOK)
+	case "<":
+		return jsonpathLess(left, leftOK, right, rightOK)
+	case "<=":
+		return jsonpathLess(left, leftOK, right, rightOK) || jsonpathEqual(left, leftOK, right, rightOK)
+	case ">":
+		return jsonpathLess(right, rightOK, left, leftOK)
+	case ">=":
+		return jsonpathLess(right, rightOK, left, leftOK) || jsonpathEqual(left, leftOK, right, rightOK)
+	}
+	return false
+}
+
+// jsonpathEqual returns whether two values are deeply equal, where numbers
+// are compared by value regardless of their Go type. Nothing only equals
+// nothing.
+func jsonpathEqual(left any, leftOK bool, right any, rightOK bool) bool {
+	if !leftOK || !rightOK {
+		return leftOK == rightOK
+	}
+	if l, ok := toFloat64(left); ok {
+		r, ok := toFloat64(right)
+		return ok && l == r
+	}
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case bool, string:
+		return left == right
+	case []any:
+		r, ok := right.([]any)
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !jsonpathEqual(l[i], true, r[i], true) {
+				return false
+			}
+		}
+		return true
+	}
+	leftKeys, leftValues, ok := patternEntries(nil, left)
+	if !ok {
+		return false
+	}
+	rightKeys, rightValues, ok := patternEntries(nil, right)
+	if !ok || len(leftKeys) != len(rightKeys) {
+		return false
+	}
+	for i := range leftKeys {
+		if fmt.Sprintf("%v", leftKeys[i]) != fmt.Sprintf("%v", rightKeys[i]) || !jsonpathEqual(leftValues[i], true, rightValues[i], true) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonpathLess returns whether a number or string is less than another of the
+// same type.
+func jsonpathLess(left any, leftOK bool, right any, rightOK bool) bool {
+	if !leftOK || !rightOK {
+		return false
+	}
+	if l, ok := toFloat64(left); ok {
+		r, ok := toFloat64(right)
+		return ok && l < r
+	}
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		return ok && l < r
+	}
+	return false
+}
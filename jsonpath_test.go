@@ -0,0 +1,150 @@
+package shorthand
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonpathConformance is a test case in the format of the JSONPath
+// Compliance Test Suite, where either the result or `invalid_selector` is
+// set. Some results have more than one valid order, given by `results`.
+type jsonpathConformance struct {
+	Name            string  `json:"name"`
+	Selector        string  `json:"selector"`
+	Document        any     `json:"document"`
+	Result          []any   `json:"result"`
+	Results         [][]any `json:"results"`
+	InvalidSelector bool    `json:"invalid_selector"`
+}
+
+func TestJSONPathConformance(t *testing.T) {
+	data, err := os.ReadFile("testdata/jsonpath.json")
+	require.NoError(t, err)
+
+	var suite struct {
+		Tests []jsonpathConformance `json:"tests"`
+	}
+	require.NoError(t, json.Unmarshal(data, &suite))
+	require.NotEmpty(t, suite.Tests)
+
+	for _, example := range suite.Tests {
+		t.Run(example.Name, func(t *testing.T) {
+			query, err := CompileJSONPath(example.Selector)
+			if example.InvalidSelector {
+				require.Error(t, err, example.Selector)
+				return
+			}
+			require.NoError(t, err, example.Selector)
+
+			result, found, err := query.Exec(example.Document, GetOptions{})
+			require.NoError(t, err)
+			assert.True(t, found)
+			if example.Results != nil {
+				assert.Contains(t, example.Results, result)
+				return
+			}
+			assert.Equal(t, example.Result, result)
+		})
+	}
+}
+
+func TestJSONPathErrors(t *testing.T) {
+	for _, example := range []struct {
+		path    string
+		message string
+		offset  uint
+		length  uint
+	}{
+		{`store.book`, "JSONPath queries must start with '$'", 0, 1},
+		{`$.store | length`, "pipes are not supported in JSONPath queries", 8, 1},
+		{`$.store.`, "expected a name or '*' after '.'", 7, 1},
+		{`$[(@.length-1)]`, "script expressions are not supported, use a filter like [?@.id == 1]", 2, 1},
+		{`$[?@.price * 2 > 10]`, "arithmetic is not supported in JSONPath filters", 11, 1},
+		{`$[?price < 10]`, "unexpected price, use @.price to get a property of the current value", 3, 5},
+		{`$[?@.* == 1]`, "cannot compare @.*, which is not a single value", 3, 3},
+		{`$[?foo(@)]`, "unsupported function foo", 3, 3},
+		{`$[?length(@.tags)]`, "expected a comparison after length(@.tags)", 3, 14},
+		{`$[01]`, "integer 01 must not have leading zeros", 2, 2},
+	} {
+		t.Run(example.path, func(t *testing.T) {
+			_, err := CompileJSONPath(example.path)
+			require.Error(t, err)
+			assert.Equal(t, example.message, err.Error())
+			assert.Equal(t, example.offset, err.Offset())
+			assert.Equal(t, example.length, err.Length())
+		})
+	}
+}
+
+func TestGetJSONPath(t *testing.T) {
+	input := map[string]any{
+		"store": map[string]any{
+			"book": []any{
+				map[string]any{"title": "A", "price": 8},
+				map[string]any{"title": "B", "price": 12.5},
+			},
+		},
+	}
+
+	result, err := GetJSONPath(`$.store.book[?@.price < 10].title`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"A"}, result)
+
+	result, err = GetJSONPath(`$.missing`, input, GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []any{}, result)
+
+	// JSONPath and shorthand queries with the same source are cached apart.
+	cache := NewQueryCache(10)
+	value, _, err := GetPath(`$.store.book[0].title`, input, GetOptions{Cache: cache})
+	require.NoError(t, err)
+	assert.Equal(t, "A", value)
+	result, err = GetJSONPath(`$.store.book[0].title`, input, GetOptions{Cache: cache})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"A"}, result)
+
+	query, err := CompileJSONPath(`$..price`)
+	require.NoError(t, err)
+	segments := query.Segments()
+	require.Len(t, segments, 2)
+	assert.Equal(t, "..price", segments[1].Expression)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpRecursiveProp, Key: "price"}}, segments[1].Ops)
+
+	// Names and indexes use the same ops as shorthand queries, while other
+	// selectors keep a select op.
+	described, err := CompileJSONPath(`$.store.book[0][?@.price < 10, 'title']`)
+	require.NoError(t, err)
+	segments = described.Segments()
+	require.Len(t, segments, 5)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpSelect, Selectors: []string{"$"}}}, segments[0].Ops)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpDot}, {Kind: QueryOpProp, Key: "store"}}, segments[1].Ops)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpDot}, {Kind: QueryOpIndex}}, segments[3].Ops)
+	assert.Equal(t, []QueryOp{{Kind: QueryOpSelect, Selectors: []string{"?@.price < 10", "'title'"}}}, segments[4].Ops)
+
+	// The matching children of a value come before its descendants.
+	result, err = GetJSONPath(`$..name`, map[string]any{"a": []any{map[string]any{"name": 1}}, "name": 2}, GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []any{2, 1}, result)
+
+	paths, err := query.FindPaths(input, GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"store.book[0].price", "store.book[1].price"}, paths)
+
+	var titles []any
+	query, err = CompileJSONPath(`$.store.book[*].title`)
+	require.NoError(t, err)
+	err = query.Each(input, GetOptions{}, func(value any) bool {
+		titles = append(titles, value)
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"A", "B"}, titles)
+
+	_, err = GetJSONPath(`$..*`, input, GetOptions{MaxSteps: 3})
+	assert.True(t, errors.Is(err, ErrStepLimit))
+}
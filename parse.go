@@ -3,6 +3,7 @@ package shorthand
 import (
 	"encoding/base64"
 	"encoding/json"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -60,6 +61,21 @@ func canCoerce(value string) bool {
 	return false
 }
 
+// coerceSpecialFloat parses the values `NaN`, `+Inf` and `-Inf`, which have
+// no numeric literal syntax. It is only used for values, never for keys, and
+// only if `ParseOptions.EnableSpecialFloats` is set.
+func coerceSpecialFloat(value string) (float64, bool) {
+	switch value {
+	case "NaN":
+		return math.NaN(), true
+	case "+Inf":
+		return math.Inf(1), true
+	case "-Inf":
+		return math.Inf(-1), true
+	}
+	return 0, false
+}
+
 func coerceValue(value string, forceFloat bool) (any, bool) {
 	if value == "null" {
 		return nil, true
@@ -206,7 +222,7 @@ func endsWithWhitespace(s string) bool {
 	return unicode.IsSpace(r)
 }
 
-func canEndValueBeforeComment(value string, forceFloat bool) bool {
+func canEndValueBeforeComment(value string, forceFloat bool, specialFloats bool) bool {
 	if value == "" {
 		return false
 	}
@@ -225,6 +241,10 @@ func canEndValueBeforeComment(value string, forceFloat bool) bool {
 		}
 	}
 
+	if _, ok := coerceSpecialFloat(value); ok && specialFloats {
+		return true
+	}
+
 	_, ok := coerceValue(value, forceFloat)
 	return ok
 }
@@ -277,6 +297,10 @@ func (d *Document) parseEscape(quoted bool, includeEscape bool) bool {
 
 	if replace, ok := JSONReplacements[peek]; ok {
 		d.next()
+		if includeEscape && replace == '\\' {
+			// Keep literal backslashes escaped in paths.
+			d.buf.WriteRune('\\')
+		}
 		d.buf.WriteRune(replace)
 		return true
 	}
@@ -337,6 +361,26 @@ func (d *Document) parseQuoted(escapeProp bool) Error {
 	return nil
 }
 
+// unescapePathChars removes the escapes from path characters like `.` and
+// `:` in a property, which are not needed once it is wrapped in quotes. Other
+// escapes like `\\` and `\"` are kept.
+func unescapePathChars(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if !strings.ContainsRune(".{[:^]", rune(s[i])) {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
 func (d *Document) parseIndex() Error {
 	for {
 		r := d.next()
@@ -400,7 +444,7 @@ func (d *Document) parseProp(path string, commaStop bool) (string, Error) {
 			if canCoerce(prop) || prop == "" {
 				// This could be coerced into another type, so let's keep it wrapped
 				// in quotes to ensure it is treated properly.
-				prop = `"` + prop + `"`
+				prop = `"` + unescapePathChars(prop) + `"`
 			}
 
 			if path != "" {
@@ -618,7 +662,11 @@ func (d *Document) parseValue(path string, coerce bool, terminateComma bool) Err
 					return nil
 				}
 
-				if coerced, ok := coerceValue(value, d.options.ForceFloat64Numbers); ok {
+				coerced, ok := coerceValue(value, d.options.ForceFloat64Numbers)
+				if !ok && d.options.EnableSpecialFloats {
+					coerced, ok = coerceSpecialFloat(value)
+				}
+				if ok {
 					if d.options.DebugLogger != nil {
 						d.options.DebugLogger("Parse value: %v", coerced)
 					}
@@ -749,7 +797,7 @@ func (d *Document) parseValue(path string, coerce bool, terminateComma bool) Err
 				first = true
 				continue
 			}
-			if endsWithWhitespace(rawValue) || canEndValueBeforeComment(value, d.options.ForceFloat64Numbers) {
+			if endsWithWhitespace(rawValue) || canEndValueBeforeComment(value, d.options.ForceFloat64Numbers, d.options.EnableSpecialFloats) {
 				d.skipComments(r)
 				return finishValue(value)
 			}
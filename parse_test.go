@@ -2,9 +2,11 @@ package shorthand
 
 import (
 	"encoding/json"
+	"math"
 	"os"
 	"path/filepath"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -87,7 +89,7 @@ var parseExamples = []struct {
 	{
 		Name:  "Quoted Coerceable Keys",
 		Input: `{"null": 0, "true": 1, "false": 2, "2020-01-01T12:00:00Z": 3, "4": 5}`,
-		JSON:  `[["\"null\"", 0], ["\"true\"", 1], ["\"false\"", 2], ["\"2020-01-01T12\\:00\\:00Z\"", 3], ["\"4\"", 5]]`,
+		JSON:  `[["\"null\"", 0], ["\"true\"", 1], ["\"false\"", 2], ["\"2020-01-01T12:00:00Z\"", 3], ["\"4\"", 5]]`,
 	},
 	{
 		Name:  "Guess object",
@@ -275,6 +277,25 @@ func TestParserTrimsUnicodeWhitespaceAfterPropertyName(t *testing.T) {
 	assert.Equal(t, "name", d.Operations[0].Path)
 }
 
+func TestParserQuotedKeyPathChars(t *testing.T) {
+	result, err := Unmarshal(`{"0:": 1, "1.5": 2, "2020-01-01T12:00:00Z": 3, "0\\.": 4}`, ParseOptions{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"0:": 1, "1.5": 2, "2020-01-01T12:00:00Z": 3, `0\.`: 4}, result)
+}
+
+func TestParserSpecialFloats(t *testing.T) {
+	result, err := Unmarshal("{a: NaN, b: +Inf, c: -Inf}", ParseOptions{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "NaN", "b": "+Inf", "c": "-Inf"}, result)
+
+	result, err = Unmarshal("{a: NaN, b: +Inf, c: -Inf // comment\n}", ParseOptions{EnableSpecialFloats: true}, nil)
+	require.NoError(t, err)
+	m := result.(map[string]any)
+	assert.True(t, math.IsNaN(m["a"].(float64)))
+	assert.Equal(t, math.Inf(1), m["b"])
+	assert.Equal(t, math.Inf(-1), m["c"])
+}
+
 func TestParserInvalidJSONFileInclude(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "bad.json")
@@ -370,3 +391,30 @@ func FuzzParser(f *testing.F) {
 		d.Parse(s)
 	})
 }
+
+func FuzzMarshalRoundTrip(f *testing.F) {
+	f.Add("1.0")
+	f.Add("NaN")
+	f.Add(`{"1": 1.5, 1: [a: 1]}`)
+	f.Add("2022-01-02T03:04:05+00:00")
+	f.Add(`["a: b", "", %wg==]`)
+	f.Fuzz(func(t *testing.T, s string) {
+		if !utf8.ValidString(s) {
+			// Invalid UTF-8 can't be represented in quoted strings.
+			return
+		}
+
+		for _, detect := range []bool{false, true} {
+			options := ParseOptions{EnableObjectDetection: detect, EnableSpecialFloats: true}
+			value, err := Unmarshal(s, options, nil)
+			if err != nil {
+				continue
+			}
+
+			out := Marshal(value, MarshalOptions{RoundTrip: true})
+			result, err := Unmarshal(out, options, nil)
+			require.NoError(t, err, "marshalled: %s", out)
+			require.True(t, roundTripEqual(value, result), "marshalled: %s\nexpected: %#v\nactual: %#v", out, value, result)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package shorthand
+
+import (
+	"strconv"
+	"strings"
+)
+
+// location is where a query result was found in the input, which
+// `execSegment` tracks alongside the result when finding paths. Results of
+// fanning out over an array, e.g. `items.name`, are lists with a location
+// for each item of the result array. Locations are nil when not finding
+// paths and are never modified once created.
+type location struct {
+	path    string
+	missing bool
+	isList  bool
+	list    []location
+}
+
+// missingLocation is the location of a value which isn't in the input.
+var missingLocation = &location{missing: true}
+
+// notFound returns the location of a value which isn't in the input, which is
+// nil when not finding paths.
+func (l *location) notFound() *location {
+	if l == nil {
+		return nil
+	}
+	return missingLocation
+}
+
+// items returns the location of each item of an array result.
+func (l *location) items(values []any) []location {
+	if l.isList {
+		return l.list
+	}
+	items := make([]location, len(values))
+	for i := range values {
+		if l.missing {
+			items[i] = location{missing: true}
+			continue
+		}
+		items[i] = location{path: l.path + "[" + strconv.Itoa(i) + "]"}
+	}
+	return items
+}
+
+// child returns the location of a map value by its key.
+func (l *location) child(key any) *location {
+	if l.missing || l.isList {
+		return missingLocation
+	}
+	return &location{path: appendPathKey(l.path, key)}
+}
+
+// children returns a list of the locations of map values by their keys.
+func (l *location) children(keys []any) *location {
+	list := make([]location, len(keys))
+	for i, k := range keys {
+		list[i] = *l.child(k)
+	}
+	return locationList(list)
+}
+
+// locationList creates the location of a list result. The list is nil when
+// not finding paths, which has no location.
+func locationList(list []location) *location {
+	if list == nil {
+		return nil
+	}
+	return &location{isList: true, list: list}
+}
+
+// fanOut tracks the locations of the items of an array and of the results
+// collected from them while fanning out over it. It is nil when not finding
+// paths.
+type fanOut struct {
+	items []location
+	out   []location
+}
+
+// newFanOut starts tracking a fan-out over the items of an array found at the
+// given location, if finding paths.
+func newFanOut(at *location, items []any) *fanOut {
+	if at == nil {
+		return nil
+	}
+	return &fanOut{items: at.items(items), out: make([]location, 0, len(items))}
+}
+
+// item returns the location of an item.
+func (f *fanOut) item(i int) *location {
+	if f == nil {
+		return nil
+	}
+	return &f.items[i]
+}
+
+// add appends the location of a collected result.
+func (f *fanOut) add(at *location) {
+	if f != nil {
+		f.out = append(f.out, *at)
+	}
+}
+
+// location returns the location of the collected results.
+func (f *fanOut) location() *location {
+	if f == nil {
+		return nil
+	}
+	return locationList(f.out)
+}
+
+// pathMatch is a value matched by a query along with its path.
+type pathMatch struct {
+	value any
+	path  string
+}
+
+// collect appends all found values of a result in order.
+func (l *location) collect(value any, matches []pathMatch) []pathMatch {
+	if l.isList {
+		values, _ := value.([]any)
+		for i := range l.list {
+			matches = l.list[i].collect(values[i], matches)
+		}
+		return matches
+	}
+	if !l.missing {
+		matches = append(matches, pathMatch{value: value, path: l.path})
+	}
+	return matches
+}
+
+// appendPathKey appends a map key to a path, escaping or quoting it if needed
+// so that the path can be used to patch the input.
+func appendPathKey(path string, key any) string {
+	rendered := renderMapKey(MarshalOptions{RoundTrip: true}, key)
+	if s, ok := key.(string); ok && !needsQuotedPathKey(s) {
+		// Quotes are only allowed on the last part of a path, so path
+		// characters are escaped instead, e.g. `a\.b.c`.
+		rendered = escapePathKey(s)
+	}
+	if path == "" {
+		return rendered
+	}
+	return path + "." + rendered
+}
+
+// needsQuotedPathKey returns whether a key can't be written in a path using
+// escapes alone, e.g. because it would be coerced into a number or has
+// surrounding whitespace.
+func needsQuotedPathKey(key string) bool {
+	return key == "" ||
+		canCoerce(key) ||
+		strings.TrimSpace(key) != key ||
+		strings.Contains(key, "//") ||
+		containsAnyRune(key, "\"}")
+}
+
+// escapePathKey escapes the characters in a key which would otherwise be read
+// as part of the path, e.g. `a.b` becomes `a\.b`.
+func escapePathKey(key string) string {
+	if !containsAnyRune(key, ".[]{:^,\\") {
+		return key
+	}
+	var sb strings.Builder
+	for _, r := range key {
+		if strings.ContainsRune(".[]{:^,\\", r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// FindPaths runs a query and returns the path of each match, e.g.
+// `items[3].name`, rather than its value. Each path can be used to get or
+// patch that value, e.g. with `Document.Apply`. Queries which construct new
+// values, e.g. with field selection or functions, return an error.
+func FindPaths(query string, input any) ([]string, Error) {
+	q, err := defaultQueryCache.compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.FindPaths(input, GetOptions{})
+}
+
+// FindPaths is like `Exec` but returns the path of each match, see
+// the `FindPaths` function.
+func (q *Query) FindPaths(input any, options GetOptions) ([]string, Error) {
+	matches, err := q.findMatches(input, options)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(matches))
+	for i, match := range matches {
+		paths[i] = match.path
+	}
+	return paths, nil
+}
+
+// findMatches runs the query while tracking paths, returning each match
+// along with its path.
+func (q *Query) findMatches(input any, options GetOptions) ([]pathMatch, Error) {
+	options = options.withBudget()
+	options, collected := options.withErrors()
+	if q.scoped && options.scope == nil {
+		options.scope = &queryScope{root: input}
+	}
+	// Each match needs its own path, so filters over maps never keep keys.
+	options.KeepFilteredKeys = false
+	result, _, at, err := q.execAt(input, &location{}, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := collected.err(); err != nil {
+		return nil, err
+	}
+	return at.collect(result, nil), nil
+}
+
+// createsValueError is returned when finding the paths of a query which
+// creates a new value, which has no path in the input.
+func (q *Query) createsValueError(offset, length uint, what any) Error {
+	return NewError(&q.expression, offset, length, "cannot find paths for %v, which creates a new value", what)
+}
@@ -0,0 +1,264 @@
+package shorthand
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var findPathsInput = `{
+	"items": [
+		{"id": 1, "name": "a", "tags": ["x", "y"]},
+		{"id": 2, "name": "b", "tags": []},
+		{"id": 3, "name": "c", "tags": ["z"]},
+		{"id": 4, "name": "d"}
+	],
+	"meta": {"name": "m", "a.b": {"name": "q"}, "1": true}
+}`
+
+var findPathsExamples = []struct {
+	Name  string
+	Query string
+	Paths []string
+	Error string
+}{
+	{
+		Name:  "Prop",
+		Query: `meta.name`,
+		Paths: []string{"meta.name"},
+	},
+	{
+		Name:  "Missing",
+		Query: `meta.missing`,
+		Paths: []string{},
+	},
+	{
+		Name:  "Index",
+		Query: `items[-1].name`,
+		Paths: []string{"items[3].name"},
+	},
+	{
+		Name:  "Index out of range",
+		Query: `items[10]`,
+		Paths: []string{},
+	},
+	{
+		Name:  "Fanout",
+		Query: `items.tags`,
+		Paths: []string{"items[0].tags", "items[1].tags", "items[2].tags"},
+	},
+	{
+		Name:  "Slice",
+		Query: `items[1:2].id`,
+		Paths: []string{"items[1].id", "items[2].id"},
+	},
+	{
+		Name:  "Slice step",
+		Query: `items[::-2].id`,
+		Paths: []string{"items[3].id", "items[1].id"},
+	},
+	{
+		Name:  "Filter",
+		Query: `items[id > 2].name`,
+		Paths: []string{"items[2].name", "items[3].name"},
+	},
+	{
+		Name:  "Map filter",
+		Query: `meta[name == q]`,
+		Paths: []string{`meta.a\.b`},
+	},
+	{
+		Name:  "Wildcard",
+		Query: `meta.*`,
+		Paths: []string{`meta."1"`, `meta.a\.b`, "meta.name"},
+	},
+	{
+		Name:  "Glob",
+		Query: `meta.a*`,
+		Paths: []string{`meta.a\.b`},
+	},
+	{
+		Name:  "Regex filter",
+		Query: `items[name =~ "^[ab]$"].id`,
+		Paths: []string{"items[0].id", "items[1].id"},
+	},
+	{
+		Name:  "Recursive",
+		Query: `..name`,
+		Paths: []string{"items[0].name", "items[1].name", "items[2].name", "items[3].name", `meta.a\.b.name`, "meta.name"},
+	},
+	{
+		Name:  "Flatten",
+		Query: `items.tags[]`,
+		Paths: []string{"items[0].tags[0]", "items[0].tags[1]", "items[2].tags[0]"},
+	},
+	{
+		Name:  "Pipe",
+		Query: `items.tags | [1]`,
+		Paths: []string{"items[1].tags"},
+	},
+	{
+		Name:  "Pipe filter",
+		Query: `items.name | [@ != b]`,
+		Paths: []string{"items[0].name", "items[2].name", "items[3].name"},
+	},
+	{
+		Name:  "Pipe property fallback",
+		Query: `meta | name`,
+		Paths: []string{"meta.name"},
+	},
+	{
+		Name:  "Root",
+		Query: `items[name == $.items[2].name].id`,
+		Paths: []string{"items[2].id"},
+	},
+	{
+		Name:  "Root path",
+		Query: `$.meta.name`,
+		Paths: []string{"meta.name"},
+	},
+	{
+		Name:  "Parent",
+		Query: `items.{p: ^}`,
+		Error: "cannot find paths for field selection",
+	},
+	{
+		Name:  "Parent path",
+		Query: `^.meta`,
+		Error: "cannot find paths for parent references",
+	},
+	{
+		Name:  "Fallback",
+		Query: `meta.title ?? meta.name`,
+		Paths: []string{"meta.name"},
+	},
+	{
+		Name:  "Fallback literal",
+		Query: `meta.title ?? "none"`,
+		Error: "cannot find paths for none",
+	},
+	{
+		Name:  "Conditional",
+		Query: `items | if @.length > 3 then [0].name else [1].name`,
+		Paths: []string{"items[0].name"},
+	},
+	{
+		Name:  "Update",
+		Query: `meta.name |= "x"`,
+		Error: "cannot find paths for an update",
+	},
+	{
+		Name:  "Field selection",
+		Query: `items.{id}`,
+		Error: "cannot find paths for field selection",
+	},
+	{
+		Name:  "Function",
+		Query: `items | sortBy(id)`,
+		Error: "cannot find paths for sortBy",
+	},
+	{
+		Name:  "Array construction",
+		Query: `[meta, items]`,
+		Error: "cannot find paths for array construction",
+	},
+	{
+		Name:  "String index",
+		Query: `meta.name[0]`,
+		Error: "cannot find paths within a string",
+	},
+}
+
+func TestFindPaths(t *testing.T) {
+	for _, example := range findPathsExamples {
+		t.Run(example.Name, func(t *testing.T) {
+			var input any
+			require.NoError(t, json.Unmarshal([]byte(findPathsInput), &input))
+
+			paths, err := FindPaths(example.Query, input)
+			if example.Error != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), example.Error)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, example.Paths, paths)
+
+			// Each path must get and patch the value it found.
+			for _, path := range paths {
+				value, found, err := GetPath(path, input, GetOptions{})
+				require.NoError(t, err)
+				require.True(t, found, path)
+				assert.NotEqual(t, "patched", value)
+
+				d := Document{Operations: []Operation{{Kind: OpSet, Path: path, Value: "patched"}}}
+				patched, err := d.Apply(input)
+				require.NoError(t, err, path)
+				value, _, err = GetPath(path, patched, GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, "patched", value, path)
+
+				// The path must also work when written in a shorthand document.
+				d = *NewDocument(ParseOptions{EnableObjectDetection: true})
+				require.NoError(t, d.Parse(path+": patched"), path)
+				parsed, err := d.Apply(input)
+				require.NoError(t, err, path)
+				assert.Equal(t, patched, parsed, path)
+			}
+		})
+	}
+}
+
+func TestFindPathsEscapedKeys(t *testing.T) {
+	newInput := func() any {
+		return map[string]any{
+			"a.b":  map[string]any{"c[0]": map[string]any{"d:e": 1}},
+			"f,g^": []any{map[string]any{`h\i`: 2}},
+		}
+	}
+
+	for query, path := range map[string]string{
+		`"a.b".*.*`:   `a\.b.c\[0\].d\:e`,
+		`"f,g^"[0].*`: `f\,g\^[0].h\\i`,
+	} {
+		paths, err := FindPaths(query, newInput())
+		require.NoError(t, err)
+		require.Equal(t, []string{path}, paths)
+
+		d := NewDocument(ParseOptions{EnableObjectDetection: true})
+		require.NoError(t, d.Parse(path+": patched"), path)
+		patched, err := d.Apply(newInput())
+		require.NoError(t, err, path)
+		assert.Len(t, patched, 2, path)
+		value, _, err := GetPath(path, patched, GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "patched", value, path)
+	}
+}
+
+func TestFindPathsNonStringKeys(t *testing.T) {
+	newInput := func() any {
+		return map[any]any{
+			1:       map[string]any{"name": "int"},
+			2.5:     map[string]any{"name": "float"},
+			true:    map[string]any{"name": "bool"},
+			"x y. ": map[string]any{"name": "string"},
+		}
+	}
+
+	paths, err := FindPaths(`*.name`, newInput())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.name", "25e-1.name", "true.name", `"x y. ".name`}, paths)
+
+	for _, path := range paths {
+		d := Document{Operations: []Operation{{Kind: OpSet, Path: path, Value: "patched"}}}
+		patched, err := d.Apply(newInput())
+		require.NoError(t, err, path)
+		assert.Len(t, patched, 4, path)
+		value, _, err := GetPath(path, patched, GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "patched", value, path)
+	}
+}
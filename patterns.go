@@ -0,0 +1,299 @@
+package shorthand
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/danielgtaylor/mexpr"
+)
+
+// keyPattern matches map keys using a glob like `app*` or a regular
+// expression like `/^x-/`. Non-string keys are matched by their string form.
+type keyPattern struct {
+	source string
+	re     *regexp.Regexp
+}
+
+func (p *keyPattern) String() string {
+	return p.source
+}
+
+func (p *keyPattern) match(key any) bool {
+	if s, ok := key.(string); ok {
+		return p.re.MatchString(s)
+	}
+	return p.re.MatchString(fmt.Sprintf("%v", key))
+}
+
+// globPattern converts a glob, where `*` matches any number of characters,
+// into a key pattern.
+func globPattern(glob string) *keyPattern {
+	parts := strings.Split(glob, "*")
+	for i := range parts {
+		// Regexes must be valid UTF-8, and invalid bytes in keys are matched
+		// as the replacement character anyway.
+		parts[i] = regexp.QuoteMeta(strings.ToValidUTF8(parts[i], "\uFFFD"))
+	}
+	return &keyPattern{
+		source: glob,
+		re:     regexp.MustCompile(`(?s)^` + strings.Join(parts, ".*") + `$`),
+	}
+}
+
+// isGlob returns whether an unquoted key is a glob rather than a literal key.
+// A lone `*` keeps its original meaning of all values.
+func isGlob(key string) bool {
+	return key != "*" && strings.Contains(key, "*")
+}
+
+// keyMatches returns whether a map key matches a query key or pattern.
+func keyMatches(key, k any) bool {
+	if p, ok := key.(*keyPattern); ok {
+		return p.match(k)
+	}
+	return k == key
+}
+
+// singleProp returns the key of a query which only gets a single property or
+// pattern, e.g. `password` or `app*`.
+func (q *Query) singleProp() (any, bool) {
+	if len(q.segments) != 1 || len(q.segments[0].ops) != 1 {
+		return nil, false
+	}
+	if op, ok := q.segments[0].ops[0].(compiledPropOp); ok {
+		return op.key, true
+	}
+	return nil, false
+}
+
+// keyPattern returns the pattern of a query which is only a glob or regex
+// key, e.g. `app*`, or nil for any other query.
+func (q *Query) keyPattern() *keyPattern {
+	key, _ := q.singleProp()
+	p, _ := key.(*keyPattern)
+	return p
+}
+
+// patternEntries returns the keys matching a pattern, or all keys if the
+// pattern is nil, along with their values sorted by key like `*`. It returns
+// false if the input is not a map.
+func patternEntries(p *keyPattern, input any) ([]any, []any, bool) {
+	var keys []any
+	switch m := input.(type) {
+	case map[string]any:
+		matched := make([]string, 0, len(m))
+		for k := range m {
+			if p == nil || p.match(k) {
+				matched = append(matched, k)
+			}
+		}
+		sort.Strings(matched)
+		keys = make([]any, len(matched))
+		values := make([]any, len(matched))
+		for i, k := range matched {
+			keys[i] = k
+			values[i] = m[k]
+		}
+		return keys, values, true
+	case map[any]any:
+		keys = make([]any, 0, len(m))
+		for _, k := range sortedKeys(m) {
+			if p == nil || p.match(k) {
+				keys = append(keys, k)
+			}
+		}
+		values := make([]any, len(keys))
+		for i, k := range keys {
+			values[i] = m[k]
+		}
+		return keys, values, true
+	}
+	return nil, nil, false
+}
+
+// sortedKeys returns the keys of a map sorted by their string form.
+func sortedKeys(m map[any]any) []any {
+	keys := make([]any, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprintf("%v", keys[i]) < fmt.Sprintf("%v", keys[j])
+	})
+	return keys
+}
+
+// parseKeyRegex parses a regular expression key like `/^x-/` starting at the
+// opening slash. A slash within the expression is escaped as `\/`. It returns
+// false without consuming anything if the key is not a complete regular
+// expression, e.g. `/users`, so that such keys keep working as literals.
+func (d *Document) parseKeyRegex() (*keyPattern, bool, Error) {
+	start := d.pos
+	d.next()
+
+	var buf strings.Builder
+	for {
+		r := d.next()
+		switch r {
+		case -1:
+			d.pos = start
+			return nil, false, nil
+		case '\\':
+			if d.peek() == '/' {
+				d.next()
+				buf.WriteRune('/')
+				continue
+			}
+			buf.WriteRune(r)
+			if d.peek() != -1 {
+				buf.WriteRune(d.next())
+			}
+			continue
+		case '/':
+			switch d.peek() {
+			case -1, '.', '[', '|', ',', '}', ']', ' ', '\t', '\n', '\r':
+			default:
+				d.pos = start
+				return nil, false, nil
+			}
+			re, err := regexp.Compile(buf.String())
+			if err != nil {
+				return nil, false, NewError(&d.expression, start, d.pos-start, "invalid regular expression: %v", err)
+			}
+			return &keyPattern{source: d.expression[start:d.pos], re: re}, true, nil
+		}
+		buf.WriteRune(r)
+	}
+}
+
+// filterRegex is a regex match `left =~ "pattern"` within a filter. Since
+// mexpr has no such operator, the filter is parsed with `==` in its place and
+// `node` is replaced by the result of the match for each item.
+type filterRegex struct {
+	node *mexpr.Node
+	left *mexpr.Node
+	re   *regexp.Regexp
+}
+
+// compiledFilter is a parsed filter expression along with its regex matches
+// and variables.
+type compiledFilter struct {
+	ast       *mexpr.Node
+	regexes   []filterRegex
+	variables []filterVariable
+}
+
+// op returns a filter operation for the compiled expression, which is at the
+// given offset within the query.
+func (f *compiledFilter) op(expr string, offset uint) compiledFilterOp {
+	return compiledFilterOp{
+		expr:      expr,
+		offset:    offset,
+		ast:       f.ast,
+		calls:     filterCalls(f.ast),
+		regexes:   f.regexes,
+		variables: f.variables,
+	}
+}
+
+// replaceRegexOps replaces each `=~` outside of a string with `==`, which has
+// the same length so offsets are unchanged. It returns the rune offsets of the
+// replaced operators.
+func replaceRegexOps(expr string) (string, []uint16) {
+	if !strings.Contains(expr, "=~") {
+		return expr, nil
+	}
+
+	var offsets []uint16
+	b := []byte(expr)
+	quoted := false
+	runes := 0
+	for i := 0; i < len(b); i++ {
+		if b[i] >= utf8.RuneSelf && !utf8.RuneStart(b[i]) {
+			continue
+		}
+		switch {
+		case quoted && b[i] == '\\' && i+1 < len(b):
+			i++
+			runes++
+		case b[i] == '"':
+			quoted = !quoted
+		case !quoted && b[i] == '=' && i+1 < len(b) && b[i+1] == '~':
+			offsets = append(offsets, uint16(runes))
+			b[i+1] = '='
+			i++
+			runes++
+		}
+		runes++
+	}
+	return string(b), offsets
+}
+
+// findFilterRegexes finds the `==` nodes standing in for `=~` and compiles
+// their patterns. The base offset is used to report errors within the query.
+func (d *Document) findFilterRegexes(ast *mexpr.Node, offsets []uint16, base uint, inWhere bool, regexes []filterRegex) ([]filterRegex, Error) {
+	if ast == nil {
+		return regexes, nil
+	}
+
+	if ast.Type == mexpr.NodeEqual {
+		for _, offset := range offsets {
+			if ast.Offset != offset {
+				continue
+			}
+			if inWhere {
+				return nil, NewError(&d.expression, base+uint(offset), 2, "=~ is not supported within where")
+			}
+			pattern, ok := ast.Right.Value.(string)
+			if ast.Right.Type != mexpr.NodeLiteral || !ok {
+				return nil, NewError(&d.expression, base+uint(offset), 2, "=~ expects a quoted regular expression")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, NewError(&d.expression, base+uint(ast.Right.Offset), uint(ast.Right.Length), "invalid regular expression: %v", err)
+			}
+			regexes = append(regexes, filterRegex{node: ast, left: ast.Left, re: re})
+			break
+		}
+	}
+
+	var err Error
+	if params, ok := ast.Value.([]mexpr.Node); ok && ast.Type == mexpr.NodeFunctionCall {
+		for i := range params {
+			if regexes, err = d.findFilterRegexes(&params[i], offsets, base, inWhere, regexes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if regexes, err = d.findFilterRegexes(ast.Left, offsets, base, inWhere, regexes); err != nil {
+		return nil, err
+	}
+	return d.findFilterRegexes(ast.Right, offsets, base, inWhere || ast.Type == mexpr.NodeWhere, regexes)
+}
+
+// substituteNodes copies an AST, replacing the given nodes with literal
+// values. The filter's own AST is shared by concurrent queries, so it must
+// not be modified.
+func substituteNodes(ast *mexpr.Node, literals map[*mexpr.Node]any) *mexpr.Node {
+	if ast == nil || len(literals) == 0 {
+		return ast
+	}
+	if value, ok := literals[ast]; ok {
+		return &mexpr.Node{Type: mexpr.NodeLiteral, Offset: ast.Offset, Length: ast.Length, Value: value}
+	}
+
+	node := *ast
+	if params, ok := ast.Value.([]mexpr.Node); ok && ast.Type == mexpr.NodeFunctionCall {
+		copied := make([]mexpr.Node, len(params))
+		for i := range params {
+			copied[i] = *substituteNodes(&params[i], literals)
+		}
+		node.Value = copied
+	}
+	node.Left = substituteNodes(ast.Left, literals)
+	node.Right = substituteNodes(ast.Right, literals)
+	return &node
+}
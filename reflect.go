@@ -0,0 +1,270 @@
+package shorthand
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structValue is an object converted from a Go struct, which keeps the order
+// in which fields are declared rather than sorting them like a map.
+type structValue struct {
+	keys   []string
+	values []any
+}
+
+// rawValue is rendered as-is, used for types shorthand has no syntax for.
+type rawValue string
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// structField describes how a single struct field should be marshalled.
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structFieldsCache maps a struct type to its []structField.
+var structFieldsCache sync.Map
+
+// reflectValue converts an arbitrary Go value into one of the types that
+// `renderValue` handles directly. It honors `json` struct tags including
+// `omitempty`, and uses `json.Marshaler` or `encoding.TextMarshaler` when a
+// type implements them.
+func reflectValue(value any) any {
+	rv := reflect.ValueOf(value)
+	if !rv.IsValid() {
+		return nil
+	}
+
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		if !implementsMarshaler(rv.Type()) || implementsMarshaler(rv.Type().Elem()) {
+			// Marshal the pointed-to value unless only the pointer implements a
+			// marshaler interface.
+			return rv.Elem().Interface()
+		}
+	}
+
+	if n, ok := value.(json.Number); ok {
+		// Like `encoding/json`, numbers are written as-is rather than as the
+		// strings they are stored in, so precision is kept.
+		if n == "" {
+			return rawValue("0")
+		}
+		if isJSONNumber(string(n)) {
+			return rawValue(n)
+		}
+	}
+
+	if rv.Type().Implements(jsonMarshalerType) {
+		b, err := value.(json.Marshaler).MarshalJSON()
+		if err == nil {
+			var decoded any
+			if err := json.Unmarshal(b, &decoded); err == nil {
+				return decoded
+			}
+		}
+	}
+
+	if rv.Type().Implements(textMarshalerType) {
+		if b, err := value.(encoding.TextMarshaler).MarshalText(); err == nil {
+			return string(b)
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return rv.Elem().Interface()
+	case reflect.Struct:
+		fields := cachedStructFields(rv.Type())
+		out := structValue{
+			keys:   make([]string, 0, len(fields)),
+			values: make([]any, 0, len(fields)),
+		}
+		for _, field := range fields {
+			fv, ok := fieldByIndex(rv, field.index)
+			if !ok || (field.omitEmpty && isEmptyValue(fv)) {
+				continue
+			}
+			out.keys = append(out.keys, renderStringKey(field.name))
+			out.values = append(out.values, fv.Interface())
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return b
+		}
+		items := make([]any, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return items
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		if rv.Type().Key().Kind() == reflect.String {
+			m := make(map[string]any, rv.Len())
+			iter := rv.MapRange()
+			for iter.Next() {
+				m[iter.Key().String()] = iter.Value().Interface()
+			}
+			return m
+		}
+		m := make(map[any]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().Interface()] = iter.Value().Interface()
+		}
+		return m
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint()
+	case reflect.Float32:
+		return float32(rv.Float())
+	case reflect.Float64:
+		return rv.Float()
+	}
+
+	return rawValue(fmt.Sprintf("%v", value))
+}
+
+// isJSONNumber returns whether a string is a valid JSON number.
+func isJSONNumber(s string) bool {
+	return (s[0] == '-' || (s[0] >= '0' && s[0] <= '9')) && json.Valid([]byte(s))
+}
+
+// implementsMarshaler returns whether a type implements `json.Marshaler` or
+// `encoding.TextMarshaler`.
+func implementsMarshaler(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+// fieldByIndex is like `reflect.Value.FieldByIndex` but returns false instead
+// of panicking when passing through a nil embedded pointer.
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+// cachedStructFields returns the marshalled fields of a struct type.
+func cachedStructFields(t reflect.Type) []structField {
+	if cached, ok := structFieldsCache.Load(t); ok {
+		return cached.([]structField)
+	}
+
+	fields := typeFields(t, nil, map[string]bool{})
+	actual, _ := structFieldsCache.LoadOrStore(t, fields)
+	return actual.([]structField)
+}
+
+// typeFields walks the fields of a struct type, promoting fields from
+// embedded structs like `encoding/json` does. Fields closer to the top level
+// win when names conflict.
+func typeFields(t reflect.Type, parent []int, seen map[string]bool) []structField {
+	fields := []structField{}
+	embedded := []reflect.StructField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, f)
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		index := make([]int, len(parent)+1)
+		copy(index, parent)
+		index[len(parent)] = i
+
+		fields = append(fields, structField{
+			name:      name,
+			index:     index,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		index := append(append([]int{}, parent...), f.Index...)
+		fields = append(fields, typeFields(ft, index, seen)...)
+	}
+
+	return fields
+}
+
+// isEmptyValue matches the `omitempty` semantics of `encoding/json`.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
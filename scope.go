@@ -0,0 +1,210 @@
+package shorthand
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// queryScope tracks the root input of a query for `$` references and the
+// objects containing the current value for `^` references. Each scope adds
+// one parent, linking to the scope of the grandparent.
+type queryScope struct {
+	root   any
+	parent any
+	up     *queryScope
+}
+
+// withParent returns a scope with a new immediate parent.
+func (s *queryScope) withParent(parent any) *queryScope {
+	return &queryScope{root: s.root, parent: parent, up: s}
+}
+
+// lookup returns the root for zero levels or the parent the given number of
+// levels up, e.g. 2 for `^^`.
+func (s *queryScope) lookup(levels int) (any, bool) {
+	if s == nil {
+		return nil, false
+	}
+	if levels == 0 {
+		return s.root, true
+	}
+	for ; s != nil && s.up != nil; s = s.up {
+		if levels--; levels == 0 {
+			return s.parent, true
+		}
+	}
+	return nil, false
+}
+
+// compiledScopeOp gets the root with `$` or a parent with `^`, e.g. `$.user`
+// or `^.team`.
+type compiledScopeOp struct {
+	offset  uint
+	parents int
+}
+
+// isScopeEnd returns whether a rune may follow a `$` or `^` reference.
+func isScopeEnd(r rune) bool {
+	switch r {
+	case -1, '.', '[', '|', ',', '}', ']', ' ', '\t', '\n', '\r':
+		return true
+	}
+	return false
+}
+
+// compileScope parses a root or parent reference at the start of a path. It
+// returns false without consuming anything for other paths, e.g. `$ref`.
+func (d *Document) compileScope() (compiledScopeOp, bool) {
+	start := d.pos
+	op := compiledScopeOp{offset: start}
+	switch d.peek() {
+	case '$':
+		d.next()
+	case '^':
+		for d.peek() == '^' {
+			d.next()
+			op.parents++
+		}
+	default:
+		return op, false
+	}
+	if !isScopeEnd(d.peek()) {
+		d.pos = start
+		return op, false
+	}
+	return op, true
+}
+
+// usesScope returns whether a query or any nested query references the root
+// or a parent, so that running it needs to track them.
+func (q *Query) usesScope() bool {
+	for _, segment := range q.segments {
+		for _, op := range segment.ops {
+			switch op := op.(type) {
+			case compiledScopeOp:
+				return true
+			case compiledFilterOp:
+				for _, v := range op.variables {
+					if v.name == "" {
+						return true
+					}
+				}
+			case compiledFieldsOp:
+				for _, field := range op.fields {
+					if field.query.scoped {
+						return true
+					}
+				}
+			case compiledArrayLiteralOp:
+				for _, element := range op.elements {
+					if element.scoped {
+						return true
+					}
+				}
+			case compiledCallOp:
+				if op.key != nil && op.key.scoped {
+					return true
+				}
+			case compiledUpdateOp:
+				if op.path.scoped || operandsUseScope([]queryOperand{op.value}) {
+					return true
+				}
+			case compiledFallbackOp:
+				if operandsUseScope(op.operands) {
+					return true
+				}
+			case compiledConditionalOp:
+				if operandsUseScope(op.branches) {
+					return true
+				}
+				for _, v := range op.cond.variables {
+					if v.name == "" {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// operandsUseScope returns whether any fallback operand or conditional branch
+// references the root or a parent.
+func operandsUseScope(operands []queryOperand) bool {
+	for _, operand := range operands {
+		if operand.query != nil && operand.query.scoped {
+			return true
+		}
+	}
+	return false
+}
+
+// filterKeywords are the mexpr keywords after which a `^` starts a parent
+// reference rather than being a power operator.
+var filterKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "contains": true,
+	"startsWith": true, "endsWith": true, "before": true, "after": true,
+	"where": true,
+}
+
+// replaceParentRefs replaces each `^` parent reference outside of a string
+// with `_`, which mexpr parses as an identifier, e.g. `^^.team` becomes
+// `__.team`. A `^` following an operand is a power operator instead. It
+// returns the rune offsets of the references and how many levels each goes up.
+func replaceParentRefs(expr string) (string, map[uint16]int) {
+	if !strings.Contains(expr, "^") {
+		return expr, nil
+	}
+
+	var refs map[uint16]int
+	b := []byte(expr)
+	quoted := false
+	runes := 0
+	for i := 0; i < len(b); i++ {
+		if b[i] >= utf8.RuneSelf && !utf8.RuneStart(b[i]) {
+			continue
+		}
+		switch {
+		case quoted && b[i] == '\\' && i+1 < len(b):
+			i++
+			runes++
+		case b[i] == '"':
+			quoted = !quoted
+		case !quoted && b[i] == '^' && !followsOperand(b[:i]):
+			if refs == nil {
+				refs = map[uint16]int{}
+			}
+			offset := uint16(runes)
+			for i < len(b) && b[i] == '^' {
+				b[i] = '_'
+				refs[offset]++
+				i++
+				runes++
+			}
+			i--
+			runes--
+		}
+		runes++
+	}
+	return string(b), refs
+}
+
+// followsOperand returns whether the end of a filter expression is an operand,
+// e.g. `2` or `size`, rather than an operator or keyword.
+func followsOperand(before []byte) bool {
+	s := strings.TrimRight(string(before), " \t\r\n")
+	if s == "" {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(s)
+	switch {
+	case last == ')' || last == ']' || last == '"' || last == '@' || last == '$':
+		return true
+	case last == '_' || (last >= '0' && last <= '9'):
+		return true
+	case last >= 'a' && last <= 'z' || last >= 'A' && last <= 'Z' || last >= utf8.RuneSelf:
+		word := s[strings.LastIndexAny(s, " \t\r\n()[],.")+1:]
+		return !filterKeywords[word]
+	}
+	return false
+}
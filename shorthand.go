@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -86,6 +86,28 @@ type MarshalOptions struct {
 	Indent  string
 	Spacer  string
 	UseFile bool
+
+	// MaxWidth lays out pretty-printed output (when `Indent` is set) to fit
+	// within this many characters per line. Objects and arrays which fit on
+	// the rest of the line are written inline, e.g. `tags: [a, b, c]`, while
+	// larger ones get one line per entry. The root object always gets one
+	// line per property. Zero puts every entry on its own line.
+	MaxWidth int
+
+	// MaxCollapse limits how many keys of nested single-property objects are
+	// collapsed into one dotted path like `foo.bar.baz: 1`. Zero means no
+	// limit and one disables collapsing, e.g. `foo{bar{baz: 1}}`.
+	MaxCollapse int
+
+	// RoundTrip guarantees that calling `Unmarshal` on the output returns a
+	// value equal to the input, as long as the input only contains types that
+	// `Unmarshal` produces and strings are valid UTF-8. Floats always include a
+	// decimal point or exponent, time zones are kept, the root object keeps its
+	// braces and strings are quoted whenever they could be misread, including
+	// when parsed with object detection enabled. `NaN`, `+Inf` and `-Inf` are
+	// only read back as floats with `ParseOptions.EnableSpecialFloats`.
+	// `UseFile` is ignored.
+	RoundTrip bool
 }
 
 func (o MarshalOptions) GetIndent(level int) string {
@@ -136,6 +158,15 @@ func shouldQuoteStringValue(s string) bool {
 		containsAnyRune(s, "\"[],{}\n\r\t\\")
 }
 
+// shouldQuoteRoundTrip returns whether a string value needs quotes to be read
+// back as a string when object detection or special floats are enabled.
+func shouldQuoteRoundTrip(s string) bool {
+	if _, ok := coerceSpecialFloat(s); ok {
+		return true
+	}
+	return containsAnyRune(s, ":^")
+}
+
 func renderStringKey(s string) string {
 	if shouldQuoteKey(s) {
 		return quoteString(s)
@@ -143,13 +174,50 @@ func renderStringKey(s string) string {
 	return s
 }
 
-func renderMapKey(k any) string {
+func renderMapKey(options MarshalOptions, k any) string {
 	if s, ok := k.(string); ok {
 		return renderStringKey(s)
 	}
+	if options.RoundTrip {
+		if f, ok := k.(float64); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return renderFloatKey(f)
+		}
+		// Render other keys like values, e.g. `nil` is written as `null`.
+		return renderValue(options, 0, false, k)
+	}
 	return fmt.Sprintf("%v", k)
 }
 
+// renderFloatKey writes a float key without a `.`, which would be read as a
+// path separator, by using an integer mantissa, e.g. `25e-1` for 2.5.
+func renderFloatKey(f float64) string {
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp, _ := strings.Cut(s, "e")
+	e, _ := strconv.Atoi(exp)
+	if whole, fraction, ok := strings.Cut(mantissa, "."); ok {
+		mantissa = whole + fraction
+		e -= len(fraction)
+	}
+	return mantissa + "e" + strconv.Itoa(e)
+}
+
+// renderFloat writes a float so that it is never parsed back as an integer.
+func renderFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
 func Marshal(input any, options ...MarshalOptions) string {
 	if len(options) == 0 {
 		options = []MarshalOptions{{}}
@@ -165,97 +233,71 @@ func MarshalCLI(input any) string {
 	return result
 }
 
-func MarshalPretty(input any) string {
-	return Marshal(input, MarshalOptions{Spacer: " ", Indent: "  "})
+// CLIOptions configures `MarshalCLIArgs`.
+type CLIOptions struct {
+	// FileDir is the directory where strings longer than 50 characters or
+	// containing newlines and all binary data are written, each to a new file
+	// with a unique name which is referenced as `@path`. Parse the arguments
+	// with `EnableFileInput` to load them again. When empty, `@file`
+	// placeholders are used just like `MarshalCLI`.
+	FileDir string
 }
 
-func renderValue(options MarshalOptions, level int, fromKey bool, value any) string {
-	prefix := ""
-	if fromKey {
-		prefix = ":" + options.Spacer
+// MarshalCLIArgs renders input as command-line arguments which, joined by
+// spaces as `GetInput` does, reproduce the input. Each top-level property is
+// its own argument so they can be passed directly to `exec.Command`, or be
+// combined into a single command line with `ShellQuote`.
+func MarshalCLIArgs(input any, options CLIOptions) ([]string, error) {
+	e := encodeState{
+		options: MarshalOptions{Spacer: " ", UseFile: true},
+		fileDir: options.FileDir,
 	}
 
-	// Go uses `nil` so here we hard-code `null` to match JSON/YAML.
-	if value == nil {
-		return prefix + "null"
-	}
-
-	switch v := value.(type) {
-	case map[any]any:
-		// Special case: foo.bar: 1
-		if len(v) == 1 {
-			dot := ""
-			if fromKey {
-				dot = "."
-			}
-			for k := range v {
-				return dot + renderMapKey(k) + renderValue(options, level, true, v[k])
-			}
-		}
-
-		// Normal case: foo{a: 1, b: 2}
-		keys := make([]any, 0, len(v))
-
-		for k := range v {
-			keys = append(keys, k)
+	input = normalizeValue(input)
+	keys, values := objectFields(e.options, input)
+	if len(keys) < 2 {
+		// Scalars, arrays and single properties are a single argument.
+		e.value(0, false, input)
+		out := string(e.buf)
+		if strings.HasPrefix(out, "{") && out != "{}" {
+			out = out[1 : len(out)-1]
 		}
+		return []string{out}, e.err
+	}
 
-		sort.Slice(keys, func(i, j int) bool {
-			return fmt.Sprintf("%v", keys[i]) < fmt.Sprintf("%v", keys[j])
-		})
-
-		fields := make([]string, 0, len(v))
-		for _, k := range keys {
-			fields = append(fields, renderMapKey(k)+renderValue(options, level+1, true, v[k]))
-		}
-
-		return "{" + options.GetIndent(level+1) + strings.Join(fields, options.GetSeparator(level+1)) + options.GetIndent(level) + "}"
-	case map[string]any:
-		// Special case: foo.bar: 1
-		if len(v) == 1 {
-			dot := ""
-			if fromKey {
-				dot = "."
-			}
-			for k := range v {
-				return dot + renderStringKey(k) + renderValue(options, level, true, v[k])
-			}
-		}
-
-		// Normal case: foo{a: 1, b: 2}
-		keys := make([]string, 0, len(v))
-
-		for k := range v {
-			keys = append(keys, k)
-		}
-
-		sort.Strings(keys)
-
-		fields := make([]string, 0, len(v))
-		for _, k := range keys {
-			fields = append(fields, renderStringKey(k)+renderValue(options, level+1, true, v[k]))
+	args := make([]string, len(keys))
+	for i, k := range keys {
+		e.buf = e.buf[:0]
+		e.writeString(k)
+		e.value(1, true, values[i])
+		if i < len(keys)-1 {
+			e.writeByte(',')
 		}
+		args[i] = string(e.buf)
+	}
+	return args, e.err
+}
 
-		return "{" + options.GetIndent(level+1) + strings.Join(fields, options.GetSeparator(level+1)) + options.GetIndent(level) + "}"
-	case []any:
-		items := make([]string, 0, len(v))
-
-		// Normal case: foo: [1, true, {id: 1, count: 2}]
-		for _, item := range v {
-			items = append(items, renderValue(options, level+1, false, item))
+// ShellQuote joins arguments into a single command line, quoting each one
+// as needed for POSIX shells.
+func ShellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+			quoted[i] = arg
+			continue
 		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
 
-		return prefix + "[" + options.GetIndent(level+1) + strings.Join(items, options.GetSeparator(level+1)) + options.GetIndent(level) + "]"
-	default:
-		if s, ok := v.(string); ok {
-			if options.UseFile && (len(s) > 50 || strings.Contains(s, "\n")) {
-				// Long strings are represented as being loaded from files.
-				v = "@file"
-			} else if shouldQuoteStringValue(s) {
-				v = quoteString(s)
-			}
-		}
+func MarshalPretty(input any) string {
+	return Marshal(input, MarshalOptions{Spacer: " ", Indent: "  "})
+}
 
-		return fmt.Sprintf("%s%v", prefix, v)
-	}
+func renderValue(options MarshalOptions, level int, fromKey bool, value any) string {
+	e := encodeState{options: options}
+	e.value(level, fromKey, value)
+	return string(e.buf)
 }
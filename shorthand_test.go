@@ -3,8 +3,13 @@ package shorthand
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -270,6 +275,178 @@ func TestMarshalPretty(t *testing.T) {
 }`, result)
 }
 
+var maxWidthExamples = []struct {
+	Name     string
+	Input    any
+	Width    int
+	Collapse int
+	Output   string
+}{
+	{
+		Name:   "Fits",
+		Input:  map[string]any{"id": 1, "tags": []any{"a", "b", "c"}},
+		Width:  20,
+		Output: "{\n  id: 1\n  tags: [a, b, c]\n}",
+	},
+	{
+		Name:   "Breaks arrays",
+		Input:  map[string]any{"id": 1, "tags": []any{"one", "two", "three"}},
+		Width:  20,
+		Output: "{\n  id: 1\n  tags: [\n    one,\n    two,\n    three\n  ]\n}",
+	},
+	{
+		Name:   "Trailing comma counts",
+		Input:  []any{[]any{1, 2}, 3},
+		Width:  8,
+		Output: "[\n  [\n    1,\n    2\n  ],\n  3\n]",
+	},
+	{
+		Name:  "Nested",
+		Input: map[string]any{"a": map[string]any{"b": []any{1, 2}, "c": map[string]any{"d": strings.Repeat("x", 30), "e": true}}, "f": 1},
+		Width: 30,
+		Output: `{
+  a{
+    b: [1, 2]
+    c{
+      d: xxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
+      e: true
+    }
+  }
+  f: 1
+}`,
+	},
+	{
+		Name:   "Root array",
+		Input:  []any{1, 2, 3},
+		Width:  80,
+		Output: "[1, 2, 3]",
+	},
+	{
+		Name:   "Root single key",
+		Input:  map[string]any{"a": map[string]any{"b": 1, "c": 2}},
+		Width:  80,
+		Output: "a{b: 1, c: 2}",
+	},
+	{
+		Name:     "No collapse",
+		Input:    map[string]any{"a": map[string]any{"b": map[string]any{"c": 1}}, "d": 1},
+		Width:    80,
+		Collapse: 1,
+		Output:   "{\n  a{b{c: 1}}\n  d: 1\n}",
+	},
+	{
+		Name:     "Limited collapse",
+		Input:    map[string]any{"a": map[string]any{"b": map[string]any{"c": map[string]any{"d": 1}}}, "e": 1},
+		Width:    80,
+		Collapse: 2,
+		Output:   "{\n  a.b{c.d: 1}\n  e: 1\n}",
+	},
+}
+
+func TestMarshalMaxWidth(t *testing.T) {
+	for _, example := range maxWidthExamples {
+		t.Run(example.Name, func(t *testing.T) {
+			out := Marshal(example.Input, MarshalOptions{Spacer: " ", Indent: "  ", MaxWidth: example.Width, MaxCollapse: example.Collapse})
+			assert.Equal(t, example.Output, out)
+
+			result, err := Unmarshal(out, ParseOptions{EnableObjectDetection: true}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, example.Input, result)
+		})
+	}
+}
+
+type marshalEmbedded struct {
+	Created time.Time `json:"created"`
+}
+
+type marshalStatus int
+
+func (s marshalStatus) MarshalText() ([]byte, error) {
+	return []byte([]string{"inactive", "active"}[s]), nil
+}
+
+type marshalVersion struct {
+	Major, Minor int
+}
+
+func (v *marshalVersion) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%d.%d"`, v.Major, v.Minor)), nil
+}
+
+type marshalRequest struct {
+	marshalEmbedded
+	ID       int               `json:"id"`
+	Name     string            `json:"name"`
+	Tags     []string          `json:"tags,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Data     []byte            `json:"data,omitempty"`
+	Status   marshalStatus     `json:"status"`
+	Version  *marshalVersion   `json:"version,omitempty"`
+	Parent   *marshalRequest   `json:"parent,omitempty"`
+	Ignored  string            `json:"-"`
+	Untagged bool
+	private  string
+}
+
+func TestMarshalReflection(t *testing.T) {
+	created, err := time.Parse(time.RFC3339, "2022-01-02T03:04:05Z")
+	require.NoError(t, err)
+
+	input := marshalRequest{
+		marshalEmbedded: marshalEmbedded{Created: created},
+		ID:              1,
+		Name:            "foo",
+		Tags:            []string{"a", "b"},
+		Labels:          map[string]string{"env": "prod", "app": "web"},
+		Data:            []byte{0xc2},
+		Status:          1,
+		Version:         &marshalVersion{1, 2},
+		Ignored:         "ignored",
+		private:         "private",
+	}
+
+	out := MarshalCLI(input)
+	assert.Equal(t, `id: 1, name: foo, tags: [a, b], labels{app: web, env: prod}, data: %wg==, status: active, version: "1.2", Untagged: false, created: 2022-01-02T03:04:05Z`, out)
+
+	result, err := Unmarshal(out, ParseOptions{EnableObjectDetection: true}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"id":       1,
+		"name":     "foo",
+		"tags":     []any{"a", "b"},
+		"labels":   map[string]any{"app": "web", "env": "prod"},
+		"data":     []byte{0xc2},
+		"status":   "active",
+		"version":  "1.2",
+		"Untagged": false,
+		"created":  created,
+	}, result)
+}
+
+func TestMarshalReflectionTypes(t *testing.T) {
+	type named string
+	var nilPtr *marshalRequest
+	var nilSlice []int
+	opts := MarshalOptions{Spacer: " "}
+
+	assert.Equal(t, "[1, 2, 3]", Marshal([]int{1, 2, 3}, opts))
+	assert.Equal(t, "[1, 2]", Marshal([2]float32{1, 2}, opts))
+	assert.Equal(t, "{1: a, 2: b}", Marshal(map[int]string{2: "b", 1: "a"}, opts))
+	assert.Equal(t, `[a, "true"]`, Marshal([]named{"a", "true"}, opts))
+	assert.Equal(t, "null", Marshal(nilPtr, opts))
+	assert.Equal(t, "null", Marshal(nilSlice, opts))
+	assert.Equal(t, "x: 5", Marshal(map[string]*int{"x": func() *int { i := 5; return &i }()}, opts))
+	assert.Equal(t, "2022-01-02T03:04:05.5Z", Marshal(time.Date(2022, 1, 2, 3, 4, 5, 500000000, time.UTC), opts))
+	assert.Equal(t, "{}", Marshal(struct{}{}, opts))
+	assert.Equal(t, "{n: 5, big: 12345678901234567890, exp: -1.5e+10, empty: 0}", Marshal(struct {
+		N     json.Number  `json:"n"`
+		Big   json.Number  `json:"big"`
+		Exp   *json.Number `json:"exp"`
+		Empty json.Number  `json:"empty"`
+	}{"5", "12345678901234567890", func() *json.Number { n := json.Number("-1.5e+10"); return &n }(), ""}, opts))
+}
+
 func TestMarshalRoundTripReservedCharacters(t *testing.T) {
 	input := map[string]any{
 		"a.b":       1,
@@ -290,6 +467,100 @@ func TestMarshalRoundTripReservedCharacters(t *testing.T) {
 	assert.Equal(t, input, result)
 }
 
+var roundTripExamples = []struct {
+	Name   string
+	Input  any
+	Output string
+}{
+	{Name: "Float", Input: 1.0, Output: "1.0"},
+	{Name: "Negative zero", Input: math.Copysign(0, -1), Output: "-0.0"},
+	{Name: "Exponent", Input: 1e21, Output: "1e+21"},
+	{Name: "NaN", Input: math.NaN(), Output: "NaN"},
+	{Name: "Infinity", Input: []any{math.Inf(1), math.Inf(-1)}, Output: "[+Inf,-Inf]"},
+	{Name: "Special float strings", Input: []any{"NaN", "+Inf"}, Output: `["NaN","+Inf"]`},
+	{Name: "UTC time", Input: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC), Output: "2022-01-02T03:04:05Z"},
+	{Name: "Zero offset time", Input: time.Date(2022, 1, 2, 3, 4, 5, 0, time.FixedZone("", 0)), Output: "2022-01-02T03:04:05+00:00"},
+	{Name: "Offset time", Input: time.Date(2022, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600)), Output: "2022-01-02T03:04:05+01:00"},
+	{Name: "Root single key", Input: map[string]any{"a": map[string]any{"b": 1}}, Output: "{a{b:1}}"},
+	{Name: "Array single key", Input: []any{map[string]any{"a": 1}}, Output: "[{a:1}]"},
+	{Name: "Empty containers", Input: map[string]any{"a": map[string]any{}, "b": []any{}}, Output: "{a{},b:[]}"},
+	{Name: "Object-like string", Input: "a: b", Output: `"a: b"`},
+	{Name: "Swap-like string", Input: "a ^ b", Output: `"a ^ b"`},
+	{Name: "Map keys", Input: map[any]any{"1": true, 1: false, 1.0: nil, nil: "n"}, Output: `{1e0:null,1:false,"1":true,null:n}`},
+	{Name: "Fractional float key", Input: map[any]any{2.5: 1, -0.125: 2}, Output: `{-125e-3:2,25e-1:1}`},
+	{Name: "Long string", Input: strings.Repeat("a", 60), Output: strings.Repeat("a", 60)},
+	{Name: "Bytes", Input: []byte{}, Output: "%"},
+	{Name: "Backslash key", Input: map[string]any{`a\b`: 1, `0\`: 2}, Output: `{"0\\":2,"a\\b":1}`},
+}
+
+// roundTripEqual is like `reflect.DeepEqual` but treats NaN as equal to
+// itself and compares times by instant and offset rather than location.
+func roundTripEqual(a, b any) bool {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		return ok && (av == bv && math.Signbit(av) == math.Signbit(bv) || math.IsNaN(av) && math.IsNaN(bv))
+	case time.Time:
+		bv, ok := b.(time.Time)
+		_, aOffset := av.Zone()
+		_, bOffset := bv.Zone()
+		return ok && av.Equal(bv) && aOffset == bOffset && (av.Location() == time.UTC) == (bv.Location() == time.UTC)
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !roundTripEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if other, ok := bv[k]; !ok || !roundTripEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	case map[any]any:
+		if len(av) == 0 {
+			// Empty objects are always read back as `map[string]any`.
+			return isMap(b) && reflect.ValueOf(b).Len() == 0
+		}
+		bv, ok := b.(map[any]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if other, ok := bv[k]; !ok || !roundTripEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, example := range roundTripExamples {
+		t.Run(example.Name, func(t *testing.T) {
+			out := Marshal(example.Input, MarshalOptions{RoundTrip: true, UseFile: true})
+			assert.Equal(t, example.Output, out)
+
+			for _, detect := range []bool{false, true} {
+				result, err := Unmarshal(out, ParseOptions{EnableObjectDetection: detect, EnableSpecialFloats: true}, nil)
+				require.NoError(t, err)
+				assert.True(t, roundTripEqual(example.Input, result), "object detection %v: %#v", detect, result)
+			}
+		})
+	}
+}
+
 func TestMarshalCLIEmptyMap(t *testing.T) {
 	out := MarshalCLI(map[string]any{})
 	assert.Equal(t, "{}", out)
@@ -298,6 +569,58 @@ func TestMarshalCLIEmptyMap(t *testing.T) {
 	assert.Equal(t, map[string]any{}, result)
 }
 
+func TestMarshalCLIArgs(t *testing.T) {
+	dir := t.TempDir()
+	input := map[string]any{
+		"id":     1,
+		"name":   "it's me",
+		"body":   "line one\nline two",
+		"binary": []byte{0xff, 0x00},
+		"text":   []byte("hello"),
+		"nested": map[string]any{"tags": []any{"a", "b"}},
+	}
+
+	args, err := MarshalCLIArgs(input, CLIOptions{FileDir: dir})
+	require.NoError(t, err)
+	require.Len(t, args, len(input))
+	assert.Equal(t, "id: 1,", args[2])
+	assert.Equal(t, "name: it's me,", args[3])
+	assert.Equal(t, "nested.tags: [a, b],", args[4])
+	assert.Regexp(t, `^body: @.+/value-\d+\.txt,$`, args[1])
+
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 3)
+
+	result, err := Unmarshal(strings.Join(args, " "), ParseOptions{
+		EnableFileInput:       true,
+		EnableObjectDetection: true,
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, input, result)
+}
+
+func TestMarshalCLIArgsSingle(t *testing.T) {
+	for _, example := range marshalExamples {
+		if m, ok := example.Input.(map[string]any); ok && len(m) > 1 {
+			continue
+		}
+		t.Run(example.Name, func(t *testing.T) {
+			args, err := MarshalCLIArgs(example.Input, CLIOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, []string{example.Output}, args)
+		})
+	}
+}
+
+func TestMarshalCLIArgsFileError(t *testing.T) {
+	_, err := MarshalCLIArgs([]byte("hello"), CLIOptions{FileDir: filepath.Join(t.TempDir(), "missing")})
+	require.Error(t, err)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `id: 1, 'name: it'\''s me,' '' 'a b' tags: '[a]'`, ShellQuote([]string{"id:", "1,", "name: it's me,", "", "a b", "tags:", "[a]"}))
+}
+
 func TestQuoteStringFallbackOnMarshalError(t *testing.T) {
 	prev := marshalString
 	marshalString = func(any) ([]byte, error) {
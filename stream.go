@@ -0,0 +1,184 @@
+package shorthand
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// StreamFormat sets how records are read from a stream.
+type StreamFormat int
+
+const (
+	// StreamLines reads one shorthand or JSON record per line, e.g. JSON Lines.
+	// Blank lines are skipped.
+	StreamLines StreamFormat = iota
+
+	// StreamCBOR reads a CBOR sequence, i.e. CBOR items one after another.
+	StreamCBOR
+)
+
+// DefaultMaxRecordSize is the default maximum size of a line in bytes when
+// reading `StreamLines` records.
+const DefaultMaxRecordSize = 64 * 1024 * 1024
+
+// StreamOptions configures `StreamQuery`.
+type StreamOptions struct {
+	// Format of the records in the stream.
+	Format StreamFormat
+
+	// ParseOptions are used to parse each `StreamLines` record.
+	ParseOptions ParseOptions
+
+	// GetOptions are used to run the query against each record.
+	GetOptions GetOptions
+
+	// Slurp reads every record into an array and runs the query once against
+	// it, e.g. to use `length()` or `countBy(status)` across all records. Memory
+	// use grows with the size of the stream.
+	Slurp bool
+
+	// MaxRecordSize limits the size of a `StreamLines` record in bytes.
+	// Defaults to `DefaultMaxRecordSize`.
+	MaxRecordSize int
+}
+
+// RecordError is returned by `StreamQuery` when a record can't be read or
+// queried. Records are numbered from 1.
+type RecordError struct {
+	Record int
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Record, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// StreamQuery reads records from `r` one at a time, runs the query against
+// each, and calls `fn` with every result that is found. Only one record is in
+// memory at a time unless `Slurp` is set. Use an `Encoder` to write results:
+//
+//	enc := shorthand.NewEncoder(os.Stdout, shorthand.MarshalOptions{})
+//	err := shorthand.StreamQuery(os.Stdin, query, shorthand.StreamOptions{}, enc.Encode)
+//
+// A nil query passes each record, or the slurped array, to `fn` unchanged.
+// Reading stops at the first error, including any returned by `fn`.
+func StreamQuery(r io.Reader, query *Query, options StreamOptions, fn func(result any) error) error {
+	var records []any
+
+	handle := func(record int, value any) error {
+		if options.Slurp {
+			records = append(records, value)
+			return nil
+		}
+		if query == nil {
+			return fn(value)
+		}
+		result, found, err := query.Exec(value, options.GetOptions)
+		if err != nil {
+			return &RecordError{Record: record, Err: err}
+		}
+		if !found {
+			return nil
+		}
+		return fn(result)
+	}
+
+	var err error
+	switch options.Format {
+	case StreamLines:
+		err = streamLines(r, options, handle)
+	case StreamCBOR:
+		err = streamCBOR(r, handle)
+	default:
+		err = fmt.Errorf("unknown stream format %d", options.Format)
+	}
+	if err != nil || !options.Slurp {
+		return err
+	}
+
+	if records == nil {
+		records = []any{}
+	}
+	if query == nil {
+		return fn(records)
+	}
+	result, found, qerr := query.Exec(records, options.GetOptions)
+	if qerr != nil {
+		return qerr
+	}
+	if !found {
+		return nil
+	}
+	return fn(result)
+}
+
+// streamLines parses each non-blank line as a record.
+func streamLines(r io.Reader, options StreamOptions, handle func(int, any) error) error {
+	maxSize := options.MaxRecordSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxRecordSize
+	}
+
+	// The buffer grows as needed up to the max, but the initial capacity
+	// also counts toward the limit so must not exceed it.
+	initialSize := 64 * 1024
+	if initialSize > maxSize {
+		initialSize = maxSize
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, initialSize), maxSize)
+
+	record := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record++
+		if !utf8.Valid(line) {
+			return &RecordError{Record: record, Err: ErrInvalidFile}
+		}
+		value, err := Unmarshal(string(line), options.ParseOptions, nil)
+		if err != nil {
+			return &RecordError{Record: record, Err: err}
+		}
+		if err := handle(record, value); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return &RecordError{Record: record + 1, Err: fmt.Errorf("record is larger than %d bytes", maxSize)}
+		}
+		return err
+	}
+	return nil
+}
+
+// streamCBOR decodes each item of a CBOR sequence as a record.
+func streamCBOR(r io.Reader, handle func(int, any) error) error {
+	decoder := cbor.NewDecoder(r)
+	for record := 1; ; record++ {
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return &RecordError{Record: record, Err: err}
+		}
+		if err := handle(record, value); err != nil {
+			return err
+		}
+	}
+}
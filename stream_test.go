@@ -0,0 +1,152 @@
+package shorthand
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamQuery(t *testing.T) {
+	input := strings.Join([]string{
+		`{"id": 1, "status": "ok"}`,
+		``,
+		`id: 2, status: err`,
+		`{"id": 3, "status": "ok"}`,
+		`{"other": true}`,
+	}, "\n")
+
+	for _, example := range []struct {
+		Name    string
+		Query   string
+		Slurp   bool
+		Results []any
+	}{
+		{Name: "Per record", Query: `id`, Results: []any{1, 2, 3}},
+		{Name: "Field selection", Query: `{status}`, Results: []any{
+			map[string]any{"status": "ok"},
+			map[string]any{"status": "err"},
+			map[string]any{"status": "ok"},
+			map[string]any{"status": nil},
+		}},
+		{Name: "Slurp", Query: `length()`, Slurp: true, Results: []any{4}},
+		{Name: "Slurp aggregation", Query: `countBy(status)`, Slurp: true, Results: []any{
+			map[string]any{"ok": 2, "err": 1, "null": 1},
+		}},
+	} {
+		t.Run(example.Name, func(t *testing.T) {
+			query, qerr := CompileQuery(example.Query)
+			require.NoError(t, qerr)
+
+			results := []any{}
+			err := StreamQuery(strings.NewReader(input), query, StreamOptions{
+				Slurp:        example.Slurp,
+				ParseOptions: ParseOptions{EnableObjectDetection: true},
+			}, func(result any) error {
+				results = append(results, result)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, example.Results, results)
+		})
+	}
+}
+
+func TestStreamQueryCBOR(t *testing.T) {
+	var buf bytes.Buffer
+	for _, v := range []any{map[string]any{"id": 1}, map[string]any{"id": 2}} {
+		b, err := cbor.Marshal(v)
+		require.NoError(t, err)
+		buf.Write(b)
+	}
+
+	query, err := CompileQuery(`id`)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	enc := NewEncoder(&out, MarshalOptions{})
+	require.NoError(t, StreamQuery(bytes.NewReader(buf.Bytes()), query, StreamOptions{Format: StreamCBOR}, enc.Encode))
+	assert.Equal(t, "1\n2\n", out.String())
+
+	// Without a query records pass through unchanged.
+	out.Reset()
+	require.NoError(t, StreamQuery(bytes.NewReader(buf.Bytes()), nil, StreamOptions{Format: StreamCBOR}, enc.Encode))
+	assert.Equal(t, "id:1\nid:2\n", out.String())
+
+	out.Reset()
+	require.NoError(t, StreamQuery(bytes.NewReader(buf.Bytes()), nil, StreamOptions{Format: StreamCBOR, Slurp: true}, enc.Encode))
+	assert.Equal(t, "[{id:1},{id:2}]\n", out.String())
+}
+
+func TestStreamQueryErrors(t *testing.T) {
+	query, qerr := CompileQuery(`id`)
+	require.NoError(t, qerr)
+	ignore := func(any) error { return nil }
+
+	err := StreamQuery(strings.NewReader("{\"id\": 1}\n{\"id\": 2\n"), query, StreamOptions{}, ignore)
+	var recordErr *RecordError
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 2, recordErr.Record)
+
+	err = StreamQuery(strings.NewReader("{\"id\": 1}\n"+strings.Repeat("a", 100)+"\n"), query, StreamOptions{MaxRecordSize: 50}, ignore)
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 2, recordErr.Record)
+	assert.Contains(t, err.Error(), "larger than 50 bytes")
+
+	err = StreamQuery(bytes.NewReader([]byte{0xa1, 0x62}), query, StreamOptions{Format: StreamCBOR}, ignore)
+	require.ErrorAs(t, err, &recordErr)
+	assert.Equal(t, 1, recordErr.Record)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = StreamQuery(strings.NewReader("id: 1\nid: 2\n"), query, StreamOptions{
+		ParseOptions: ParseOptions{EnableObjectDetection: true},
+	}, func(any) error {
+		calls++
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+}
+
+// TestStreamQueryBounded checks that records are handled as they are read
+// rather than after reading the whole stream.
+func TestStreamQueryBounded(t *testing.T) {
+	query, err := CompileQuery(`id`)
+	require.NoError(t, err)
+
+	r := &recordReader{remaining: 100000}
+	count := 0
+	require.NoError(t, StreamQuery(r, query, StreamOptions{}, func(result any) error {
+		count++
+		assert.Less(t, r.read-count, 1000, "too many records read ahead")
+		return nil
+	}))
+	assert.Equal(t, 100000, count)
+}
+
+// recordReader generates JSON Lines records on demand.
+type recordReader struct {
+	remaining int
+	read      int
+	pending   []byte
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		r.remaining--
+		r.read++
+		r.pending = []byte(`{"id": 1}` + "\n")
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,183 @@
+package shorthand
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/danielgtaylor/mexpr"
+)
+
+// comparisonNodes are the filter operators whose right side may be an
+// unquoted string, e.g. `status == down`. An identifier there is never
+// required to be a property, even in strict mode.
+var comparisonNodes = map[mexpr.NodeType]bool{
+	mexpr.NodeEqual:            true,
+	mexpr.NodeNotEqual:         true,
+	mexpr.NodeLessThan:         true,
+	mexpr.NodeLessThanEqual:    true,
+	mexpr.NodeGreaterThan:      true,
+	mexpr.NodeGreaterThanEqual: true,
+	mexpr.NodeContains:         true,
+	mexpr.NodeStartsWith:       true,
+	mexpr.NodeEndsWith:         true,
+	mexpr.NodeBefore:           true,
+	mexpr.NodeAfter:            true,
+}
+
+// requiredProperties finds the identifiers of a filter which must be
+// properties of each item in strict mode, e.g. `nmae` in `nmae == bob`. This
+// is every identifier except unquoted strings on the right of a comparison or
+// the left of `in`, built-ins like `@` and `length`, function names, the
+// properties selected by `.` or `where`, and variables. Without strict mode a
+// missing property is an unquoted string, so e.g. `items[active]` would match
+// every item without an `active` property.
+func requiredProperties(ast *mexpr.Node, variables []filterVariable, required []*mexpr.Node) []*mexpr.Node {
+	if ast == nil {
+		return required
+	}
+
+	switch ast.Type {
+	case mexpr.NodeIdentifier:
+		for _, v := range variables {
+			if v.node == ast {
+				return required
+			}
+		}
+		switch ast.Value.(string) {
+		case "@", "length", "lower", "upper":
+			return required
+		}
+		return append(required, ast)
+	case mexpr.NodeLiteral:
+		return required
+	case mexpr.NodeFieldSelect, mexpr.NodeWhere:
+		// The right side is relative to the left, which strict mode checks
+		// when the filter runs.
+		return requiredProperties(ast.Left, variables, required)
+	case mexpr.NodeFunctionCall:
+		if params, ok := ast.Value.([]mexpr.Node); ok {
+			for i := range params {
+				required = requiredProperties(&params[i], variables, required)
+			}
+		}
+		return required
+	case mexpr.NodeIn:
+		if ast.Left == nil || ast.Left.Type != mexpr.NodeIdentifier {
+			required = requiredProperties(ast.Left, variables, required)
+		}
+		return requiredProperties(ast.Right, variables, required)
+	}
+
+	required = requiredProperties(ast.Left, variables, required)
+	if comparisonNodes[ast.Type] && ast.Right != nil && ast.Right.Type == mexpr.NodeIdentifier {
+		return required
+	}
+	return requiredProperties(ast.Right, variables, required)
+}
+
+// missingProperty returns the first required property which an item doesn't
+// have, or nil if it has all of them.
+func missingProperty(required []*mexpr.Node, item any) *mexpr.Node {
+	for _, node := range required {
+		name := node.Value.(string)
+		switch m := item.(type) {
+		case map[string]any:
+			if _, ok := m[name]; ok {
+				continue
+			}
+		case map[any]any:
+			if _, ok := m[name]; ok {
+				continue
+			}
+		}
+		return node
+	}
+	return nil
+}
+
+// describeItem describes a filtered item for an error message, listing the
+// keys of maps rather than their values.
+func describeItem(item any) string {
+	var keys []string
+	switch m := item.(type) {
+	case map[string]any:
+		keys = mapKeys(m)
+	case map[any]any:
+		for k := range m {
+			keys = append(keys, fmt.Sprintf("%v", k))
+		}
+	default:
+		return fmt.Sprintf("%v", item)
+	}
+	sort.Strings(keys)
+	return "map with keys [" + strings.Join(keys, ", ") + "]"
+}
+
+// Errors is every error found by a strict query with `CollectErrors` set, in
+// the order the failing items were checked. Its position is that of the
+// first error.
+type Errors []Error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Unwrap returns the errors so that they can be checked with `errors.Is` and
+// `errors.As`.
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (e Errors) Offset() uint {
+	return e[0].Offset()
+}
+
+func (e Errors) Length() uint {
+	return e[0].Length()
+}
+
+func (e Errors) Pretty() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Pretty()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// withErrors sets up collecting the errors of failed items when strict mode
+// collects them, unless the query is nested within another which it then
+// collects for. The returned errors are owned by this query.
+func (options GetOptions) withErrors() (GetOptions, *Errors) {
+	if !options.Strict || !options.CollectErrors || options.errors != nil {
+		return options, nil
+	}
+	options.errors = &Errors{}
+	return options, options.errors
+}
+
+// err returns the collected errors, or nil if there are none.
+func (e *Errors) err() Error {
+	if e == nil || len(*e) == 0 {
+		return nil
+	}
+	return *e
+}
+
+// failItem returns the error of an item which failed a strict filter, or
+// collects it and returns nil so the item is skipped.
+func (options GetOptions) failItem(err Error) Error {
+	if options.errors == nil {
+		return err
+	}
+	*options.errors = append(*options.errors, err)
+	return nil
+}
@@ -0,0 +1,523 @@
+package shorthand
+
+import (
+	"strings"
+	"unicode"
+)
+
+// syntaxKind describes the type of a node in a parsed source syntax tree.
+type syntaxKind int
+
+const (
+	syntaxScalar syntaxKind = iota
+	syntaxQuoted
+	syntaxObject
+	syntaxArray
+)
+
+// syntaxComment is a single `// ...` line comment from the source.
+type syntaxComment struct {
+	start       uint
+	text        string
+	blankBefore bool
+}
+
+// syntaxNode is a value in the source syntax tree. Unlike the operations
+// produced by `Document.Parse`, the syntax tree keeps track of where every
+// value, key and comment lives in the original source so that it can be
+// edited or reformatted without losing information.
+type syntaxNode struct {
+	kind  syntaxKind
+	start uint
+	end   uint
+
+	// braced is false only for a top-level object without the outer `{` and
+	// `}`, see `ParseOptions.EnableObjectDetection`.
+	braced bool
+
+	// multiline is true when the first entry of an object or array starts on a
+	// new line after the opening bracket.
+	multiline bool
+
+	// entries holds object properties or array items.
+	entries []*syntaxEntry
+
+	// commaOnly is true for an object with commas but no properties, like
+	// `{,}`, which unlike `{}` doesn't create an object.
+	commaOnly bool
+
+	// leading comments come before the value, while trailing comments come
+	// after the last entry of an object or array (or after the document).
+	leading  []syntaxComment
+	trailing []syntaxComment
+
+	// after holds comments following the top-level value of the document.
+	after []syntaxComment
+}
+
+// syntaxEntry is an object property or an array item.
+type syntaxEntry struct {
+	leading     []syntaxComment
+	blankBefore bool
+
+	// start is the offset of the key for objects, or the value for arrays.
+	start uint
+
+	// key is the raw source text of the key, e.g. `foo.bar[0]` or `"a.b"`,
+	// and keyEnd is the offset just after it. Array items have no key.
+	key    string
+	keyEnd uint
+	parts  []pathPart
+
+	// sep is the character separating the key from the value, one of `:`,
+	// `{` or `^` (swap).
+	sep   rune
+	value *syntaxNode
+
+	comma    bool
+	commaPos uint
+
+	// comment is a trailing comment on the same line as the entry.
+	comment *syntaxComment
+}
+
+// end returns the offset just after the entry's value and optional comma.
+func (e *syntaxEntry) end() uint {
+	if e.comma && e.commaPos >= e.value.end {
+		return e.commaPos + 1
+	}
+	return e.value.end
+}
+
+// lineEnd returns the offset just after the entry including any comment on
+// the same line.
+func (e *syntaxEntry) lineEnd() uint {
+	if e.comment != nil {
+		return e.comment.start + uint(len(e.comment.text))
+	}
+	return e.end()
+}
+
+// leadingStart returns the offset of the first leading comment, or the entry
+// itself if there are no leading comments.
+func (e *syntaxEntry) leadingStart() uint {
+	if len(e.leading) > 0 {
+		return e.leading[0].start
+	}
+	return e.start
+}
+
+// pathPart is a single key or index from an operation path like
+// `foo.bar[0]`.
+type pathPart struct {
+	raw    string
+	key    string
+	quoted bool
+	index  bool
+}
+
+// trimKey trims whitespace around a raw key, keeping whitespace escaped by
+// a trailing backslash like `a\ `.
+func trimKey(key string) string {
+	trimmed := strings.TrimRight(key, " \t\r\n")
+	backslashes := len(trimmed) - len(strings.TrimRight(trimmed, "\\"))
+	if backslashes%2 == 1 && len(trimmed) < len(key) {
+		trimmed = key[:len(trimmed)+1]
+	}
+	return strings.TrimLeft(trimmed, " \t\r\n")
+}
+
+// splitPath splits a path as produced by `parseProp` into its parts. The raw
+// text of each part is kept so that a path can be reassembled exactly.
+func splitPath(path string) []pathPart {
+	parts := []pathPart{}
+	var key strings.Builder
+	start := 0
+	quoted := false
+
+	flush := func(end int) {
+		if end > start || quoted {
+			parts = append(parts, pathPart{
+				raw:    path[start:end],
+				key:    key.String(),
+				quoted: quoted,
+			})
+		}
+		key.Reset()
+		quoted = false
+	}
+
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '\\':
+			if i+1 < len(path) {
+				i++
+				key.WriteByte(path[i])
+			}
+		case '"':
+			quoted = true
+			for i++; i < len(path) && path[i] != '"'; i++ {
+				if path[i] == '\\' && i+1 < len(path) {
+					i++
+				}
+				key.WriteByte(path[i])
+			}
+		case '.':
+			flush(i)
+			start = i + 1
+		case '[':
+			flush(i)
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				end = len(path) - i - 1
+			}
+			parts = append(parts, pathPart{
+				raw:   path[i : i+end+1],
+				key:   path[i+1 : i+end],
+				index: true,
+			})
+			i += end
+			start = i + 1
+			if start < len(path) && path[start] == '.' {
+				i++
+				start++
+			}
+		default:
+			key.WriteByte(c)
+		}
+	}
+	flush(len(path))
+
+	return parts
+}
+
+// joinPath reassembles path parts into a path string.
+func joinPath(parts []pathPart) string {
+	var sb strings.Builder
+	for i, part := range parts {
+		if i > 0 && !part.index {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(part.raw)
+	}
+	return sb.String()
+}
+
+// equal returns whether two path parts refer to the same key or index.
+func (p pathPart) equal(other pathPart) bool {
+	return p.index == other.index && p.quoted == other.quoted && p.key == other.key
+}
+
+// hasPathPrefix returns whether `prefix` is a prefix of (or equal to) `parts`.
+func hasPathPrefix(parts, prefix []pathPart) bool {
+	if len(prefix) > len(parts) {
+		return false
+	}
+	for i := range prefix {
+		if !parts[i].equal(prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSyntax parses shorthand or JSON source into a syntax tree. The input
+// should already be known to be valid, e.g. by calling `Document.Parse`, as
+// the syntax tree parser is more lenient than the real one.
+func parseSyntax(input string, options ParseOptions) (*syntaxNode, Error) {
+	d := Document{options: options, expression: input}
+
+	braced := true
+	if options.EnableObjectDetection && d.detectObject() {
+		braced = false
+	}
+
+	comments, _ := d.collectTrivia()
+
+	var root *syntaxNode
+	if !braced || (options.EnableObjectDetection && d.peek() == -1) {
+		root = &syntaxNode{kind: syntaxObject, start: d.pos}
+		d.pos = 0
+		if err := d.parseSyntaxEntries(root, -1); err != nil {
+			return nil, err
+		}
+		root.end = uint(len(strings.TrimRightFunc(input, unicode.IsSpace)))
+		if root.start > root.end {
+			root.start = root.end
+		}
+		root.multiline = strings.Contains(input[:root.end], "\n") || strings.HasSuffix(input, "\n")
+		return root, nil
+	}
+
+	root, err := d.parseSyntaxValue(false)
+	if err != nil {
+		return nil, err
+	}
+	root.leading = comments
+	root.after, _ = d.collectTrivia()
+	root.braced = true
+	if d.peek() != -1 {
+		return nil, d.error(1, "Expected EOF but found additional input: %s", runeStr(d.peek()))
+	}
+	return root, nil
+}
+
+// collectTrivia skips whitespace and comments, returning the comments found
+// and whether a blank line was found after the last one.
+func (d *Document) collectTrivia() ([]syntaxComment, bool) {
+	var comments []syntaxComment
+	newlines := 0
+
+	for {
+		r := d.peek()
+		switch r {
+		case '\n':
+			newlines++
+			d.next()
+		case ' ', '\t', '\r', '\v', '\f':
+			d.next()
+		case '/':
+			if !strings.HasPrefix(d.expression[d.pos:], "//") {
+				return comments, newlines > 1
+			}
+			comments = append(comments, syntaxComment{
+				start:       d.pos,
+				text:        d.consumeCommentText(),
+				blankBefore: newlines > 1,
+			})
+			newlines = 0
+		default:
+			if r > 0x7f && unicode.IsSpace(r) {
+				d.next()
+				continue
+			}
+			return comments, newlines > 1
+		}
+	}
+}
+
+// consumeCommentText consumes a `//` comment up to, but not including, the
+// end of the line and returns its text.
+func (d *Document) consumeCommentText() string {
+	start := d.pos
+	end := strings.IndexByte(d.expression[start:], '\n')
+	if end < 0 {
+		end = len(d.expression) - int(start)
+	}
+	d.pos = start + uint(end)
+	return strings.TrimRight(d.expression[start:d.pos], " \t\r")
+}
+
+// collectLineComment consumes a comment on the remainder of the current line,
+// if present.
+func (d *Document) collectLineComment() *syntaxComment {
+	pos := d.pos
+	for pos < uint(len(d.expression)) && (d.expression[pos] == ' ' || d.expression[pos] == '\t') {
+		pos++
+	}
+	if !strings.HasPrefix(d.expression[pos:], "//") {
+		return nil
+	}
+	d.pos = pos
+	return &syntaxComment{start: pos, text: d.consumeCommentText()}
+}
+
+// skipInlineWhitespace skips whitespace without moving past the end of the
+// current line.
+func (d *Document) skipInlineWhitespace() {
+	for {
+		switch d.peek() {
+		case ' ', '\t', '\r':
+			d.next()
+		default:
+			return
+		}
+	}
+}
+
+// parseSyntaxEntries parses object properties or array items until the
+// closing bracket `closer`, or until EOF if `closer` is -1.
+func (d *Document) parseSyntaxEntries(node *syntaxNode, closer rune) Error {
+	isObject := node.kind == syntaxObject
+	first := true
+
+	// Array items between commas may be empty, which the parser reads as
+	// empty strings, e.g. `[1,,2]`. This tracks whether a comma has started
+	// an item which hasn't been seen yet.
+	open := false
+	emptyItem := func(comments []syntaxComment, blank bool) *syntaxEntry {
+		entry := &syntaxEntry{leading: comments, blankBefore: blank, start: d.pos}
+		entry.value = &syntaxNode{kind: syntaxScalar, start: d.pos, end: d.pos}
+		node.entries = append(node.entries, entry)
+		return entry
+	}
+
+	for {
+		if first && closer != -1 {
+			// Determine whether the first entry starts on a new line.
+			rest := d.expression[d.pos:]
+			trimmed := strings.TrimLeft(rest, " \t\r")
+			node.multiline = strings.HasPrefix(trimmed, "\n") || strings.HasPrefix(trimmed, "//")
+		}
+		first = false
+
+		comments, blank := d.collectTrivia()
+		r := d.peek()
+
+		if r == ',' {
+			if !isObject && (len(node.entries) == 0 || open) {
+				entry := emptyItem(comments, blank)
+				entry.comma = true
+				entry.commaPos = d.pos
+				open = true
+				d.next()
+				continue
+			}
+			open = true
+			node.commaOnly = len(node.entries) == 0
+			if len(node.entries) > 0 {
+				last := node.entries[len(node.entries)-1]
+				if !last.comma {
+					last.comma = true
+					last.commaPos = d.pos
+				}
+			}
+			d.next()
+			continue
+		}
+
+		if r == -1 || r == closer || (closer == -1 && (r == '}' || r == ']')) {
+			if r != closer {
+				if closer != -1 {
+					return d.error(1, "Expected '%s' but found %s", runeStr(closer), runeStr(r))
+				}
+				return d.error(1, "Expected EOF but found additional input: %s", runeStr(r))
+			}
+			if !isObject && open {
+				emptyItem(nil, false)
+			}
+			node.trailing = comments
+			if r != -1 {
+				d.next()
+			}
+			node.end = d.pos
+			return nil
+		}
+
+		entry := &syntaxEntry{
+			leading:     comments,
+			blankBefore: blank,
+			start:       d.pos,
+		}
+
+		if isObject {
+			path, err := d.parseProp("", false)
+			if err != nil {
+				return err
+			}
+			entry.key = trimKey(d.expression[entry.start:d.pos])
+			entry.keyEnd = entry.start + uint(len(entry.key))
+			entry.parts = splitPath(path)
+
+			entry.sep = d.next()
+			switch entry.sep {
+			case '{':
+				d.back()
+			case ':':
+			case '^':
+				d.skipWhitespace()
+				start := d.pos
+				if _, err := d.parseProp("", true); err != nil {
+					return err
+				}
+				raw := strings.TrimSpace(d.expression[start:d.pos])
+				entry.value = &syntaxNode{kind: syntaxScalar, start: start, end: start + uint(len(raw))}
+			default:
+				d.back()
+				return d.error(1, "Expected colon but got %v", runeStr(entry.sep))
+			}
+		}
+
+		if entry.value == nil {
+			value, err := d.parseSyntaxValue(true)
+			if err != nil {
+				return err
+			}
+			entry.value = value
+			if !isObject {
+				entry.start = value.start
+				entry.leading = append(entry.leading, value.leading...)
+				value.leading = nil
+			}
+		}
+
+		entry.comment = d.collectLineComment()
+		if entry.comment == nil {
+			d.skipInlineWhitespace()
+			if d.peek() == ',' {
+				entry.comma = true
+				entry.commaPos = d.pos
+				d.next()
+				entry.comment = d.collectLineComment()
+			}
+		}
+
+		node.entries = append(node.entries, entry)
+		open = entry.comma
+	}
+}
+
+// parseSyntaxValue parses a single value, mirroring the rules used by
+// `parseValue` to decide where unquoted values end.
+func (d *Document) parseSyntaxValue(terminateComma bool) (*syntaxNode, Error) {
+	comments, _ := d.collectTrivia()
+	node := &syntaxNode{start: d.pos, leading: comments, braced: true}
+
+	switch d.peek() {
+	case '{':
+		d.next()
+		node.kind = syntaxObject
+		return node, d.parseSyntaxEntries(node, '}')
+	case '[':
+		d.next()
+		node.kind = syntaxArray
+		return node, d.parseSyntaxEntries(node, ']')
+	case '"':
+		d.next()
+		node.kind = syntaxQuoted
+		if err := d.skipQuotedRaw(); err != nil {
+			return nil, err
+		}
+		node.end = d.pos
+		return node, nil
+	}
+
+	node.kind = syntaxScalar
+	for {
+		r := d.next()
+
+		if r == '\\' {
+			if d.peek() != -1 {
+				d.next()
+			}
+			continue
+		}
+
+		if r == '/' && d.peek() == '/' {
+			raw := d.expression[node.start : d.pos-1]
+			if endsWithWhitespace(raw) || canEndValueBeforeComment(strings.TrimSpace(raw), d.options.ForceFloat64Numbers, d.options.EnableSpecialFloats) {
+				d.back()
+				break
+			}
+		}
+
+		if r == -1 || r == '\n' || r == '}' || r == ']' || (terminateComma && r == ',') {
+			d.back()
+			break
+		}
+	}
+	node.end = node.start + uint(len(strings.TrimRightFunc(d.expression[node.start:d.pos], unicode.IsSpace)))
+
+	return node, nil
+}
@@ -0,0 +1,89 @@
+package shorthand
+
+// compiledUpdateOp replaces each value matched by a path with the result of
+// running an operand against it, e.g. `..password |= "***"`. The result is
+// the updated input rather than the matched values.
+type compiledUpdateOp struct {
+	offset uint
+	path   *Query
+	value  queryOperand
+}
+
+// compileUpdate compiles `path |= value`, where the path is everything before
+// the operator and the value is a query or literal like a fallback operand.
+func (d *Document) compileUpdate(token operatorToken, end uint) (compiledOp, Error) {
+	op := compiledUpdateOp{offset: token.offset}
+	path, err := d.compileOperand(d.pos, token.offset, token)
+	if err != nil {
+		return nil, err
+	}
+	if path.query == nil {
+		return nil, NewError(&d.expression, d.pos, token.offset-d.pos, "expected a path to update, but found %v", path.literal)
+	}
+	op.path = path.query
+
+	if op.value, err = d.compileOperand(token.offset+2, end, token); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// execUpdate finds the values matched by the path of an update and sets each
+// to the result of the operand, which is run against the original value. The
+// input itself is not modified.
+func (q *Query) execUpdate(op compiledUpdateOp, input any, options GetOptions) (any, Error) {
+	matches, err := op.path.findMatches(input, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return input, nil
+	}
+
+	result := deepCopy(input)
+	d := Document{Operations: make([]Operation, 0, len(matches))}
+	for _, match := range matches {
+		value, _, _, err := op.value.exec(match.value, nil, options)
+		if err != nil {
+			return nil, err
+		}
+		if match.path == "" {
+			// The path matched the input itself, e.g. `$ |= {id}`.
+			result = value
+			continue
+		}
+		d.Operations = append(d.Operations, Operation{Kind: OpSet, Path: match.path, Value: value})
+	}
+
+	result, err = d.Apply(result)
+	if err != nil {
+		return nil, NewError(&q.expression, op.offset, 2, "%s", err.Error())
+	}
+	return result, nil
+}
+
+// deepCopy copies maps and arrays so that they can be modified without
+// changing the original value. Other values are shared.
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = deepCopy(item)
+		}
+		return out
+	case map[any]any:
+		out := make(map[any]any, len(v))
+		for k, item := range v {
+			out[k] = deepCopy(item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = deepCopy(item)
+		}
+		return out
+	}
+	return value
+}
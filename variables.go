@@ -0,0 +1,147 @@
+package shorthand
+
+import (
+	"math"
+	"strings"
+
+	"github.com/danielgtaylor/mexpr"
+)
+
+// filterVariable is a reference to a variable like `$user`, the root `$`, or
+// a parent like `^` within a filter. The identifier node is replaced by the
+// referenced value when the query runs. The name is empty for the root and
+// parents, where `parents` is the number of levels up.
+type filterVariable struct {
+	node    *mexpr.Node
+	name    string
+	offset  uint
+	parents int
+}
+
+// compiledVariableIndexOp gets an index or key from a variable, e.g. `[$idx]`.
+type compiledVariableIndexOp struct {
+	offset uint
+	name   string
+}
+
+// compiledVariableOp gets a variable at the start of a path, e.g. `$user` in
+// `$user.name` or `count |= $n`. If the variable isn't set, it gets the
+// property with the same name instead so keys like `$ref` still work.
+type compiledVariableOp struct {
+	offset uint
+	name   string
+}
+
+// compileVariable parses a variable reference at the start of a path. It
+// returns false without consuming anything if there is none.
+func (d *Document) compileVariable() (compiledVariableOp, bool) {
+	start := d.pos
+	if d.peek() != '$' {
+		return compiledVariableOp{}, false
+	}
+	for !isScopeEnd(d.peek()) {
+		d.next()
+	}
+	name := d.expression[start:d.pos]
+	if !isVariable(name) {
+		d.pos = start
+		return compiledVariableOp{}, false
+	}
+	return compiledVariableOp{offset: start, name: name[1:]}, true
+}
+
+// isVariable returns whether a name is a variable reference like `$user`.
+func isVariable(name string) bool {
+	if len(name) < 2 || name[0] != '$' {
+		return false
+	}
+	for i, r := range name[1:] {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// findFilterVariables finds the variables, root, and parents referenced by a
+// filter. The base offset is that of the filter within the query, and
+// `parentRefs` are from `replaceParentRefs`.
+func findFilterVariables(ast *mexpr.Node, base uint, parentRefs map[uint16]int, variables []filterVariable) []filterVariable {
+	if ast == nil {
+		return variables
+	}
+
+	switch ast.Type {
+	case mexpr.NodeIdentifier:
+		name, _ := ast.Value.(string)
+		offset := base + uint(ast.Offset)
+		if levels, ok := parentRefs[ast.Offset]; ok && name == strings.Repeat("_", levels) {
+			variables = append(variables, filterVariable{node: ast, offset: offset, parents: levels})
+		} else if name == "$" {
+			variables = append(variables, filterVariable{node: ast, offset: offset})
+		} else if isVariable(name) {
+			variables = append(variables, filterVariable{node: ast, name: name[1:], offset: offset})
+		}
+		return variables
+	case mexpr.NodeFieldSelect:
+		// The right side is a property name, e.g. `$user.id`.
+		return findFilterVariables(ast.Left, base, parentRefs, variables)
+	case mexpr.NodeFunctionCall:
+		if params, ok := ast.Value.([]mexpr.Node); ok {
+			for i := range params {
+				variables = findFilterVariables(&params[i], base, parentRefs, variables)
+			}
+		}
+		return variables
+	}
+
+	variables = findFilterVariables(ast.Left, base, parentRefs, variables)
+	return findFilterVariables(ast.Right, base, parentRefs, variables)
+}
+
+// variableLiterals looks up the values of a filter's variables, returning an
+// error for the first one which isn't set. A missing parent is null.
+func (q *Query) variableLiterals(variables []filterVariable, options GetOptions) (map[*mexpr.Node]any, Error) {
+	if len(variables) == 0 {
+		return nil, nil
+	}
+	literals := make(map[*mexpr.Node]any, len(variables))
+	for _, v := range variables {
+		if v.name == "" {
+			literals[v.node], _ = options.scope.lookup(v.parents)
+			continue
+		}
+		value, err := q.lookupVariable(v.name, v.offset, options)
+		if err != nil {
+			return nil, err
+		}
+		literals[v.node] = value
+	}
+	return literals, nil
+}
+
+// lookupVariable gets the value of a variable from the options.
+func (q *Query) lookupVariable(name string, offset uint, options GetOptions) (any, Error) {
+	value, ok := options.Variables[name]
+	if !ok {
+		return nil, NewError(&q.expression, offset, uint(len(name)+1), "undefined variable $%s", name)
+	}
+	return value, nil
+}
+
+// variableKey resolves a variable index op to either an `int` index or a
+// `string` map key.
+func (q *Query) variableKey(op compiledVariableIndexOp, options GetOptions) (any, Error) {
+	value, err := q.lookupVariable(op.name, op.offset, options)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	if f, ok := toFloat64(value); ok && f == math.Trunc(f) {
+		return int(f), nil
+	}
+	return nil, NewError(&q.expression, op.offset, uint(len(op.name)+1), "variable $%s must be an integer index or string key, but found %v", op.name, value)
+}